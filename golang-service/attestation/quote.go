@@ -0,0 +1,105 @@
+package attestation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Layout of an SGX quote: a 48 byte header followed by the 384 byte report body
+const (
+	quoteHeaderSize = 48
+	reportBodySize  = 384
+
+	mrenclaveOffset  = 64
+	mrsignerOffset   = 128
+	isvProdIDOffset  = 256
+	isvSVNOffset     = 258
+	reportDataOffset = 320
+)
+
+// ReportBody holds the fields of the enclave report body checked by the client
+type ReportBody struct {
+	MRENCLAVE  [32]byte // Measurement of the enclave code and data
+	MRSIGNER   [32]byte // Hash of the enclave signer's public key
+	ISVProdID  uint16   // Product ID assigned by the signer
+	ISVSVN     uint16   // Security version of the enclave
+	ReportData [64]byte // User data bound into the report by the enclave
+}
+
+// Verifier holds the expected enclave identity, empty fields are not checked
+type Verifier struct {
+	MRENCLAVE []byte
+	MRSIGNER  []byte
+	ISVProdID int // Negative to skip the check
+}
+
+// ParseQuote decodes a base64 encoded SGX quote and returns its report body
+func ParseQuote(quote string) (*ReportBody, error) {
+	buf, err := base64.StdEncoding.DecodeString(quote)
+	if err != nil {
+		return nil, fmt.Errorf("Quote is not base64 encoded: %v", err)
+	}
+	if len(buf) < quoteHeaderSize+reportBodySize {
+		return nil, errors.New("Quote too short to hold a report body")
+	}
+
+	return ParseReportBody(buf[quoteHeaderSize : quoteHeaderSize+reportBodySize])
+}
+
+// ParseReportBody parses the 384 byte SGX report body
+func ParseReportBody(b []byte) (*ReportBody, error) {
+	if len(b) != reportBodySize {
+		return nil, fmt.Errorf("Report body is %d bytes, expected %d", len(b), reportBodySize)
+	}
+
+	r := new(ReportBody)
+	copy(r.MRENCLAVE[:], b[mrenclaveOffset:])
+	copy(r.MRSIGNER[:], b[mrsignerOffset:])
+	r.ISVProdID = binary.LittleEndian.Uint16(b[isvProdIDOffset:])
+	r.ISVSVN = binary.LittleEndian.Uint16(b[isvSVNOffset:])
+	copy(r.ReportData[:], b[reportDataOffset:])
+
+	return r, nil
+}
+
+// Enabled reports whether any part of the enclave identity is checked
+func (v *Verifier) Enabled() bool {
+	return len(v.MRENCLAVE) > 0 || len(v.MRSIGNER) > 0 || v.ISVProdID >= 0
+}
+
+// Verify checks the report body against the expected enclave identity
+func (v *Verifier) Verify(r *ReportBody) error {
+	if len(v.MRENCLAVE) > 0 && !bytes.Equal(v.MRENCLAVE, r.MRENCLAVE[:]) {
+		return fmt.Errorf("MRENCLAVE mismatch: got %x", r.MRENCLAVE)
+	}
+	if len(v.MRSIGNER) > 0 && !bytes.Equal(v.MRSIGNER, r.MRSIGNER[:]) {
+		return fmt.Errorf("MRSIGNER mismatch: got %x", r.MRSIGNER)
+	}
+	if v.ISVProdID >= 0 && uint16(v.ISVProdID) != r.ISVProdID {
+		return fmt.Errorf("ISVProdID mismatch: expected %d, got %d", v.ISVProdID, r.ISVProdID)
+	}
+	return nil
+}
+
+// KeyBinding returns the report data an enclave binds its verification key with: the sha256 of the
+// DER encoded (PKIX) public key in the first 32 bytes, the remaining bytes are not checked
+func KeyBinding(verificationKeyDER []byte) [64]byte {
+	var data [64]byte
+	h := sha256.Sum256(verificationKeyDER)
+	copy(data[:], h[:])
+	return data
+}
+
+// VerifyKeyBinding checks that the report binds the verification key, so signatures made with it
+// come from the attested enclave and not from a key the server substituted
+func VerifyKeyBinding(r *ReportBody, verificationKeyDER []byte) error {
+	want := KeyBinding(verificationKeyDER)
+	if !bytes.Equal(r.ReportData[:sha256.Size], want[:sha256.Size]) {
+		return fmt.Errorf("Report data %x does not bind the verification key", r.ReportData[:sha256.Size])
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package attestation
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"testing"
+)
+
+// testQuote returns a base64 encoded quote of an enclave binding the verification key
+func testQuote(verificationKeyDER []byte) string {
+	buf := make([]byte, quoteHeaderSize+reportBodySize)
+	body := buf[quoteHeaderSize:]
+	for i := 0; i < 32; i++ {
+		body[mrenclaveOffset+i] = 0xe0
+		body[mrsignerOffset+i] = 0x51
+	}
+	body[isvProdIDOffset] = 7
+	data := KeyBinding(verificationKeyDER)
+	copy(body[reportDataOffset:], data[:])
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func testKeyDER(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// TestVerifyKeyBindingSwappedKey pairs the quote with another verification key than the one the
+// enclave bound, as a server signing RTHs with a key of its own would
+func TestVerifyKeyBindingSwappedKey(t *testing.T) {
+	attested, swapped := testKeyDER(t), testKeyDER(t)
+
+	r, err := ParseQuote(testQuote(attested))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &Verifier{MRENCLAVE: r.MRENCLAVE[:], MRSIGNER: r.MRSIGNER[:], ISVProdID: 7}
+	if err = v.Verify(r); err != nil {
+		t.Fatalf("identity of the quote: %v", err)
+	}
+
+	if err = VerifyKeyBinding(r, attested); err != nil {
+		t.Errorf("attested key: %v", err)
+	}
+	if err = VerifyKeyBinding(r, swapped); err == nil {
+		t.Error("swapped key accepted")
+	}
+	if err = VerifyKeyBinding(r, attested[:len(attested)-1]); err == nil {
+		t.Error("truncated encoding of the attested key accepted")
+	}
+}
+
+func TestVerifyISVProdID(t *testing.T) {
+	r, err := ParseQuote(testQuote(testKeyDER(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		isvProdID int
+		wantErr   bool
+	}{
+		{name: "expected product", isvProdID: 7},
+		{name: "another product", isvProdID: 8, wantErr: true},
+		{name: "product 0", isvProdID: 0, wantErr: true},
+		{name: "check skipped", isvProdID: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Verifier{MRENCLAVE: r.MRENCLAVE[:], MRSIGNER: r.MRSIGNER[:], ISVProdID: tt.isvProdID}
+			if err := v.Verify(r); (err != nil) != tt.wantErr {
+				t.Errorf("Verify: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
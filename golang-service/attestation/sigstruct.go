@@ -0,0 +1,74 @@
+package attestation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+)
+
+// Layout of the enclave signature structure (SIGSTRUCT) produced by sgx_sign
+const (
+	sigstructSize = 1808
+
+	sigstructHeader2Offset     = 24
+	sigstructModulusOffset     = 128
+	sigstructModulusSize       = 384
+	sigstructEnclaveHashOffset = 960
+	sigstructISVProdIDOffset   = 1024
+	sigstructISVSVNOffset      = 1026
+)
+
+// Fixed header fields every SIGSTRUCT starts with
+var (
+	sigstructHeader  = []byte{0x06, 0x00, 0x00, 0x00, 0xe1, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00}
+	sigstructHeader2 = []byte{0x01, 0x01, 0x00, 0x00, 0x60, 0x00, 0x00, 0x00, 0x60, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00}
+)
+
+// Sigstruct holds the enclave identity signed into the enclave at build time
+type Sigstruct struct {
+	MRENCLAVE [32]byte // ENCLAVEHASH, the expected enclave measurement
+	MRSIGNER  [32]byte // sha256 of the signer's modulus
+	ISVProdID uint16
+	ISVSVN    uint16
+}
+
+// ReadSigstruct reads the SIGSTRUCT from a file, either a raw signature structure
+// or a signed enclave (enclave.signed.so) carrying it in its metadata
+func ReadSigstruct(filename string) (*Sigstruct, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSigstruct(buf)
+}
+
+// ParseSigstruct locates the SIGSTRUCT in buf by its fixed headers and parses it
+func ParseSigstruct(buf []byte) (*Sigstruct, error) {
+	for off := 0; off+sigstructSize <= len(buf); off++ {
+		i := bytes.Index(buf[off:], sigstructHeader)
+		if i < 0 {
+			break
+		}
+		off += i
+		if off+sigstructSize > len(buf) {
+			break
+		}
+
+		b := buf[off : off+sigstructSize]
+		if !bytes.Equal(b[sigstructHeader2Offset:sigstructHeader2Offset+len(sigstructHeader2)], sigstructHeader2) {
+			continue
+		}
+
+		s := new(Sigstruct)
+		copy(s.MRENCLAVE[:], b[sigstructEnclaveHashOffset:])
+		s.MRSIGNER = sha256.Sum256(b[sigstructModulusOffset : sigstructModulusOffset+sigstructModulusSize])
+		s.ISVProdID = binary.LittleEndian.Uint16(b[sigstructISVProdIDOffset:])
+		s.ISVSVN = binary.LittleEndian.Uint16(b[sigstructISVSVNOffset:])
+		return s, nil
+	}
+
+	return nil, errors.New("No SIGSTRUCT found")
+}
@@ -0,0 +1,63 @@
+package attestation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+// testSigstruct returns a synthetic SIGSTRUCT with the given enclave hash and product,
+// and a modulus of repeated 0x4d bytes
+func testSigstruct(mrenclave byte, isvProdID, isvSVN uint16) []byte {
+	b := make([]byte, sigstructSize)
+	copy(b, sigstructHeader)
+	copy(b[sigstructHeader2Offset:], sigstructHeader2)
+	copy(b[sigstructModulusOffset:], bytes.Repeat([]byte{0x4d}, sigstructModulusSize))
+	copy(b[sigstructEnclaveHashOffset:], bytes.Repeat([]byte{mrenclave}, 32))
+	binary.LittleEndian.PutUint16(b[sigstructISVProdIDOffset:], isvProdID)
+	binary.LittleEndian.PutUint16(b[sigstructISVSVNOffset:], isvSVN)
+	return b
+}
+
+// TestParseSigstructEmbedded parses a SIGSTRUCT embedded in a larger file, as in the metadata of
+// a signed enclave
+func TestParseSigstructEmbedded(t *testing.T) {
+	buf := bytes.Repeat([]byte{0xaa}, 4096)
+	copy(buf[1001:], testSigstruct(0xe0, 7, 3))
+
+	s, err := ParseSigstruct(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Repeat([]byte{0xe0}, 32); !bytes.Equal(s.MRENCLAVE[:], want) {
+		t.Errorf("MRENCLAVE %x, want %x", s.MRENCLAVE, want)
+	}
+	if want := sha256.Sum256(bytes.Repeat([]byte{0x4d}, sigstructModulusSize)); s.MRSIGNER != want {
+		t.Errorf("MRSIGNER %x, want %x", s.MRSIGNER, want)
+	}
+	if s.ISVProdID != 7 || s.ISVSVN != 3 {
+		t.Errorf("ISVProdID %d, ISVSVN %d, want 7 and 3", s.ISVProdID, s.ISVSVN)
+	}
+}
+
+// TestParseSigstructWrongHeader2 skips a match of the first header whose second header differs
+func TestParseSigstructWrongHeader2(t *testing.T) {
+	decoy := testSigstruct(0xde, 1, 1)
+	decoy[sigstructHeader2Offset] ^= 0xff
+
+	buf := make([]byte, 4*sigstructSize)
+	copy(buf[16:], decoy)
+	if _, err := ParseSigstruct(buf); err == nil {
+		t.Fatal("SIGSTRUCT with a wrong second header parsed")
+	}
+
+	copy(buf[16+sigstructSize:], testSigstruct(0xe0, 7, 3))
+	s, err := ParseSigstruct(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.MRENCLAVE[0] != 0xe0 || s.ISVProdID != 7 {
+		t.Errorf("MRENCLAVE %x, ISVProdID %d parsed, want the SIGSTRUCT after the wrong header", s.MRENCLAVE, s.ISVProdID)
+	}
+}
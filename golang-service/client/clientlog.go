@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// clientLogDomain prefixes the serialized entry in the entry hash
+const clientLogDomain = "sgx-decryption-service client log v1\x00"
+
+// clientLogGenesis is the previous hash of the first entry
+var clientLogGenesis = hex.EncodeToString(make([]byte, sha256.Size))
+
+// clientLogEntry is one line of the client log, a decryption the client made.
+// Only hashes are logged, never the plaintext.
+type clientLogEntry struct {
+	Seq        uint64 `json:"seq"`
+	Time       int64  `json:"time"`
+	Ciphertext string `json:"ciphertext"`          // hex encoded sha256 of the ciphertext
+	Plaintext  string `json:"plaintext,omitempty"` // hex encoded sha256 of the plaintext, empty when the decryption failed
+	Error      string `json:"error,omitempty"`
+	Prev       string `json:"prev"` // hash of the previous entry
+	Hash       string `json:"hash"` // sha256 over the domain and the entry without hash and signature
+	Sig        []byte `json:"sig,omitempty"`
+}
+
+// hash returns the entry hash, covering the previous hash and so the whole chain before the entry
+func (e clientLogEntry) hash() []byte {
+	e.Hash, e.Sig = "", nil
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h := sha256.Sum256(append([]byte(clientLogDomain), b...))
+	return h[:]
+}
+
+// clientLog appends hash-chained entries to a file, signing their hashes when given a key
+type clientLog struct {
+	mu     sync.Mutex
+	file   *os.File
+	signer crypto.Signer
+	seq    uint64
+	prev   string
+}
+
+// openClientLog opens the client log for appending, after verifying the entries it already holds.
+// With a signer their signatures are verified too, so signed entries are not appended to a log
+// that another key, or no key, signed.
+func openClientLog(filename string, signer crypto.Signer) (*clientLog, error) {
+	l := &clientLog{signer: signer, prev: clientLogGenesis}
+
+	var pub crypto.PublicKey
+	if signer != nil {
+		pub = signer.Public()
+	}
+	if f, err := os.Open(filename); err == nil {
+		last, n, err := verifyClientLog(f, pub)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if n > 0 {
+			l.seq, l.prev = last.Seq+1, last.Hash
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l.file = file
+	return l, nil
+}
+
+// Append logs the decryption of a ciphertext, with the plaintext hash or the error
+func (l *clientLog) Append(ctSum [32]byte, plaintext []byte, decErr error) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := clientLogEntry{Seq: l.seq, Time: clk.Now().Unix(), Ciphertext: hex.EncodeToString(ctSum[:]), Prev: l.prev}
+	if decErr != nil {
+		e.Error = decErr.Error()
+	} else {
+		ptSum := sha256.Sum256(plaintext)
+		e.Plaintext = hex.EncodeToString(ptSum[:])
+	}
+
+	h := e.hash()
+	e.Hash = hex.EncodeToString(h)
+	if l.signer != nil {
+		var err error
+		if e.Sig, err = signClientLog(l.signer, h); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err = l.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	l.seq, l.prev = e.Seq+1, e.Hash
+	return nil
+}
+
+func (l *clientLog) Close() error {
+	return l.file.Close()
+}
+
+// signClientLog signs an entry hash, Ed25519 signs it as is, RSA as a SHA-256 digest
+func signClientLog(signer crypto.Signer, h []byte) ([]byte, error) {
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, h, crypto.Hash(0))
+	}
+	return signer.Sign(rand.Reader, h, crypto.SHA256)
+}
+
+// verifyClientLogSig checks the signature of an entry hash with the public key
+func verifyClientLogSig(pub crypto.PublicKey, h, sig []byte) error {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, h, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h, sig)
+	}
+	return fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// verifyClientLog checks the chain of the entries read from r: sequence numbers, previous hashes
+// and entry hashes, and with a public key the signature of every entry.
+// Returns the last entry and the number of entries.
+func verifyClientLog(r io.Reader, pub crypto.PublicKey) (last clientLogEntry, n int, err error) {
+	prev := clientLogGenesis
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		var e clientLogEntry
+		dec := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&e); err != nil {
+			return last, n, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		switch {
+		case e.Seq != uint64(n):
+			return last, n, fmt.Errorf("line %d: sequence number %d, want %d", line, e.Seq, n)
+		case e.Prev != prev:
+			return last, n, fmt.Errorf("line %d: previous hash does not match the entry before", line)
+		case e.Hash != hex.EncodeToString(e.hash()):
+			return last, n, fmt.Errorf("line %d: entry hash does not match the entry", line)
+		}
+		if pub != nil {
+			h, _ := hex.DecodeString(e.Hash)
+			if err = verifyClientLogSig(pub, h, e.Sig); err != nil {
+				return last, n, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+
+		last, prev = e, e.Hash
+		n++
+	}
+	return last, n, scanner.Err()
+}
+
+// readSigningKey reads a PKCS#8 PEM private key as written by the keygen subcommand
+func readSigningKey(filename string) (crypto.Signer, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: key of type %T cannot sign", filename, key)
+	}
+	return signer, nil
+}
+
+// readPEM reads the first PEM block of a file
+func readPEM(filename string) (*pem.Block, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", filename)
+	}
+	return block, nil
+}
+
+// verifyClientLogCmd implements the verify-client-log subcommand: it checks the hash chain
+// of a client log and, given the public key, the signatures of its entries
+func verifyClientLogCmd(args []string) {
+	fs := flag.NewFlagSet("verify-client-log", flag.ExitOnError)
+	pubFile := fs.String("pub", "", "PEM file with the public key the entries are signed with (printed by keygen), unsigned logs are only checked for their chain")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s verify-client-log [flags] file\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var pub crypto.PublicKey
+	if *pubFile != "" {
+		block, err := readPEM(*pubFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	last, n, err := verifyClientLog(f, pub)
+	if err != nil {
+		log.Fatalf("client log does not verify: %v", err)
+	}
+	if n == 0 {
+		fmt.Println("client log is empty")
+		return
+	}
+	fmt.Printf("ok   %d entries, head %s\n", n, last.Hash)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sewelol/sgx-decryption-service/clock"
+)
+
+func testSigner(t *testing.T) crypto.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv
+}
+
+// writeClientLog appends n entries to the client log, signed when given a signer
+func writeClientLog(t *testing.T, filename string, signer crypto.Signer, n int) {
+	t.Helper()
+	l, err := openClientLog(filename, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < n; i++ {
+		if err = l.Append(sha256.Sum256([]byte{byte(i)}), []byte("plaintext"), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenClientLogVerifiesSignatures(t *testing.T) {
+	key, other := testSigner(t), testSigner(t)
+
+	tests := []struct {
+		name    string
+		written crypto.Signer // key the existing entries were signed with
+		opened  crypto.Signer // -client-log-key when the log is opened again
+		wantErr bool
+	}{
+		{name: "same key", written: key, opened: key},
+		{name: "another key", written: key, opened: other, wantErr: true},
+		{name: "unsigned log opened with a key", opened: key, wantErr: true},
+		{name: "signed log opened without a key", written: key},
+		{name: "unsigned", written: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "client.log")
+			writeClientLog(t, filename, tt.written, 2)
+
+			l, err := openClientLog(filename, tt.opened)
+			if tt.wantErr {
+				if err == nil {
+					l.Close()
+					t.Fatal("log opened")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = l.Append(sha256.Sum256([]byte("next")), nil, errors.New("failed")); err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+			if l.seq != 3 {
+				t.Fatalf("appended entry %d, want entry 2 after the existing ones", l.seq-1)
+			}
+		})
+	}
+}
+
+// readClientLog returns the lines of the client log
+func readClientLog(t *testing.T, filename string) []string {
+	t.Helper()
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(buf), "\n"), "\n")
+}
+
+// editEntry decodes the entry on a line, edits it and encodes it again
+func editEntry(t *testing.T, line string, edit func(e *clientLogEntry)) string {
+	t.Helper()
+	var e clientLogEntry
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatal(err)
+	}
+	edit(&e)
+	buf, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestVerifyClientLogTampered(t *testing.T) {
+	key := testSigner(t)
+	rehash := func(e *clientLogEntry) { e.Hash = hex.EncodeToString(e.hash()) }
+
+	tests := []struct {
+		name   string
+		signed bool
+		tamper func(lines []string) []string
+	}{
+		{name: "entry edited", tamper: func(lines []string) []string {
+			lines[1] = editEntry(t, lines[1], func(e *clientLogEntry) { e.Error = "failed" })
+			return lines
+		}},
+		{name: "entry edited and rehashed", tamper: func(lines []string) []string {
+			lines[1] = editEntry(t, lines[1], func(e *clientLogEntry) { e.Plaintext = ""; rehash(e) })
+			return lines
+		}},
+		{name: "last entry edited and rehashed", signed: true, tamper: func(lines []string) []string {
+			lines[2] = editEntry(t, lines[2], func(e *clientLogEntry) { e.Time++; rehash(e) })
+			return lines
+		}},
+		{name: "entry deleted", tamper: func(lines []string) []string {
+			return append(lines[:1], lines[2:]...)
+		}},
+		{name: "entry deleted and renumbered", tamper: func(lines []string) []string {
+			lines[2] = editEntry(t, lines[2], func(e *clientLogEntry) { e.Seq = 1; rehash(e) })
+			return append(lines[:1], lines[2:]...)
+		}},
+		{name: "entries reordered", tamper: func(lines []string) []string {
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}},
+		{name: "entries reordered and renumbered", tamper: func(lines []string) []string {
+			lines[1] = editEntry(t, lines[1], func(e *clientLogEntry) { e.Seq = 2; rehash(e) })
+			lines[2] = editEntry(t, lines[2], func(e *clientLogEntry) { e.Seq = 1; rehash(e) })
+			lines[1], lines[2] = lines[2], lines[1]
+			return lines
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var signer crypto.Signer
+			var pub crypto.PublicKey
+			if tt.signed {
+				signer, pub = key, key.Public()
+			}
+			filename := filepath.Join(t.TempDir(), "client.log")
+			writeClientLog(t, filename, signer, 3)
+
+			lines := readClientLog(t, filename)
+			if _, n, err := verifyClientLog(strings.NewReader(strings.Join(lines, "\n")), nil); err != nil || n != 3 {
+				t.Fatalf("log as written: %d entries, %v", n, err)
+			}
+			tampered := strings.Join(tt.tamper(lines), "\n")
+			if _, _, err := verifyClientLog(strings.NewReader(tampered), pub); err == nil {
+				t.Fatal("tampered log verified")
+			}
+		})
+	}
+}
+
+func TestClientLogTime(t *testing.T) {
+	defer func(c clock.Clock) { clk = c }(clk)
+	clk = clock.NewFake(time.Unix(1500000000, 0))
+
+	filename := filepath.Join(t.TempDir(), "client.log")
+	writeClientLog(t, filename, nil, 1)
+	var e clientLogEntry
+	if err := json.Unmarshal([]byte(readClientLog(t, filename)[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Time != 1500000000 {
+		t.Errorf("entry logged at %d, want the time of the clock 1500000000", e.Time)
+	}
+}
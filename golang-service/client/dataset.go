@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+	"golang.org/x/net/context"
+)
+
+// dataset is a pair of records and proofs files processed together
+type dataset struct {
+	recordsFile string
+	proofsFile  string
+	records     []record // joined records, in proofs file order
+	prefix      string   // log prefix, empty when there is a single dataset
+	filePrefix  string   // prefix of the -output-dir file names, empty when there is a single dataset
+}
+
+func (ds *dataset) name() string {
+	return ds.recordsFile + "," + ds.proofsFile
+}
+
+func (ds *dataset) logf(format string, v ...interface{}) {
+	log.Printf(ds.prefix+format, v...)
+}
+
+// datasetFlag collects the -dataset pairs
+type datasetFlag []*dataset
+
+func (d *datasetFlag) String() string {
+	var names []string
+	for _, ds := range *d {
+		names = append(names, ds.name())
+	}
+	return strings.Join(names, " ")
+}
+
+func (d *datasetFlag) Set(s string) error {
+	files := strings.Split(s, ",")
+	if len(files) != 2 || files[0] == "" || files[1] == "" {
+		return errors.New("expected records,proofs")
+	}
+	*d = append(*d, &dataset{recordsFile: files[0], proofsFile: files[1]})
+	return nil
+}
+
+// load reads the records and proofs files of the dataset and joins them by ciphertext hash
+func (ds *dataset) load() error {
+	ctDB, err := readRecords(ds.recordsFile)
+	if err != nil {
+		return err
+	}
+	if *useProofsIndex {
+		return ds.loadIndexed(ctDB)
+	}
+	proofs, err := readProofs(ds.proofsFile)
+	if err != nil {
+		return err
+	}
+
+	records, orphanProofs, orphanRecords := joinRecords(ctDB, proofs)
+	for _, p := range orphanProofs {
+		ds.logf("no ciphertext for proof of record %s", hex.EncodeToString(p.ctSum[:]))
+	}
+	for _, ctSum := range orphanRecords {
+		ds.logf("no proof for record %s", hex.EncodeToString(ctSum[:]))
+	}
+	ds.logf("%d records with proofs, %d orphan proofs, %d orphan records", len(records), len(orphanProofs), len(orphanRecords))
+
+	ds.records = records
+	return nil
+}
+
+// loadIndexed looks up the proofs of the records in the index of the proofs file, so only
+// the proofs of records in the records file are held in memory
+func (ds *dataset) loadIndexed(ctDB map[[32]byte][]byte) error {
+	ix, err := openProofIndex(ds.proofsFile)
+	if err != nil {
+		return err
+	}
+	defer ix.Close()
+
+	records, orphanRecords, err := readIndexedRecords(ctDB, ix)
+	if err != nil {
+		return err
+	}
+	for _, ctSum := range orphanRecords {
+		ds.logf("no proof for record %s", hex.EncodeToString(ctSum[:]))
+	}
+	ds.logf("%d records with proofs in the index, %d orphan records", len(records), len(orphanRecords))
+
+	ds.records = records
+	return nil
+}
+
+// batch holds what the datasets of one invocation share: the attested connection,
+// the verified RTH, the local checks and the outputs
+type batch struct {
+	client   *dc.Client
+	stop     <-chan struct{}
+	rth      []byte              // RTH the proofs of extension of the next dataset start from, advanced by every dataset
+	pinned   bool                // the RTH was obtained out-of-band or agreed by sources, the proofs must build on it
+	selected map[[32]byte]string // IDs of the records to send, nil to send all
+	ctProofs map[[32]byte]pt.CTInclusionProof
+	ctRoot   []byte
+	baseline []byte
+	reached  map[[32]byte]bool // RTHs reached from the baseline, across the datasets
+	expected map[[32]byte][32]byte
+	out      *resultWriter
+	dir      *dirWriter
+	clog     *clientLog
+}
+
+// datasetReport summarizes the processing of one dataset
+type datasetReport struct {
+	rejected, decrypted, failed, skipped int
+	malformed                            int
+	compared, mismatches, unexpected     int
+	truncated                            bool
+}
+
+// exit returns the exit code of the dataset, a mismatch outranks a malformed plaintext,
+// which outranks a truncated run
+func (r datasetReport) exit() int {
+	switch {
+	case r.mismatches > 0:
+		return exitMismatch
+	case r.malformed > 0:
+		return exitMalformed
+	case r.truncated:
+		return exitTruncated
+	}
+	return 0
+}
+
+// process verifies the records of the dataset locally in log order, decrypts the accepted ones
+// and writes their results. The RTH of the batch moves on to the one the device holds after the
+// records that were sent.
+func (b *batch) process(ds *dataset) (rep datasetReport) {
+	// Verify the records locally, in log order
+	// The device moves on to the RTH of the extension once the proofs verify, whether or not the decryption succeeds
+	currentRTH := b.rth
+	var accepted []record
+	var positions []int
+	var rths [][]byte // RTH of the device after each accepted record
+	var requests []dc.Record
+	for pos, r := range ds.records {
+		if b.selected != nil {
+			if _, ok := b.selected[r.ctSum]; !ok {
+				continue
+			}
+		}
+		newRTH, err := b.verify(r, currentRTH)
+		if err != nil {
+			ds.logf("rejected record %s: %v", hex.EncodeToString(r.ctSum[:]), err)
+			rep.rejected++
+			continue
+		}
+		currentRTH = newRTH
+
+		accepted = append(accepted, r)
+		positions = append(positions, pos)
+		rths = append(rths, currentRTH)
+		requests = append(requests, dc.Record{Ciphertext: r.ct, ProofOfPresence: r.pop, ProofOfExtension: r.poe, BaselineRTH: b.baseline})
+	}
+	if b.verifying() {
+		ds.logf("%d records rejected by local proof verification", rep.rejected)
+	}
+
+	//  Remote call for DecryptRecord
+	results, runErr := b.client.DecryptAllUntil(context.Background(), b.stop, requests)
+	defer results.Close()
+	for i, res := range results {
+		r := accepted[i]
+		if res.Err == dc.ErrNotAttempted {
+			rep.skipped++
+			continue
+		}
+		b.rth = rths[i]
+		plaintext, err := res.Open()
+		var malformed error
+		if err == nil {
+			malformed = plaintextSchemaRules.check(plaintext)
+		}
+		if b.out != nil {
+			res := result{ID: b.selected[r.ctSum], Hash: hex.EncodeToString(r.ctSum[:]), Plaintext: plaintext}
+			if err != nil {
+				res.Error = err.Error()
+			}
+			if malformed != nil {
+				res.Malformed = malformed.Error()
+			}
+			if werr := b.out.Write(res); werr != nil {
+				log.Fatalf("could not write result: %v", werr)
+			}
+		}
+		if b.clog != nil {
+			if werr := b.clog.Append(r.ctSum, plaintext, err); werr != nil {
+				log.Fatalf("could not append to the client log: %v", werr)
+			}
+		}
+		if b.dir != nil && err == nil && malformed == nil {
+			name := hex.EncodeToString(r.ctSum[:])
+			switch *outputName {
+			case "index":
+				name = fmt.Sprintf("%08d", positions[i])
+			case "id":
+				name = b.selected[r.ctSum]
+			}
+			if werr := b.dir.Write(ds.filePrefix+name, plaintext); werr != nil {
+				log.Fatalf("could not write plaintext: %v", werr)
+			}
+		}
+		switch {
+		case err != nil:
+			ds.logf("could not decrypt record: %v", err)
+			rep.failed++
+		case malformed != nil:
+			ds.logf("malformed plaintext of record %s: %v", hex.EncodeToString(r.ctSum[:]), malformed)
+			rep.malformed++
+		default:
+			if len(plaintext) > 0 {
+				fmt.Printf("\rDecryptRecord(%s) = %d", hex.EncodeToString(r.ctSum[:]), plaintext[0])
+			} else {
+				fmt.Printf("\rDecryptRecord(%s) = empty plaintext", hex.EncodeToString(r.ctSum[:]))
+			}
+			rep.decrypted++
+		}
+
+		if b.expected != nil {
+			want, ok := b.expected[r.ctSum]
+			switch {
+			case !ok:
+				rep.unexpected++
+			case err != nil:
+				ds.logf("mismatch for record %s: could not decrypt", hex.EncodeToString(r.ctSum[:]))
+				rep.mismatches++
+			case sha256.Sum256(plaintext) != want:
+				ds.logf("mismatch for record %s: plaintext differs from the expected one", hex.EncodeToString(r.ctSum[:]))
+				rep.mismatches++
+			}
+		}
+	}
+	rep.compared = len(results) - rep.skipped - rep.unexpected
+
+	if runErr == dc.ErrNotAttempted {
+		ds.logf("run truncated by -max-runtime %s: %d records decrypted, %d failed, %d not attempted", *maxRuntime, rep.decrypted, rep.failed, rep.skipped)
+		rep.truncated = true
+	}
+	if plaintextSchemaRules != nil {
+		ds.logf("%d of %d decrypted plaintexts do not conform to -plaintext-schema", rep.malformed, rep.decrypted+rep.malformed)
+	}
+	if b.expected != nil {
+		ds.logf("%d of %d compared plaintexts differ, %d records have no expected plaintext", rep.mismatches, rep.compared, rep.unexpected)
+	}
+	return rep
+}
+
+// verifying reports whether records are verified locally before they are sent
+func (b *batch) verifying() bool {
+	return *requirePOE || b.pinned || b.ctProofs != nil || b.baseline != nil
+}
+
+// verify runs the local checks of a record against the RTH the device holds before it: inclusion
+// in the external log, the proof of extension from the RTH, the proof of presence in the extended
+// tree when the RTH is pinned, and the extension of the baseline. It returns the RTH of the device
+// once the record is sent, currentRTH when the proof of extension is not checked.
+func (b *batch) verify(r record, currentRTH []byte) ([]byte, error) {
+	if b.ctProofs != nil {
+		if err := checkExternalInclusion(r, b.ctProofs, b.ctRoot); err != nil {
+			return nil, err
+		}
+	}
+
+	if *requirePOE || b.pinned {
+		newRTH, err := checkExtension(r.poe, currentRTH)
+		if err == nil && b.pinned {
+			err = checkPresence(r, newRTH)
+		}
+		if err != nil {
+			return nil, err
+		}
+		currentRTH = newRTH[:]
+	}
+
+	if b.baseline != nil {
+		if b.reached == nil {
+			var h [32]byte
+			copy(h[:], b.baseline)
+			b.reached = map[[32]byte]bool{h: true}
+		}
+		if err := checkBaseline(r, b.reached); err != nil {
+			return nil, err
+		}
+	}
+	return currentRTH, nil
+}
+
+// processAll processes the datasets one after another, in the order given, and returns the combined
+// exit code. The device holds a single RTH that every decryption moves forward, so the datasets cannot
+// run concurrently: the proofs of extension of a dataset build on the RTH the previous one left.
+func (b *batch) processAll(datasets []*dataset) int {
+	reports := make([]datasetReport, len(datasets))
+	for i, ds := range datasets {
+		reports[i] = b.process(ds)
+	}
+
+	exit := 0
+	for i, rep := range reports {
+		if len(datasets) > 1 {
+			log.Printf("dataset %s: %d decrypted, %d malformed, %d failed, %d rejected, %d not attempted, %d mismatches",
+				datasets[i].name(), rep.decrypted, rep.malformed, rep.failed, rep.rejected, rep.skipped, rep.mismatches)
+		}
+		if e := rep.exit(); exitRank(e) > exitRank(exit) {
+			exit = e
+		}
+	}
+	return exit
+}
+
+// exitRank orders the exit codes of the datasets, the combined exit code is the highest ranked
+func exitRank(code int) int {
+	switch code {
+	case exitMismatch:
+		return 3
+	case exitMalformed:
+		return 2
+	case exitTruncated:
+		return 1
+	}
+	return 0
+}
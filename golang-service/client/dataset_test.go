@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// echoDevice decrypts every record to its ciphertext and remembers the order the records came in
+type echoDevice struct {
+	pb.DecryptionDeviceClient
+	mu  sync.Mutex
+	got [][]byte
+}
+
+func (d *echoDevice) DecryptRecord(ctx context.Context, in *pb.DecryptionRequest, opts ...grpc.CallOption) (*pb.Record, error) {
+	d.mu.Lock()
+	d.got = append(d.got, in.Ciphertext)
+	d.mu.Unlock()
+	tag := sha256.Sum256(in.Ciphertext)
+	return &pb.Record{Plaintext: in.Ciphertext, Tag: tag[:]}, nil
+}
+
+// appendProof returns the JSON proof of extension appending the leaf to the tree with the given RTH
+func appendProof(t *testing.T, rth []byte, leaf [32]byte) string {
+	t.Helper()
+	old := pt.ProofNode{Hash: hex.EncodeToString(rth)}
+	poe := pt.ProofTree{OldProof: old, NewProof: pt.ProofNode{Left: &old, Right: &pt.ProofNode{Hash: hex.EncodeToString(leaf[:])}}}
+	buf, err := json.Marshal(poe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// TestProcessAllChainsRTH processes two datasets whose proofs of extension chain, in both orders.
+// Only the order in which the second dataset builds on the RTH the first one left the device at is sent in full.
+func TestProcessAllChainsRTH(t *testing.T) {
+	genesis := sha256.Sum256([]byte("genesis"))
+	ctA, a := testCiphertext("a")
+	ctB, b := testCiphertext("b")
+	rthA := pt.ComputeRTH([][]byte{genesis[:], a[:]})
+	rthB := pt.ComputeRTH([][]byte{genesis[:], a[:], b[:]})
+
+	newDataset := func(name string, ct []byte, ctSum [32]byte, poe string) *dataset {
+		return &dataset{
+			recordsFile: name + ".csv",
+			proofsFile:  name + "_proofs.csv",
+			records:     []record{{ct: ct, proof: proof{ctSum: ctSum, poe: poe}}},
+			prefix:      "[" + name + "] ",
+			filePrefix:  name + "-",
+		}
+	}
+	dsA := newDataset("a", ctA, a, appendProof(t, genesis[:], a))
+	dsB := newDataset("b", ctB, b, appendProof(t, rthA, b))
+
+	defer func(poe bool, name string) { *requirePOE, *outputName = poe, name }(*requirePOE, *outputName)
+	*requirePOE = true
+	*outputName = "index"
+
+	tests := []struct {
+		name     string
+		datasets []*dataset
+		want     [][]byte // ciphertexts sent, in order
+		wantRTH  []byte
+	}{
+		{name: "chained", datasets: []*dataset{dsA, dsB}, want: [][]byte{ctA, ctB}, wantRTH: rthB},
+		{name: "out of order", datasets: []*dataset{dsB, dsA}, want: [][]byte{ctA}, wantRTH: rthA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := new(echoDevice)
+			dir, err := newDirWriter(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			bt := &batch{client: dc.New(dev), stop: make(chan struct{}), rth: genesis[:], dir: dir}
+			if exit := bt.processAll(tt.datasets); exit != 0 {
+				t.Errorf("exit code %d", exit)
+			}
+
+			if len(dev.got) != len(tt.want) {
+				t.Fatalf("%d records sent, want %d", len(dev.got), len(tt.want))
+			}
+			for i := range tt.want {
+				if !bytes.Equal(dev.got[i], tt.want[i]) {
+					t.Errorf("record %d sent: %q, want %q", i, dev.got[i], tt.want[i])
+				}
+			}
+			if !bytes.Equal(bt.rth, tt.wantRTH) {
+				t.Errorf("RTH after the datasets %x, want %x", bt.rth, tt.wantRTH)
+			}
+
+			// both datasets have a record at index 0, the prefix keeps their files apart
+			for i, ct := range tt.want {
+				name := "a-00000000"
+				if i == 1 {
+					name = "b-00000000"
+				}
+				got, err := ioutil.ReadFile(filepath.Join(dir.dir, name))
+				if err != nil || !bytes.Equal(got, ct) {
+					t.Errorf("file %s: %q, %v, want %q", name, got, err, ct)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+)
+
+// decodeProof implements the decode-proof subcommand: it prints the structure of a proof
+// and the hashes computed from it, and reports which of the checks fail
+func decodeProof(args []string) {
+	fs := flag.NewFlagSet("decode-proof", flag.ExitOnError)
+	rthHex := fs.String("rth", "", "hex encoded RTH to compare the computed root with")
+	leafHex := fs.String("leaf", "", "hex encoded leaf hash (sha256 of the ciphertext) to locate in the proof")
+	treeSize := fs.Uint64("tree-size", 0, "number of leafs in the tree, needed for the leaf index")
+	hasher := fs.String("hasher", "service", "hasher of an audit path proof: service or rfc6962")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s decode-proof [flags] [file]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reads a JSON proof tree, or a compact audit path ({\"leaf_index\", \"audit_path\"}),\n")
+		fmt.Fprintf(os.Stderr, "from file or stdin (no file or \"-\").\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	in, err := readProofInput(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	rth := decodeHexFlag("rth", *rthHex)
+	leaf := decodeHexFlag("leaf", *leafHex)
+
+	if bytes.Contains(in, []byte(`"audit_path"`)) {
+		var p pt.CTInclusionProof
+		if err = json.Unmarshal(in, &p); err != nil {
+			log.Fatal(err)
+		}
+		h := pt.ServiceTree
+		if *hasher == "rfc6962" {
+			h = pt.RFC6962
+		} else if *hasher != "service" {
+			log.Fatalf("unknown -hasher %q", *hasher)
+		}
+		printAuditPath(os.Stdout, h, p, leaf, *treeSize, rth)
+		return
+	}
+
+	tree, err := pt.UnmarshalProofTree(string(in))
+	if err != nil {
+		log.Fatal(err)
+	}
+	printProofTree(os.Stdout, *tree, leaf, *treeSize, rth)
+}
+
+// readProofInput reads the proof from the named file, or stdin when name is empty or "-"
+func readProofInput(name string) ([]byte, error) {
+	var r io.Reader = os.Stdin
+	if name != "" && name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return ioutil.ReadAll(r)
+}
+
+// decodeHexFlag decodes an optional hex encoded hash flag
+func decodeHexFlag(name, s string) []byte {
+	if s == "" {
+		return nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		log.Fatalf("invalid -%s %q", name, s)
+	}
+	return b
+}
+
+// printProofTree prints a proof of presence and/or extension
+func printProofTree(w io.Writer, p pt.ProofTree, leaf []byte, treeSize uint64, rth []byte) {
+	if leaf == nil {
+		if b, err := hex.DecodeString(p.Record); err == nil && len(b) == 32 {
+			leaf = b
+		}
+	}
+
+	if !emptyNode(p.Root) {
+		fmt.Fprintln(w, "Proof of presence")
+		root, ok := printNode(w, p.Root, "", "root", leaf)
+		if ok {
+			if p.RTH != "" {
+				compareHash(w, "declared RTH", root[:], p.RTH)
+			}
+			if rth != nil {
+				compareHash(w, "-rth", root[:], hex.EncodeToString(rth))
+			}
+			if leaf != nil {
+				printLeafIndex(w, p.Root, leaf, treeSize)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	if !emptyNode(p.OldProof) || !emptyNode(p.NewProof) {
+		fmt.Fprintln(w, "Proof of extension, old tree")
+		oldRoot, oldOK := printNode(w, p.OldProof, "", "root", leaf)
+		fmt.Fprintln(w, "Proof of extension, new tree")
+		_, newOK := printNode(w, p.NewProof, "", "root", leaf)
+
+		if oldOK && newOK {
+			if _, _, err := pt.VerifyExtension(p); err != nil {
+				fmt.Fprintf(w, "FAIL extension: %v\n", err)
+			} else {
+				fmt.Fprintln(w, "ok   new tree extends the old tree")
+			}
+			if rth != nil {
+				compareHash(w, "-rth (old tree)", oldRoot[:], hex.EncodeToString(rth))
+			}
+			if leaf != nil {
+				var l [32]byte
+				copy(l[:], leaf)
+				if err := pt.VerifyAppended(p, l); err != nil {
+					fmt.Fprintf(w, "FAIL leaf: %v\n", err)
+				} else {
+					fmt.Fprintln(w, "ok   leaf is appended by the extension")
+				}
+			}
+		}
+	}
+}
+
+// printNode prints the subtree under node, one line per node with its direction and computed hash.
+// Returns the computed hash, or false when the subtree does not verify.
+func printNode(w io.Writer, node pt.ProofNode, indent, dir string, leaf []byte) ([32]byte, bool) {
+	var order [][32]byte
+	h, err := pt.ComputeRoot(node, &order)
+
+	switch {
+	case node.Hash != "" && err != nil:
+		fmt.Fprintf(w, "%s%s hash %q  <-- %v\n", indent, dir, node.Hash, err)
+	case node.Hash != "":
+		mark := ""
+		if leaf != nil && bytes.Equal(h[:], leaf) {
+			mark = "  <-- leaf"
+		}
+		fmt.Fprintf(w, "%s%s hash %x%s\n", indent, dir, h, mark)
+	case node.Left == nil || node.Right == nil:
+		fmt.Fprintf(w, "%s%s  <-- %v\n", indent, dir, err)
+	default:
+		if err != nil {
+			fmt.Fprintf(w, "%s%s node\n", indent, dir)
+		} else {
+			fmt.Fprintf(w, "%s%s node %x\n", indent, dir, h)
+		}
+		printNode(w, *node.Left, indent+"  ", "L", leaf)
+		printNode(w, *node.Right, indent+"  ", "R", leaf)
+	}
+	return h, err == nil
+}
+
+// printLeafIndex prints the leaf index and RFC 6962 audit path of the leaf, when the tree size is known
+func printLeafIndex(w io.Writer, root pt.ProofNode, leaf []byte, treeSize uint64) {
+	if treeSize == 0 {
+		fmt.Fprintln(w, "     leaf index unknown, pass -tree-size")
+		return
+	}
+
+	var l [32]byte
+	copy(l[:], leaf)
+	index, path, err := pt.ServiceAuditPath(root, l, treeSize)
+	if err != nil {
+		fmt.Fprintf(w, "FAIL leaf index: %v\n", err)
+		return
+	}
+	fmt.Fprintf(w, "     leaf index %d of %d, audit path:\n", index, treeSize)
+	for i, s := range path {
+		fmt.Fprintf(w, "       %d %x\n", i, s)
+	}
+}
+
+// printAuditPath prints an RFC 6962 audit path with the side of every sibling,
+// and the computed root when the leaf hash is given
+func printAuditPath(w io.Writer, h pt.Hasher, p pt.CTInclusionProof, leaf []byte, treeSize uint64, rth []byte) {
+	fmt.Fprintf(w, "Audit path, claimed leaf index %d\n", p.LeafIndex)
+	if treeSize == 0 {
+		for i, s := range p.AuditPath {
+			fmt.Fprintf(w, "  %d   %x\n", i, s)
+		}
+		fmt.Fprintln(w, "     sides unknown, pass -tree-size")
+		return
+	}
+	if p.LeafIndex >= treeSize {
+		fmt.Fprintf(w, "FAIL leaf index %d out of range for tree size %d\n", p.LeafIndex, treeSize)
+		return
+	}
+
+	// same walk as RFC 9162 section 2.1.3.2, recording the side of each sibling
+	fn, sn := p.LeafIndex, treeSize-1
+	r := leaf
+	for i, s := range p.AuditPath {
+		side := "R"
+		if fn&1 == 1 || fn == sn {
+			side = "L"
+			if r != nil {
+				r = h.HashChildren(s, r)
+			}
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else if r != nil {
+			r = h.HashChildren(r, s)
+		}
+		fn >>= 1
+		sn >>= 1
+
+		if r != nil {
+			fmt.Fprintf(w, "  %d %s %x  -> %x\n", i, side, s, r)
+		} else {
+			fmt.Fprintf(w, "  %d %s %x\n", i, side, s)
+		}
+	}
+
+	if leaf == nil {
+		fmt.Fprintln(w, "     root unknown, pass -leaf")
+		return
+	}
+	fmt.Fprintf(w, "     computed root %x\n", r)
+	if rth == nil {
+		return
+	}
+	if err := pt.VerifyInclusion(h, leaf, p.LeafIndex, treeSize, p.AuditPath, rth); err != nil {
+		fmt.Fprintf(w, "FAIL %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok   computed root matches -rth")
+}
+
+// compareHash prints whether the computed hash matches the expected hex encoded hash
+func compareHash(w io.Writer, name string, computed []byte, expected string) {
+	if strings.EqualFold(hex.EncodeToString(computed), expected) {
+		fmt.Fprintf(w, "ok   computed root matches %s\n", name)
+		return
+	}
+	fmt.Fprintf(w, "FAIL computed root %x does not match %s %s\n", computed, name, expected)
+}
+
+// emptyNode reports whether a proof node was left out of the JSON
+func emptyNode(n pt.ProofNode) bool {
+	return n.Hash == "" && n.Left == nil && n.Right == nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	att "github.com/sewelol/sgx-decryption-service/attestation"
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	"github.com/sewelol/sgx-decryption-service/proofcodec"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Outcomes of a diagnose check
+const (
+	checkOK      = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+)
+
+// diagnosis is the report of the diagnose subcommand
+type diagnosis struct {
+	Address string        `json:"address"`
+	Client  string        `json:"client"`
+	Time    time.Time     `json:"time"`
+	Checks  []*checkEntry `json:"checks"`
+	OK      bool          `json:"ok"` // no check failed
+}
+
+// checkEntry is the outcome of one check, with what was learned on the way
+type checkEntry struct {
+	Name     string            `json:"name"`
+	Status   string            `json:"status"`
+	Reason   string            `json:"reason,omitempty"` // why the check failed or was skipped
+	Duration string            `json:"duration,omitempty"`
+	Info     map[string]string `json:"info,omitempty"`
+}
+
+// diagnose implements the diagnose subcommand: it runs every check of the pipeline against the
+// server, reporting what passed, what failed and why, instead of stopping at the first failure
+// like ready. A check whose prerequisite failed is skipped. It takes the flags of the main command.
+func diagnose(args []string) {
+	fs := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	canaryFile := fs.String("canary", "", "file with a canary record as an ndjson line (see -format ndjson) to decrypt, no decryption is attempted without it")
+	canarySum := fs.String("canary-sha256", "", "hex encoded sha256 the canary plaintext must have")
+	timeout := fs.Duration("timeout", 10*time.Second, "deadline of every check")
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s diagnose [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Checks the connection, TLS, health, capabilities, attestation, RTH and a canary decryption,\n")
+		fmt.Fprintf(os.Stderr, "and prints a report to attach to bug reports. Exits with 1 if any check failed.\n")
+		fmt.Fprintf(os.Stderr, "A canary whose proof of extension moves the RTH advances the device.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var want []byte
+	if *canarySum != "" {
+		var err error
+		if want, err = hex.DecodeString(*canarySum); err != nil || len(want) != sha256.Size {
+			log.Fatalf("invalid -canary-sha256 %q", *canarySum)
+		}
+	}
+	if *nonceLen < minNonceLen {
+		log.Fatalf("invalid -nonce-len %d, nonces must be at least %d bytes", *nonceLen, minNonceLen)
+	}
+	verifier := newVerifier()
+	codec, err := proofcodec.ByName(*proofEncoding)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d := &diagnosis{Address: address, Client: clientIdentifier(), Time: time.Now().UTC(), OK: true}
+
+	conn, connected := d.connection(*timeout)
+	if conn != nil {
+		defer conn.Close()
+	}
+	d.tlsDetails(*timeout)
+	d.skip("health", "the service has no gRPC health service, see the connection state")
+	d.skip("capabilities", "the service has no capabilities RPC")
+
+	var c pb.DecryptionDeviceClient
+	if connected {
+		c = pb.NewDecryptionDeviceClient(conn)
+	}
+	encKey, verKey := d.attestation(c, verifier, *timeout)
+
+	var rth *pb.RootTreeHash
+	if verKey == nil {
+		d.skip("RTH verification", "no attested verification key")
+	} else {
+		d.run("RTH verification", func(info map[string]string) (err error) {
+			if rth, err = readyRTH(c, verKey, *timeout); err != nil {
+				return err
+			}
+			info["rth"] = hex.EncodeToString(rth.Rth)
+			info["tree size"] = fmt.Sprint(rth.TreeSize)
+			info["timestamp"] = fmt.Sprint(rth.Timestamp)
+			info["signature format"] = fmt.Sprint(rth.Version)
+			return nil
+		})
+	}
+
+	switch {
+	case *canaryFile == "":
+		d.skip("canary decryption", "no -canary given")
+	case encKey == nil || rth == nil:
+		d.skip("canary decryption", "attestation or RTH verification did not pass")
+	default:
+		client := dc.New(c)
+		client.ProofCodec = codec
+		client.MaxPlaintext = dc.MaxPlaintextLen(encKey, dc.OAEP)
+		d.run("canary decryption", func(info map[string]string) error {
+			info["canary"] = *canaryFile
+			return readyCanary(client, *canaryFile, want, *timeout)
+		})
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(d); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		d.print()
+	}
+	if !d.OK {
+		os.Exit(1)
+	}
+}
+
+// run runs a check and records its outcome, the check fills in what it learns in info
+func (d *diagnosis) run(name string, check func(info map[string]string) error) {
+	e := &checkEntry{Name: name, Status: checkOK, Info: make(map[string]string)}
+	start := time.Now()
+	err := check(e.Info)
+	e.Duration = time.Since(start).Round(time.Microsecond).String()
+	if err != nil {
+		e.Status, e.Reason = checkFailed, err.Error()
+		d.OK = false
+	}
+	if len(e.Info) == 0 {
+		e.Info = nil
+	}
+	d.Checks = append(d.Checks, e)
+}
+
+func (d *diagnosis) skip(name, reason string) {
+	d.Checks = append(d.Checks, &checkEntry{Name: name, Status: checkSkipped, Reason: reason})
+}
+
+// connection dials the server and waits for the connection to be ready. The connection is
+// returned even when it is not ready, so it can be closed.
+func (d *diagnosis) connection(timeout time.Duration) (conn *grpc.ClientConn, ready bool) {
+	d.run("connection", func(info map[string]string) error {
+		info["transport"] = "plaintext"
+		if *useTLS {
+			info["transport"] = "TLS"
+		}
+		transport, err := transportOption()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		id := clientIdentifier()
+		conn, err = grpc.DialContext(ctx, address, transport, grpc.WithBlock(), grpc.WithUserAgent(id+" diagnose"), grpc.WithUnaryInterceptor(withClientID(id)))
+		if conn != nil {
+			info["state"] = conn.GetState().String()
+		}
+		if err != nil {
+			return err
+		}
+		ready = true
+		return nil
+	})
+	return conn, ready
+}
+
+// tlsDetails does a TLS handshake of its own with the -tls flags, to report what was negotiated
+func (d *diagnosis) tlsDetails(timeout time.Duration) {
+	if !*useTLS {
+		d.skip("TLS", "plaintext connection, -tls is not set")
+		return
+	}
+	d.run("TLS", func(info map[string]string) error {
+		config, err := tlsConfig()
+		if err != nil {
+			return err
+		}
+		config.NextProtos = []string{"h2"}
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		cs := conn.ConnectionState()
+		info["version"] = tls.VersionName(cs.Version)
+		info["cipher suite"] = tls.CipherSuiteName(cs.CipherSuite)
+		info["alpn"] = cs.NegotiatedProtocol
+		if len(cs.PeerCertificates) > 0 {
+			cert := cs.PeerCertificates[0]
+			info["certificate subject"] = cert.Subject.String()
+			info["certificate issuer"] = cert.Issuer.String()
+			info["certificate expires"] = cert.NotAfter.UTC().Format(time.RFC3339)
+		}
+		if cs.NegotiatedProtocol != "h2" {
+			return errors.New("server did not negotiate h2, gRPC needs HTTP/2")
+		}
+		return nil
+	})
+}
+
+// attestation fetches the device keys and the quote, reports the enclave identity of the quote and
+// checks it when an identity is expected. The keys are nil if the check failed.
+func (d *diagnosis) attestation(c pb.DecryptionDeviceClient, verifier *att.Verifier, timeout time.Duration) (encKey, verKey *rsa.PublicKey) {
+	if c == nil {
+		d.skip("attestation", "not connected")
+		return nil, nil
+	}
+	d.run("attestation", func(info map[string]string) error {
+		nonce, err := newNonce("GetPublicKey")
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		pk, err := c.GetPublicKey(ctx, &pb.PublicKeyRequest{Nonce: nonce})
+		if err != nil {
+			return err
+		}
+
+		enc, _, err := parseRSAKey(pk.RSA_EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("encryption key: %v", err)
+		}
+		info["encryption key"] = fmt.Sprintf("RSA %d bits", enc.N.BitLen())
+		ver, verDER, err := parseRSAKey(pk.RSA_VerificationKey)
+		if err != nil {
+			return fmt.Errorf("verification key: %v", err)
+		}
+		sum := sha256.Sum256(verDER)
+		info["verification key"] = fmt.Sprintf("RSA %d bits, sha256 %s", ver.N.BitLen(), hex.EncodeToString(sum[:]))
+
+		report, err := att.ParseQuote(pk.Quote)
+		if err == nil {
+			info["mrenclave"] = hex.EncodeToString(report.MRENCLAVE[:])
+			info["mrsigner"] = hex.EncodeToString(report.MRSIGNER[:])
+			info["isvprodid"] = fmt.Sprint(report.ISVProdID)
+			info["isvsvn"] = fmt.Sprint(report.ISVSVN)
+			if att.VerifyKeyBinding(report, verDER) == nil {
+				info["key binding"] = "quote binds the verification key"
+			} else {
+				info["key binding"] = "quote does not bind the verification key"
+			}
+		}
+
+		if !verifier.Enabled() {
+			info["verdict"] = "identity not checked, no expected identity given"
+			if err != nil {
+				info["quote"] = "does not parse: " + err.Error()
+			}
+			encKey, verKey = enc, ver
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("quote: %v", err)
+		}
+		if err = verifier.Verify(report); err != nil {
+			return err
+		}
+		if err = att.VerifyKeyBinding(report, verDER); err != nil {
+			return err
+		}
+		info["verdict"] = "identity and key binding verified"
+		encKey, verKey = enc, ver
+		return nil
+	})
+	return encKey, verKey
+}
+
+// print writes the report for a human: one line per check, followed by what it learned
+func (d *diagnosis) print() {
+	fmt.Printf("diagnosis of %s by %s at %s\n\n", d.Address, d.Client, d.Time.Format(time.RFC3339))
+	for _, e := range d.Checks {
+		line := fmt.Sprintf("%-8s %s", e.Status, e.Name)
+		if e.Duration != "" {
+			line += " (" + e.Duration + ")"
+		}
+		if e.Reason != "" {
+			line += ": " + e.Reason
+		}
+		fmt.Println(line)
+
+		var keys []string
+		for k := range e.Info {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Printf("         %s: %s\n", k, e.Info[k])
+		}
+	}
+	if d.OK {
+		fmt.Println("\nno check failed")
+	} else {
+		fmt.Println("\nsome checks failed")
+	}
+}
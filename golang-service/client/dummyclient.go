@@ -1,59 +1,557 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
+	"io/ioutil"
 
+	att "github.com/sewelol/sgx-decryption-service/attestation"
+	"github.com/sewelol/sgx-decryption-service/clock"
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
 	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	"github.com/sewelol/sgx-decryption-service/proofcodec"
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+	"github.com/sewelol/sgx-decryption-service/rthsig"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
+	version     = "dummyclient/0.1"
 	address     = "localhost:50051"
 	defaultName = "world"
 	rsaSpecTest = false
+	recordsFile = "test_set/records.csv"
+	proofsFile  = "test_set/records_proofs.csv"
 )
 
+// Exit codes of a run that completed with a finding
+const (
+	exitTruncated = 3 // stopped by -max-runtime
+	exitMismatch  = 4 // plaintexts differ from -compare-plaintext
+	exitMalformed = 5 // plaintexts do not conform to -plaintext-schema
+)
+
+// clk is the time source of -max-runtime, the result flushes and the bound nonces, tests replace it with a clock.Fake
+var clk clock.Clock = clock.Real
+
+// Expected enclave identity, checked against the report body of the quote
+var (
+	expectedMRENCLAVE = flag.String("expected-mrenclave", "", "hex encoded MRENCLAVE the enclave must report")
+	mrenclaveFile     = flag.String("expected-mrenclave-file", "", "signed enclave or SIGSTRUCT file to read the expected MRENCLAVE from")
+	expectedMRSIGNER  = flag.String("expected-mrsigner", "", "hex encoded MRSIGNER the enclave must report")
+	expectedISVProdID = flag.Int("expected-isvprodid", -1, "ISVProdID the enclave must report (-1 to skip)")
+)
+
+// requirePOE refuses to send records without a valid proof of extension
+var requirePOE = flag.Bool("require-poe", false, "only send records with a proof of extension that verifies locally")
+
+// baselineRTH pins the RTH of a previous verified run, records must have been logged after it
+var baselineRTH = flag.String("baseline-rth", "", "hex encoded RTH of a previous verified run, records logged before it are rejected")
+
+// Records also logged to an external RFC 6962 (Certificate Transparency) log
+var (
+	ctProofsFile = flag.String("ct-proofs", "", "file with RFC 6962 inclusion proofs of the ciphertexts in an external log")
+	ctRoot       = flag.String("ct-root", "", "hex encoded root hash of the external log's tree head")
+	ctTreeSize   = flag.Uint64("ct-tree-size", 0, "tree size of the external log's tree head")
+)
+
+// RTHs anchored in an external append-only log, checked against a tree head of the log obtained independently
+var (
+	anchorRoot     = flag.String("anchor-root", "", "hex encoded root hash of the external log the RTHs are anchored in")
+	anchorTreeSize = flag.Uint64("anchor-tree-size", 0, "tree size of the external log's tree head")
+)
+
+// rthSigVersion selects the format of the signed RTH, the legacy format is for servers that predate the canonical one
+var rthSigVersion = flag.Uint("rth-sig-version", rthsig.Canonical, "signed RTH format: 2 for the canonical serialization, 1 for the legacy sha256(rth || nonce)")
+
+// maxFileSize bounds the (decompressed) size of the input files
+var maxFileSize = flag.Int64("max-file-size", 1<<30, "maximum size in bytes of an input file after decompression (0 for no limit)")
+
+// memBudget bounds the plaintexts held in memory, the rest is spilled to an encrypted temporary file
+var memBudget = flag.Int64("plaintext-mem-budget", 0, "bytes of plaintext held in memory before spilling to an encrypted temporary file (0 for no limit)")
+
+// JSON results output
+var (
+	outputFile    = flag.String("output", "", "write the results as JSON lines to this file")
+	flushInterval = flag.Duration("flush-interval", time.Second, "how often buffered results are flushed to disk (0 flushes every result)")
+)
+
+// One file per plaintext
+var (
+	outputDir  = flag.String("output-dir", "", "write every plaintext to its own file in this directory")
+	outputName = flag.String("output-name", "hash", "name of the -output-dir files: hash (hex encoded ciphertext hash), index (position of the record in the proofs file, records without a ciphertext not counted) or id (external ID, with -keymap)")
+)
+
+// proofDelimiter separates the fields of a proofs file line
+var proofDelimiter = flag.String("proof-delimiter", "whitespace", "separator of the fields of a proofs file line: whitespace (any run of spaces and tabs), space, tab, or a literal string that does not occur in the proofs")
+
+// useProofsIndex looks the proofs up in the index of the proofs file instead of reading all of them
+var useProofsIndex = flag.Bool("proofs-index", false, "look up the proofs of the records in the index built by index-proofs (<proofs file>.idx) instead of holding the whole proofs file in memory")
+
+// rthFailureMode decides whether a signed RTH that does not verify aborts the run
+var rthFailureMode = flag.String("rth-failure-mode", "fatal", "when the server's signed RTH does not verify: fatal aborts before any record is decrypted, warn logs a warning and continues (development against a self-signed enclave only)")
+
+// rthHistory verifies the RTH history of the device along with the current RTH
+var rthHistory = flag.Bool("rth-history", false, "fetch and verify the signed RTH history of the device")
+
+// comparePlaintext checks the plaintexts against the expected ones, for regression tests of a dataset
+var comparePlaintext = flag.String("compare-plaintext", "", "file with the expected plaintext (base64, or sha256:<hex>) per ciphertext hash, exit with code 4 if any differ")
+
+// plaintextSchemaRules flag decrypted plaintexts whose content is not of the expected format
+var plaintextSchemaRules plaintextSchema
+
+func init() {
+	flag.Var(&plaintextSchemaRules, "plaintext-schema", "rule the plaintexts must conform to, repeatable: len=<n>, len=<min>-<max>, magic=<hex prefix>, regex=<expression matching the whole plaintext>, utf8 or json; exit with code 5 if any do not")
+}
+
+// maxRuntime caps the run time, records not dispatched by then are left out
+var maxRuntime = flag.Duration("max-runtime", 0, "stop dispatching records after this long, let the ones in flight finish and exit with code 3 (0 for no limit)")
+
+// clientID tags the requests so server logs can attribute them
+var clientID = flag.String("client-id", "", "operator supplied tag sent with the client version in the user-agent and request metadata")
+
+// An RTH obtained out-of-band, e.g. from a monitor, replaces the one the server advertises
+var (
+	trustedRTH          = flag.String("rth", "", "hex encoded RTH obtained out-of-band, the proofs must build on it instead of the RTH the server advertises")
+	trustedRTHSig       = flag.String("rth-sig", "", "file with the signed RTH for -rth, a GetRootTreeHash response in JSON")
+	verificationKeyFile = flag.String("verification-key", "", "PEM file with the device verification key to check -rth-sig with, instead of the attested key")
+)
+
+// The RTH can be required to agree among several sources, the server being one of them
+var (
+	rthSources rthSourceFlag
+	rthQuorum  = flag.Int("rth-quorum", 0, "RTH sources, the server included, that must agree with -rth-source (0 for all)")
+)
+
+func init() {
+	flag.Var(&rthSources, "rth-source", "source of the RTH to compare with the server's, repeatable: file:<signed RTH JSON>, an http(s) URL serving one, or hex:<RTH>")
+}
+
+// proofEncoding selects the encoding of the proofs sent to the device
+var proofEncoding = flag.String("proof-encoding", "json", "encoding of the proofs sent to the device: json or protobuf")
+
+// The client log keeps a hash-chained record of every decryption, see verify-client-log
+var (
+	clientLogFile = flag.String("client-log", "", "append a hash-chained entry for every decryption to this file (hashes only, no plaintext)")
+	clientLogKey  = flag.String("client-log-key", "", "PEM private key from keygen to sign the client log entries with")
+)
+
+// Nonces of the GetRootTreeHash, GetPublicKey and history requests
+var (
+	nonceLen  = flag.Int("nonce-len", 32, "random bytes in a request nonce (at least 16)")
+	nonceBind = flag.Bool("nonce-bind", false, "bind every nonce to the time and the client identifier: sha256(random || timestamp || client id)")
+)
+
+// Records can be addressed by external IDs instead of their ciphertext hash
+var (
+	keymapFile = flag.String("keymap", "", "file mapping external IDs to ciphertext hashes, one \"id hash\" line per record")
+	ids        = flag.String("ids", "", "comma separated external IDs of the records to decrypt, all IDs of -keymap when empty")
+)
+
+// rsaExponents is the set of public exponents accepted in the device keys
+var rsaExponents = flag.String("rsa-exponents", "65537", "comma separated public exponents accepted in the RSA keys of the device")
+
+// Several datasets are processed one after another against the same attested device
+var datasets datasetFlag
+
+func init() {
+	flag.Var(&datasets, "dataset", "records,proofs files of a dataset, repeat for several datasets processed in the order given (default "+recordsFile+","+proofsFile+")")
+}
+
+// The connection to the server is plaintext unless -tls is set
+var (
+	useTLS          = flag.Bool("tls", false, "connect to the server over TLS")
+	tlsCA           = flag.String("tls-ca", "", "PEM file with the CA certificates the server certificate must chain to, the system roots when empty")
+	tlsServerName   = flag.String("tls-server-name", "", "name the server certificate must be valid for, the host of the address when empty")
+	tlsMinVersion   = flag.String("tls-min-version", "1.3", "lowest TLS version accepted: 1.2 or 1.3")
+	tlsCipherSuites = flag.String("tls-cipher-suites", "", "comma separated cipher suites accepted (Go names, e.g. TLS_AES_256_GCM_SHA384), all secure suites when empty")
+)
+
+// format selects where records are read from and results written to
+var format = flag.String("format", "csv", "csv: read the records and proofs files, write results to -output; ndjson: read {\"ciphertext_b64\", \"pop\", \"poe\"} lines from stdin and write a result line per input line to stdout")
+
+// challenge requires every plaintext to come with the device's signature over a fresh challenge
+var challenge = flag.Bool("challenge", false, "send a random challenge with every record and reject plaintexts not returned with the attested device's signature over it, the ciphertext hash and the plaintext tag")
+
+// timings asks the server where it spends the time of the decryptions
+var timings = flag.Bool("timings", false, "ask the server for its internal timings of every decryption and log their means at the end, every record's with -verbose (needs a server with -debug-timings)")
+
+// verbose logs diagnostics such as connection state transitions
+var verbose = flag.Bool("verbose", false, "log connection state transitions")
+
 type leaf struct {
 	Hash []byte
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "decode-proof":
+			decodeProof(os.Args[2:])
+			return
+		case "index-proofs":
+			indexProofs(os.Args[2:])
+			return
+		case "diff-proofs":
+			diffProofs(os.Args[2:])
+			return
+		case "verify-client-log":
+			verifyClientLogCmd(os.Args[2:])
+			return
+		case "ready":
+			ready(os.Args[2:])
+			return
+		case "diagnose":
+			diagnose(os.Args[2:])
+			return
+		case "keygen":
+			keygen(os.Args[2:])
+			return
+		case "loadtest":
+			loadtest(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Parse()
+	stop := runtimeCap(*maxRuntime)
+	verifier := newVerifier()
+	if *nonceLen < minNonceLen {
+		log.Fatalf("invalid -nonce-len %d, nonces must be at least %d bytes", *nonceLen, minNonceLen)
+	}
+	if *rthSigVersion != rthsig.Legacy && *rthSigVersion != rthsig.Canonical {
+		log.Fatalf("invalid -rth-sig-version %d", *rthSigVersion)
+	}
+	if _, err := parseExponents(*rsaExponents); err != nil {
+		log.Fatal(err)
+	}
+	if *rthFailureMode != "fatal" && *rthFailureMode != "warn" {
+		log.Fatalf("invalid -rth-failure-mode %q", *rthFailureMode)
+	}
+	if *format != "csv" && *format != "ndjson" {
+		log.Fatalf("invalid -format %q", *format)
+	}
+	if *format == "ndjson" {
+		if flags := ndjsonUnsupported(); len(flags) > 0 {
+			log.Fatalf("-format ndjson does not support %s", strings.Join(flags, ", "))
+		}
+	}
+	if *trustedRTH == "" && (*trustedRTHSig != "" || (*verificationKeyFile != "" && len(rthSources) == 0 && !*challenge)) {
+		log.Fatal("-rth-sig and -verification-key need -rth, -rth-source or -challenge")
+	}
+	quorum := *rthQuorum
+	if len(rthSources) > 0 {
+		if *trustedRTH != "" {
+			log.Fatal("-rth and -rth-source are exclusive, pass the RTH as a hex: source")
+		}
+		// the server counts as a source, a quorum of more than half cannot be met by two RTHs
+		n := len(rthSources) + 1
+		if quorum == 0 {
+			quorum = n
+		}
+		if quorum <= n/2 || quorum > n {
+			log.Fatalf("invalid -rth-quorum %d, want more than half of the %d sources and at most all", quorum, n)
+		}
+	}
+
 	// Set up a connection to the server.
-	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	id := clientIdentifier()
+	transport, err := transportOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := grpc.Dial(address, transport, grpc.WithUserAgent(id), grpc.WithUnaryInterceptor(withClientID(id)))
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
 	}
 	defer conn.Close()
 	c := pb.NewDecryptionDeviceClient(conn)
+	client := dc.New(c)
+	if client.ProofCodec, err = proofcodec.ByName(*proofEncoding); err != nil {
+		log.Fatal(err)
+	}
+
+	if *verbose {
+		go watchConnState(conn)
+	}
 
 	//  call GetRootTreeHash
-	rth, err := c.GetRootTreeHash(context.Background(), &pb.RootTreeHashRequest{Nonce: []byte("aaaaaaaaa")})
-	if err != nil {
-		log.Fatalf("could not get rth: %v", err)
+	// A server without RTH verification is only accepted with -rth-failure-mode warn, see skipUnimplemented
+	anchor := readAnchor()
+	var rth *pb.RootTreeHash
+	if *trustedRTH != "" {
+		// the server is not asked for the RTH, it may advertise another one than the device holds
+		rth = readTrustedRTH()
+		log.Printf("RTH supplied with -rth: %s", hex.EncodeToString(rth.Rth))
+	} else {
+		nonce, err := newNonce("GetRootTreeHash")
+		if err != nil {
+			log.Fatal(err)
+		}
+		rth, err = c.GetRootTreeHash(context.Background(), &pb.RootTreeHashRequest{Nonce: nonce, Version: uint32(*rthSigVersion), AnchorTreeSize: *anchorTreeSize})
+		if skipUnimplemented(err, anchor) {
+			log.Printf("WARNING: server does not implement GetRootTreeHash, continuing without RTH verification with -rth-failure-mode warn")
+			rth = nil
+		} else if unimplemented(err) {
+			log.Fatalf("server does not implement GetRootTreeHash, the RTH cannot be verified: %v", err)
+		} else if err != nil {
+			log.Fatalf("could not get rth: %v", err)
+		} else if !bytes.Equal(rth.Nonce, nonce) {
+			log.Fatalf("server answered GetRootTreeHash with nonce %x, not %x", rth.Nonce, nonce)
+		} else {
+			log.Printf("\nRTH: %s \nNonce: %s \nSignature: %s...\n\n", hex.EncodeToString(rth.Rth), hex.EncodeToString(rth.Nonce), hex.EncodeToString(rth.Sig[:31]))
+		}
+	}
+	if anchor != nil {
+		if err = checkAnchor(rth, anchor); err != nil {
+			log.Fatalf("RTH is not anchored in the external log: %v", err)
+		}
+		log.Printf("RTH anchored in the external log at leaf %d of %d", rth.Anchor.LeafIndex, *anchorTreeSize)
 	}
-	log.Printf("\nRTH: %s \nNonce: %s \nSignature: %s...\n\n", hex.EncodeToString(rth.Rth), hex.EncodeToString(rth.Nonce), hex.EncodeToString(rth.Sig[:31]))
 
 	//  call GetPublicKey
-	pk, err := c.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Nonce: []byte("a long and random byte array")})
+	// The keys are optional with -rth-failure-mode warn, unless the enclave identity is checked
+	nonce, err := newNonce("GetPublicKey")
 	if err != nil {
+		log.Fatal(err)
+	}
+	pk, err := c.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Nonce: nonce})
+	var verKey *rsa.PublicKey
+	var history [][]byte
+	if skipUnimplemented(err, anchor) && !verifier.Enabled() && (*trustedRTHSig == "" || *verificationKeyFile != "") {
+		log.Printf("WARNING: server does not implement GetPublicKey, continuing without the encryption test and RTH verification with -rth-failure-mode warn")
+	} else if unimplemented(err) {
+		log.Fatalf("server does not implement GetPublicKey, the device and the RTH cannot be verified: %v", err)
+	} else if err != nil {
 		log.Fatalf("could not get quote containing the public key: %v", err)
+	} else {
+		verKey = verifyDevice(client, pk, rth, verifier)
+		if *rthHistory {
+			if history, err = checkHistory(c, verKey, rth.GetRth()); err != nil {
+				log.Fatalf("could not verify RTH history: %v", err)
+			}
+		}
+	}
+
+	// With -rth-source the records are verified against the RTH a quorum of sources agree on
+	pinned := *trustedRTH != ""
+	if len(rthSources) > 0 {
+		if *verificationKeyFile != "" {
+			if verKey, err = readVerificationKey(*verificationKeyFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if verKey == nil {
+			log.Fatal("-rth-source needs the verification key of the device, pass -verification-key")
+		}
+		if rth, err = agreeRTH(rth, verKey, history, rthSources, quorum); err != nil {
+			log.Fatalf("RTH sources do not agree: %v", err)
+		}
+		log.Printf("RTH agreed by at least %d of %d sources: %s", quorum, len(rthSources)+1, hex.EncodeToString(rth.Rth))
+		pinned = true
+	}
+
+	var clog *clientLog
+	if *clientLogFile != "" {
+		var signer crypto.Signer
+		if *clientLogKey != "" {
+			if signer, err = readSigningKey(*clientLogKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if clog, err = openClientLog(*clientLogFile, signer); err != nil {
+			log.Fatal(err)
+		}
+		defer clog.Close()
+	} else if *clientLogKey != "" {
+		log.Fatal("-client-log-key needs -client-log")
+	}
+
+	if *challenge {
+		if *verificationKeyFile != "" {
+			if verKey, err = readVerificationKey(*verificationKeyFile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if verKey == nil {
+			log.Fatal("-challenge needs the verification key of the device, pass -verification-key")
+		}
+		client.ChallengeKey = verKey
+		client.Rand = nonceSource
+	}
+
+	// the self-test decryptions are done, only the records' timings are collected
+	stats := new(timingStats)
+	if *timings {
+		client.Timings = stats.add
+	}
+
+	b := &batch{client: client, stop: stop, rth: rth.GetRth(), pinned: pinned, clog: clog}
+	b.ctProofs, b.ctRoot = readExternalLog()
+	b.baseline = readBaseline()
+
+	if *format == "ndjson" {
+		// records are read from stdin and their results written to stdout as they complete,
+		// after the same local checks as the records of a dataset
+		if err = streamNDJSON(b, os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		if *timings {
+			stats.report()
+		}
+		return
+	}
+
+	// Read the encrypted records and their proofs of every dataset, and join them by ciphertext hash
+	if len(datasets) == 0 {
+		datasets = datasetFlag{{recordsFile: recordsFile, proofsFile: proofsFile}}
+	}
+	var all []record
+	for i, ds := range datasets {
+		if len(datasets) > 1 {
+			ds.prefix = "[" + ds.name() + "] "
+			ds.filePrefix = fmt.Sprintf("dataset%d-", i+1)
+		}
+		if err = ds.load(); err != nil {
+			log.Fatal(err)
+		}
+		all = append(all, ds.records...)
+	}
+
+	// with a keymap only the records of the requested IDs are sent, still in log order
+	if *keymapFile != "" {
+		keymap, err := readKeymap(*keymapFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var requested []string
+		if *ids != "" {
+			requested = strings.Split(*ids, ",")
+		}
+		var unresolved []string
+		b.selected, unresolved = resolveIDs(keymap, requested, all)
+		for _, id := range unresolved {
+			log.Printf("id %q does not resolve to a record", id)
+		}
+		log.Printf("%d records selected by id, %d ids unresolved", len(b.selected), len(unresolved))
+	} else if *ids != "" {
+		log.Fatal("-ids needs -keymap")
+	}
+
+	if *outputFile != "" {
+		b.out, err = newResultWriter(*outputFile, *flushInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer b.out.Close()
+
+		// flush the buffered results when interrupted
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			b.out.Close()
+			os.Exit(1)
+		}()
+	}
+
+	if *outputDir != "" {
+		if *outputName != "hash" && *outputName != "index" && *outputName != "id" {
+			log.Fatalf("invalid -output-name %q", *outputName)
+		}
+		if *outputName == "id" && b.selected == nil {
+			log.Fatal("-output-name id needs -keymap")
+		}
+		b.dir, err = newDirWriter(*outputDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *comparePlaintext != "" {
+		if b.expected, err = readExpected(*comparePlaintext); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	client.MemBudget = *memBudget
+
+	exit := b.processAll(datasets)
+	if *timings {
+		stats.report()
+	}
+	if exit != 0 {
+		if b.out != nil {
+			b.out.Close()
+		}
+		conn.Close()
+		os.Exit(exit)
 	}
+}
+
+// ndjsonUnsupported returns the flags set that only apply to datasets read from files
+func ndjsonUnsupported() []string {
+	var flags []string
+	for name, set := range map[string]bool{
+		"-dataset":           len(datasets) > 0,
+		"-keymap":            *keymapFile != "",
+		"-ids":               *ids != "",
+		"-compare-plaintext": *comparePlaintext != "",
+		"-max-runtime":       *maxRuntime != 0,
+		"-output":            *outputFile != "",
+		"-output-dir":        *outputDir != "",
+	} {
+		if set {
+			flags = append(flags, name)
+		}
+	}
+	sort.Strings(flags)
+	return flags
+}
+
+// verifyDevice checks the enclave identity in the quote, runs the encryption test
+// and verifies the signed RTH (when the server provided one) with the exported keys
+func verifyDevice(client *dc.Client, pk *pb.Quote, rth *pb.RootTreeHash, verifier *att.Verifier) (verificationKey *rsa.PublicKey) {
 	log.Printf("Quote: %s \n encryption key: %s \n verification key: %s\n\n", pk.Quote, pk.RSA_EncryptionKey, pk.RSA_VerificationKey)
 
+	// verify enclave identity
+	var report *att.ReportBody
+	if verifier.Enabled() {
+		var err error
+		report, err = att.ParseQuote(pk.Quote)
+		if err != nil {
+			log.Fatalf("could not parse quote: %v", err)
+		}
+		if err = verifier.Verify(report); err != nil {
+			log.Fatalf("enclave identity rejected: %v", err)
+		}
+		log.Printf("Enclave identity verified: MRENCLAVE %x, ISVProdID %d", report.MRENCLAVE, report.ISVProdID)
+	}
+
 	// import public keys
 	encBlock, _ := pem.Decode(pk.RSA_EncryptionKey)
 	verBlock, _ := pem.Decode(pk.RSA_VerificationKey)
@@ -69,6 +567,32 @@ func main() {
 
 	rsaEncPub, _ := encPub.(*rsa.PublicKey)
 	rsaVerPub, _ := verPub.(*rsa.PublicKey)
+	if err = checkExponent(rsaEncPub); err != nil {
+		log.Fatalf("encryption key rejected: %v", err)
+	}
+	if err = checkExponent(rsaVerPub); err != nil {
+		log.Fatalf("verification key rejected: %v", err)
+	}
+
+	// the attested enclave must have bound the verification key, or the RTH signatures need not be its own
+	if report != nil {
+		if err = att.VerifyKeyBinding(report, verBlock.Bytes); err != nil {
+			log.Fatalf("verification key rejected: %v", err)
+		}
+		log.Printf("Verification key bound in the quote's report data")
+		if *verificationKeyFile != "" {
+			key, err := readVerificationKey(*verificationKeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if !key.Equal(rsaVerPub) {
+				log.Fatal("-verification-key is not the verification key of the attested enclave")
+			}
+		}
+	}
+
+	// reject plaintexts the encryption key could not have produced
+	client.MaxPlaintext = dc.MaxPlaintextLen(rsaEncPub, dc.OAEP)
 
 	// test encryption OAEP padding
 	rng := rand.Reader
@@ -93,100 +617,417 @@ func main() {
 
 	if rsaSpecTest {
 		// test decryption RPC using OAEP padding
-		response, err := c.DecryptRecord(context.Background(), &pb.DecryptionRequest{Ciphertext: sampleCiphertext, ProofOfPresence: "{json proof...............}", ProofOfExtension: "{json proof...}"})
+		plaintext, err := client.Decrypt(context.Background(), dc.Record{Ciphertext: sampleCiphertext, ProofOfPresence: "{json proof...............}", ProofOfExtension: "{json proof...}"})
 		if err != nil {
 			log.Printf("could not decrypt record (OAEP padding): %v", err)
 		} else {
-			log.Printf("%s\n", response.Plaintext)
+			log.Printf("%s\n", plaintext)
 		}
 
 		// test decryption RPC using PKCS#1 v1.5 padding
-		response, err = c.DecryptRecord(context.Background(), &pb.DecryptionRequest{Ciphertext: samplePKCS1v15CT, ProofOfPresence: "{json proof...................}", ProofOfExtension: "{json proof...}"})
+		plaintext, err = client.Decrypt(context.Background(), dc.Record{Ciphertext: samplePKCS1v15CT, ProofOfPresence: "{json proof...................}", ProofOfExtension: "{json proof...}"})
 		if err != nil {
 			log.Printf("could not decrypt record (PKCS#1 v1.5 padding): %v", err)
 		} else {
-			log.Printf("%s\n", response.Plaintext)
+			log.Printf("%s\n", plaintext)
 		}
 	}
 
 	// Verify RTH
-	h := sha256.Sum256(append(rth.Rth, rth.Nonce...))
-
-	err = rsa.VerifyPKCS1v15(rsaVerPub, crypto.SHA256, h[:], rth.Sig)
+	// A supplied RTH is checked here only when it is signed and no -verification-key was given to check it with
+	if rth == nil || (*trustedRTH != "" && (*trustedRTHSig == "" || *verificationKeyFile != "")) {
+		return rsaVerPub
+	}
+	err = verifyRTHSig(rsaVerPub, rth)
+	if err != nil && *trustedRTH != "" {
+		log.Fatalf("failed to verify the signed RTH of -rth-sig: %v", err)
+	}
 	if err != nil {
-		log.Printf("failed to verify signed root tree hash: %v", err.Error())
+		if *rthFailureMode == "warn" {
+			log.Printf("WARNING: failed to verify signed root tree hash, continuing with -rth-failure-mode warn: %v", err)
+			return rsaVerPub
+		}
+		log.Fatalf("failed to verify signed root tree hash: %v", err)
 	}
 	log.Printf("Signed RTH verified (VerifyPKCS1v15): %s", hex.EncodeToString(rth.Rth))
+	return rsaVerPub
+}
+
+// verifyRTHSig verifies the signature over a signed RTH in the -rth-sig-version format
+func verifyRTHSig(key *rsa.PublicKey, rth *pb.RootTreeHash) error {
+	// the version the server claims is not trusted, a downgrade to the legacy format would drop the signed tree size and timestamp
+	version := uint32(*rthSigVersion)
+	if version == rthsig.Canonical && rth.Version != version {
+		return fmt.Errorf("server signed the RTH in format %d, not the canonical format (use -rth-sig-version %d for legacy servers)", rth.Version, rthsig.Legacy)
+	}
+	h := rthsig.Digest(version, rth.Rth, rth.Nonce, rth.TreeSize, rth.Timestamp)
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], rth.Sig)
+}
 
-	// Read encrypted records from file to a hash map
-	ctDB := make(map[[32]byte][]byte)
+// readTrustedRTH decodes the RTH supplied with -rth. With -rth-sig the signed RTH is read from
+// the file and must be for the same RTH, its signature is verified here with -verification-key,
+// or later with the attested verification key.
+func readTrustedRTH() *pb.RootTreeHash {
+	b, err := hex.DecodeString(*trustedRTH)
+	if err != nil || len(b) != sha256.Size {
+		log.Fatalf("invalid -rth %q", *trustedRTH)
+	}
+	if *trustedRTHSig == "" {
+		return &pb.RootTreeHash{Rth: b}
+	}
 
-	file, err := os.Open("test_set/records.csv")
+	buf, err := ioutil.ReadFile(*trustedRTHSig)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
+	rth := new(pb.RootTreeHash)
+	if err = json.Unmarshal(buf, rth); err != nil {
+		log.Fatalf("invalid -rth-sig: %v", err)
+	}
+	if !bytes.Equal(rth.Rth, b) {
+		log.Fatalf("-rth-sig is signed for RTH %s, not -rth", hex.EncodeToString(rth.Rth))
+	}
 
-	// create a new scanner and read the file line by line
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), ",")
-		// Decode b64 ciphertext
-		ct, err := base64.StdEncoding.DecodeString(line[1])
-		// Calculate hash of ciphertext
-		ctSum := sha256.Sum256(ct)
+	if *verificationKeyFile != "" {
+		key, err := readVerificationKey(*verificationKeyFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		ctDB[ctSum] = ct
+		if err = verifyRTHSig(key, rth); err != nil {
+			log.Fatalf("failed to verify the signed RTH of -rth-sig: %v", err)
+		}
+		log.Printf("Signed RTH of -rth-sig verified with -verification-key (timestamp %d)", rth.Timestamp)
 	}
-	// check for errors
-	if err = scanner.Err(); err != nil {
-		log.Fatal(err)
+	return rth
+}
+
+// readVerificationKey reads a PEM encoded RSA public key
+func readVerificationKey(filename string) (*rsa.PublicKey, error) {
+	block, err := readPEM(filename)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", filename)
 	}
+	if err = checkExponent(key); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return key, nil
+}
 
-	// Read proofs for records from file
-	proofFile, err := os.Open("test_set/records_proofs.csv")
+// checkExponent rejects RSA keys whose public exponent is not in -rsa-exponents.
+// Exponents below 3 or even are never accepted, whatever the flag says.
+func checkExponent(key *rsa.PublicKey) error {
+	if key == nil {
+		return errors.New("not an RSA public key")
+	}
+	if key.E < 3 || key.E%2 == 0 {
+		return fmt.Errorf("invalid public exponent %d", key.E)
+	}
+	allowed, err := parseExponents(*rsaExponents)
+	if err != nil {
+		return err
+	}
+	for _, e := range allowed {
+		if e == key.E {
+			return nil
+		}
+	}
+	return fmt.Errorf("public exponent %d is not one of -rsa-exponents %s", key.E, *rsaExponents)
+}
+
+// parseExponents parses a comma separated list of odd public exponents of at least 3
+func parseExponents(s string) ([]int, error) {
+	var exponents []int
+	for _, f := range strings.Split(s, ",") {
+		e, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || e < 3 || e%2 == 0 {
+			return nil, fmt.Errorf("invalid -rsa-exponents %q", s)
+		}
+		exponents = append(exponents, e)
+	}
+	return exponents, nil
+}
+
+// checkHistory fetches the RTH history of the device page by page, verifies the aggregate
+// signature and the RTHs of every page, and requires the history to lead to the current RTH.
+// Verify checks a page on its own, so the last RTH and known tree size are carried across pages:
+// the history may not repeat an RTH or shrink the tree at a page boundary either.
+// Returns the RTHs of the verified pages.
+func checkHistory(c pb.DecryptionDeviceClient, key *rsa.PublicKey, currentRTH []byte) ([][]byte, error) {
+	var start, lastSize uint64
+	var history [][]byte
+	for {
+		nonce, err := newNonce("GetRootTreeHashHistory")
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.GetRootTreeHashHistory(context.Background(), &pb.RootTreeHashHistoryRequest{Nonce: nonce, Start: start})
+		if err != nil {
+			return nil, err
+		}
+
+		h := &rthsig.History{Start: resp.Start, RTHs: resp.Rths, TreeSizes: resp.TreeSizes, Nonce: resp.Nonce, Timestamp: resp.Timestamp}
+		if h.Start != start || !bytes.Equal(h.Nonce, nonce) {
+			return nil, fmt.Errorf("history page does not answer the request for RTHs from %d on", start)
+		}
+		if len(h.RTHs) == 0 {
+			return nil, errors.New("history ends before the current RTH")
+		}
+		if err = h.Verify(key, resp.Sig); err != nil {
+			return nil, err
+		}
+		if len(history) > 0 && bytes.Equal(h.RTHs[0], history[len(history)-1]) {
+			return nil, fmt.Errorf("RTH %d of the history repeats the previous RTH", start)
+		}
+		for i, size := range h.TreeSizes {
+			if size == 0 {
+				continue
+			}
+			if size < lastSize {
+				return nil, fmt.Errorf("tree size of RTH %d of the history shrinks from %d to %d", start+uint64(i), lastSize, size)
+			}
+			lastSize = size
+		}
+
+		history = append(history, h.RTHs...)
+		for _, rth := range h.RTHs {
+			if currentRTH == nil || bytes.Equal(rth, currentRTH) {
+				log.Printf("RTH history verified: %d RTHs", start+uint64(len(h.RTHs)))
+				return history, nil
+			}
+		}
+		start += uint64(len(h.RTHs))
+	}
+}
+
+// readExternalLog reads the inclusion proofs and tree head of the external log, if one is given
+func readExternalLog() (map[[32]byte]pt.CTInclusionProof, []byte) {
+	if *ctProofsFile == "" {
+		return nil, nil
+	}
+
+	root, err := hex.DecodeString(*ctRoot)
+	if err != nil || len(root) != sha256.Size {
+		log.Fatalf("invalid -ct-root %q", *ctRoot)
+	}
+	if *ctTreeSize == 0 {
+		log.Fatal("-ct-tree-size is required with -ct-proofs")
+	}
+
+	ctProofs, err := readCTProofs(*ctProofsFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer proofFile.Close()
+	return ctProofs, root
+}
 
-	presenceDB := make(map[string]string)
-	extensionDB := make(map[string]string)
+// checkExternalInclusion verifies that the ciphertext of a record is included in the external log
+func checkExternalInclusion(r record, ctProofs map[[32]byte]pt.CTInclusionProof, root []byte) error {
+	p, ok := ctProofs[r.ctSum]
+	if !ok {
+		return errors.New("no inclusion proof in the external log")
+	}
+	return pt.VerifyInclusion(pt.RFC6962, pt.RFC6962.HashLeaf(r.ct), p.LeafIndex, *ctTreeSize, p.AuditPath, root)
+}
 
-	// Scan proof_file
-	// create a new scanner and read the proofs to proof maps
-	scanner = bufio.NewScanner(proofFile)
-	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), " ")
+// readBaseline decodes the pinned baseline RTH, if one is given
+func readBaseline() []byte {
+	if *baselineRTH == "" {
+		return nil
+	}
 
-		presenceDB[line[0]] = line[1]
-		extensionDB[line[0]] = line[2]
+	b, err := hex.DecodeString(*baselineRTH)
+	if err != nil || len(b) != sha256.Size {
+		log.Fatalf("invalid -baseline-rth %q", *baselineRTH)
+	}
+	return b
+}
 
-		ctSum := [32]byte{}
-		ctSumSlice, err := hex.DecodeString(line[0])
+// checkBaseline verifies that the proof of extension of a record starts at the baseline
+// or at an RTH reached from it, and that it appends the record. The new RTH is added
+// to the reached RTHs.
+func checkBaseline(r record, reached map[[32]byte]bool) error {
+	if r.poe == "" {
+		return errors.New("missing proof of extension")
+	}
+	tree, err := pt.UnmarshalProofTree(r.poe)
+	if err != nil {
+		return err
+	}
 
-		copy(ctSum[:], ctSumSlice)
+	oldRTH, newRTH, err := pt.VerifyExtension(*tree)
+	if err != nil {
+		return err
+	}
+	if !reached[oldRTH] {
+		return errors.New("proof of extension does not build on the baseline RTH")
+	}
+	if err = pt.VerifyAppended(*tree, r.ctSum); err != nil {
+		return fmt.Errorf("record predates the baseline RTH: %v", err)
+	}
 
-		ct := ctDB[ctSum]
-		pop := line[1]
-		poe := line[2]
+	reached[newRTH] = true
+	return nil
+}
 
-		r, err := c.DecryptRecord(context.Background(), &pb.DecryptionRequest{Ciphertext: ct, ProofOfPresence: pop, ProofOfExtension: poe})
-		if err != nil {
-			log.Printf("could not decrypt record: %v", err)
-		} else {
-			fmt.Printf("\rDecryptRecord(%s) = %d", hex.EncodeToString(ctSum[:]), r.Plaintext[0])
+// readAnchor decodes the root of the external log head the RTH must be anchored in, if one is given
+func readAnchor() []byte {
+	if *anchorRoot == "" {
+		return nil
+	}
 
-		}
+	root, err := hex.DecodeString(*anchorRoot)
+	if err != nil || len(root) != sha256.Size {
+		log.Fatalf("invalid -anchor-root %q", *anchorRoot)
+	}
+	if *anchorTreeSize == 0 {
+		log.Fatal("-anchor-tree-size is required with -anchor-root")
+	}
+	return root
+}
 
+// checkAnchor verifies the inclusion of the RTH in the external log head with the given root
+func checkAnchor(rth *pb.RootTreeHash, root []byte) error {
+	a := rth.GetAnchor()
+	if a == nil {
+		return errors.New("server sent no anchor proof")
 	}
-	// check for errors
-	if err = scanner.Err(); err != nil {
-		log.Fatal(err)
+	if a.TreeSize != *anchorTreeSize {
+		return fmt.Errorf("anchor proof is for tree size %d, not %d", a.TreeSize, *anchorTreeSize)
+	}
+	return pt.VerifyInclusion(pt.RFC6962, pt.RFC6962.HashLeaf(rth.Rth), a.LeafIndex, a.TreeSize, a.AuditPath, root)
+}
+
+// runtimeCap returns a channel closed once the run time is up, or never closed for a zero duration
+func runtimeCap(d time.Duration) <-chan struct{} {
+	stop := make(chan struct{})
+	if d > 0 {
+		after := clk.After(d)
+		go func() {
+			<-after
+			close(stop)
+		}()
+	}
+	return stop
+}
+
+// watchConnState logs the transitions of the connection state until the connection is shut down
+func watchConnState(conn *grpc.ClientConn) {
+	state := conn.GetState()
+	log.Printf("connection state: %s", state)
+
+	for state != connectivity.Shutdown && conn.WaitForStateChange(context.Background(), state) {
+		state = conn.GetState()
+		log.Printf("connection state: %s", state)
+	}
+}
+
+// clientIdentifier returns the client version, followed by the operator supplied tag if any
+func clientIdentifier() string {
+	if *clientID == "" {
+		return version
+	}
+	return version + " " + *clientID
+}
+
+// withClientID returns an interceptor sending the client identifier in the metadata of every call
+func withClientID(id string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, "client-id", id)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// unimplemented reports whether an RPC failed because the server does not implement it
+func unimplemented(err error) bool {
+	return status.Code(err) == codes.Unimplemented
+}
+
+// skipUnimplemented reports whether an RPC the server does not implement may be skipped, leaving
+// the RTH unverified. That is only the case with -rth-failure-mode warn, and only when no option
+// relies on the RTH or on the verification key of the attested device.
+func skipUnimplemented(err error, anchor []byte) bool {
+	if !unimplemented(err) || *rthFailureMode != "warn" {
+		return false
+	}
+	return !*requirePOE && !*rthHistory && anchor == nil && len(rthSources) == 0
+}
+
+// checkExtension verifies a JSON proof of extension against the current RTH of the device,
+// and returns the RTH the device moves to when the record is decrypted
+func checkExtension(poe string, currentRTH []byte) (newRTH [32]byte, err error) {
+	if poe == "" {
+		err = errors.New("missing proof of extension")
+		return
+	}
+	tree, err := pt.UnmarshalProofTree(poe)
+	if err != nil {
+		return
 	}
 
-	//  Remote call for DecryptRecord
+	oldRTH, newRTH, err := pt.VerifyExtension(*tree)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(oldRTH[:], currentRTH) {
+		err = errors.New("proof of extension does not start at the current RTH")
+		return
+	}
+	return newRTH, nil
+}
 
+// checkPresence verifies the proof of presence of a record against the RTH its proof of extension leads to
+func checkPresence(r record, rth [32]byte) error {
+	tree, err := pt.UnmarshalProofTree(r.pop)
+	if err != nil {
+		return err
+	}
+	var order [][32]byte
+	root, err := pt.ComputeRoot(tree.Root, &order)
+	if err != nil {
+		return err
+	}
+	if root != rth {
+		return errors.New("proof of presence does not verify against the RTH of the extension")
+	}
+	for _, l := range order {
+		if l == r.ctSum {
+			return nil
+		}
+	}
+	return errors.New("record not present in proof of presence")
+}
+
+// newVerifier builds the enclave identity verifier from the command line flags
+func newVerifier() *att.Verifier {
+	v := &att.Verifier{ISVProdID: *expectedISVProdID}
+
+	var err error
+	if v.MRENCLAVE, err = hex.DecodeString(*expectedMRENCLAVE); err != nil {
+		log.Fatalf("invalid -expected-mrenclave: %v", err)
+	}
+	if *mrenclaveFile != "" {
+		sig, err := att.ReadSigstruct(*mrenclaveFile)
+		if err != nil {
+			log.Fatalf("could not read -expected-mrenclave-file: %v", err)
+		}
+		if len(v.MRENCLAVE) > 0 && !bytes.Equal(v.MRENCLAVE, sig.MRENCLAVE[:]) {
+			log.Fatalf("-expected-mrenclave does not match the MRENCLAVE of %s (%x)", *mrenclaveFile, sig.MRENCLAVE)
+		}
+		v.MRENCLAVE = sig.MRENCLAVE[:]
+	}
+	if v.MRSIGNER, err = hex.DecodeString(*expectedMRSIGNER); err != nil {
+		log.Fatalf("invalid -expected-mrsigner: %v", err)
+	}
+	if v.ISVProdID > 0xffff {
+		log.Fatalf("invalid -expected-isvprodid: %d is out of range", v.ISVProdID)
+	}
+	return v
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sewelol/sgx-decryption-service/clock"
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	"github.com/sewelol/sgx-decryption-service/rthsig"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// historyDevice serves the RTH history in signed pages, the page starting at the requested position
+type historyDevice struct {
+	pb.DecryptionDeviceClient
+	key   *rsa.PrivateKey
+	pages []rthsig.History
+}
+
+func (d *historyDevice) GetRootTreeHashHistory(ctx context.Context, in *pb.RootTreeHashHistoryRequest, opts ...grpc.CallOption) (*pb.RootTreeHashHistory, error) {
+	for _, page := range d.pages {
+		if page.Start != in.Start {
+			continue
+		}
+		page.Nonce = in.Nonce
+		digest := sha256.Sum256(page.SignedBytes())
+		sig, err := rsa.SignPKCS1v15(rand.Reader, d.key, crypto.SHA256, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		return &pb.RootTreeHashHistory{Start: page.Start, Rths: page.RTHs, TreeSizes: page.TreeSizes, Nonce: page.Nonce, Sig: sig}, nil
+	}
+	return &pb.RootTreeHashHistory{Start: in.Start, Nonce: in.Nonce}, nil
+}
+
+func TestCheckHistoryAcrossPages(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rth := func(i byte) []byte {
+		h := sha256.Sum256([]byte{i})
+		return h[:]
+	}
+
+	tests := []struct {
+		name    string
+		pages   []rthsig.History
+		wantErr string
+	}{
+		{
+			name: "growing",
+			pages: []rthsig.History{
+				{Start: 0, RTHs: [][]byte{rth(0), rth(1)}, TreeSizes: []uint64{0, 1}},
+				{Start: 2, RTHs: [][]byte{rth(2), rth(3)}, TreeSizes: []uint64{1, 3}},
+			},
+		},
+		{
+			name: "unknown size at the boundary",
+			pages: []rthsig.History{
+				{Start: 0, RTHs: [][]byte{rth(0), rth(1)}, TreeSizes: []uint64{0, 2}},
+				{Start: 2, RTHs: [][]byte{rth(2), rth(3)}, TreeSizes: []uint64{0, 3}},
+			},
+		},
+		{
+			name: "shrinks at the boundary",
+			pages: []rthsig.History{
+				{Start: 0, RTHs: [][]byte{rth(0), rth(1)}, TreeSizes: []uint64{0, 5}},
+				{Start: 2, RTHs: [][]byte{rth(2), rth(3)}, TreeSizes: []uint64{2, 6}},
+			},
+			wantErr: "shrinks from 5 to 2",
+		},
+		{
+			name: "shrinks past an unknown size",
+			pages: []rthsig.History{
+				{Start: 0, RTHs: [][]byte{rth(0), rth(1)}, TreeSizes: []uint64{4, 0}},
+				{Start: 2, RTHs: [][]byte{rth(2), rth(3)}, TreeSizes: []uint64{3, 6}},
+			},
+			wantErr: "shrinks from 4 to 3",
+		},
+		{
+			name: "repeats at the boundary",
+			pages: []rthsig.History{
+				{Start: 0, RTHs: [][]byte{rth(0), rth(1)}, TreeSizes: []uint64{0, 1}},
+				{Start: 2, RTHs: [][]byte{rth(1), rth(3)}, TreeSizes: []uint64{1, 2}},
+			},
+			wantErr: "repeats the previous RTH",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &historyDevice{key: key, pages: tt.pages}
+			history, err := checkHistory(d, &key.PublicKey, rth(3))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != 4 {
+				t.Fatalf("%d RTHs verified, want 4", len(history))
+			}
+		})
+	}
+}
+
+func TestSkipUnimplemented(t *testing.T) {
+	unimpl := status.Error(codes.Unimplemented, "unknown method")
+	tests := []struct {
+		name       string
+		err        error
+		mode       string
+		requirePOE bool
+		history    bool
+		anchor     []byte
+		want       bool
+	}{
+		{name: "fatal by default", err: unimpl, mode: "fatal"},
+		{name: "warn", err: unimpl, mode: "warn", want: true},
+		{name: "other error", err: status.Error(codes.Unavailable, "down"), mode: "warn"},
+		{name: "require-poe", err: unimpl, mode: "warn", requirePOE: true},
+		{name: "rth-history", err: unimpl, mode: "warn", history: true},
+		{name: "anchor", err: unimpl, mode: "warn", anchor: make([]byte, 32)},
+	}
+
+	defer func(mode string, poe, history bool) {
+		*rthFailureMode, *requirePOE, *rthHistory = mode, poe, history
+	}(*rthFailureMode, *requirePOE, *rthHistory)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*rthFailureMode, *requirePOE, *rthHistory = tt.mode, tt.requirePOE, tt.history
+			if got := skipUnimplemented(tt.err, tt.anchor); got != tt.want {
+				t.Errorf("skipUnimplemented: %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRTHSigDowngrade(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rth := &pb.RootTreeHash{Rth: make([]byte, 32), Nonce: []byte("nonce"), Version: rthsig.Legacy}
+	h := rthsig.Digest(rthsig.Legacy, rth.Rth, rth.Nonce, 0, 0)
+	if rth.Sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(v uint) { *rthSigVersion = v }(*rthSigVersion)
+	*rthSigVersion = rthsig.Legacy
+	if err = verifyRTHSig(&key.PublicKey, rth); err != nil {
+		t.Errorf("legacy RTH with -rth-sig-version 1: %v", err)
+	}
+	// the error is left to -rth-failure-mode, the client must not exit here
+	*rthSigVersion = rthsig.Canonical
+	if err = verifyRTHSig(&key.PublicKey, rth); err == nil || !strings.Contains(err.Error(), "not the canonical format") {
+		t.Errorf("legacy RTH with -rth-sig-version 2: %v, want a format error", err)
+	}
+}
+
+func TestRuntimeCap(t *testing.T) {
+	defer func(c clock.Clock) { clk = c }(clk)
+	c := clock.NewFake(time.Unix(1500000000, 0))
+	clk = c
+
+	stop := runtimeCap(time.Minute)
+	c.BlockUntil(1)
+	c.Advance(time.Minute - time.Second)
+	select {
+	case <-stop:
+		t.Fatal("stopped before the run time was up")
+	default:
+	}
+
+	c.Advance(time.Second)
+	select {
+	case <-stop:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not stopped once the run time was up")
+	}
+}
+
+func TestNewNonceBound(t *testing.T) {
+	defer func(c clock.Clock, bind bool, src io.Reader) { clk, *nonceBind, nonceSource = c, bind, src }(clk, *nonceBind, nonceSource)
+	clk = clock.NewFake(time.Unix(1500000000, 0))
+	*nonceBind = true
+
+	nonce := func() []byte {
+		nonceSource = bytes.NewReader(make([]byte, *nonceLen))
+		n, err := newNonce("test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	first := nonce()
+	if !bytes.Equal(nonce(), first) {
+		t.Error("same random bytes at the same time bound to different nonces")
+	}
+	clk.(*clock.Fake).Advance(time.Second)
+	if bytes.Equal(nonce(), first) {
+		t.Error("nonce not bound to the time")
+	}
+}
+
+// TestWithClientID checks that the client identifier is added to the metadata the caller already set
+func TestWithClientID(t *testing.T) {
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "trace-id", "42")
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	if err := withClientID("dummyclient/test")(ctx, "/Method", nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if got := md["client-id"]; len(got) != 1 || got[0] != "dummyclient/test" {
+		t.Errorf("client-id %q, want %q", got, "dummyclient/test")
+	}
+	if got := md["trace-id"]; len(got) != 1 || got[0] != "42" {
+		t.Errorf("metadata of the caller replaced, trace-id %q", got)
+	}
+}
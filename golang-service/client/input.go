@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// inputFile reads an input file, decompressing it when it is gzip compressed.
+// The size limit applies to the decompressed stream, so a small compressed
+// file cannot expand without bound.
+type inputFile struct {
+	file *os.File
+	gz   *gzip.Reader
+	r    io.Reader
+	name string
+	max  int64
+	n    int64
+}
+
+// openInput opens an input file of at most limit decompressed bytes, limit <= 0 disables the limit
+func openInput(filename string, limit int64) (*inputFile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &inputFile{file: file, name: filename, max: limit}
+	br := bufio.NewReader(file)
+	f.r = br
+
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && string(magic) == string(gzipMagic) {
+		if f.gz, err = gzip.NewReader(br); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		f.r = f.gz
+	}
+
+	if limit > 0 {
+		// one byte over the limit tells an exceeded limit from a file of exactly limit bytes
+		f.r = io.LimitReader(f.r, limit+1)
+	}
+	return f, nil
+}
+
+func (f *inputFile) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	f.n += int64(n)
+	if f.max > 0 && f.n > f.max {
+		return n, fmt.Errorf("%s: decompressed size exceeds -max-file-size of %d bytes", f.name, f.max)
+	}
+	return n, err
+}
+
+// Close closes the gzip stream and the file
+func (f *inputFile) Close() error {
+	if f.gz != nil {
+		f.gz.Close()
+	}
+	return f.file.Close()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// TestOpenInputGzipBomb reads a gzip file of a few kilobytes that expands to 16 MiB of zeros,
+// which must stop at the limit on the decompressed size
+func TestOpenInputGzipBomb(t *testing.T) {
+	const limit = 1 << 20
+	bomb := gzipped(t, make([]byte, 16<<20))
+	if ratio := (16 << 20) / len(bomb); ratio < 500 {
+		t.Fatalf("compression ratio is %d, want a high-ratio input", ratio)
+	}
+
+	f, err := openInput(writeTestFile(t, "bomb.gz", bomb), limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err == nil || !strings.Contains(err.Error(), "exceeds -max-file-size") {
+		t.Fatalf("error %v, want the size limit exceeded", err)
+	}
+	if len(data) > limit+1 {
+		t.Fatalf("read %d bytes past a limit of %d", len(data), limit)
+	}
+}
+
+func TestOpenInputLimit(t *testing.T) {
+	const limit = 1 << 10
+	exact := strings.Repeat("x", limit)
+
+	tests := []struct {
+		name     string
+		content  string
+		limit    int64
+		exceeded bool
+	}{
+		{name: "plain at the limit", content: exact, limit: limit},
+		{name: "plain over the limit", content: exact + "x", limit: limit, exceeded: true},
+		{name: "gzip at the limit", content: gzipped(t, []byte(exact)), limit: limit},
+		{name: "gzip over the limit", content: gzipped(t, []byte(exact+"x")), limit: limit, exceeded: true},
+		{name: "no limit", content: gzipped(t, []byte(exact+"x")), limit: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := openInput(writeTestFile(t, "input", tt.content), tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			data, err := ioutil.ReadAll(f)
+			if tt.exceeded {
+				if err == nil {
+					t.Fatal("limit not enforced")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(data), exact) {
+				t.Fatalf("read %d bytes, not the decompressed input", len(data))
+			}
+		})
+	}
+}
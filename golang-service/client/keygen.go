@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// keygen implements the keygen subcommand: it generates a request-signing key pair, writes the
+// private key to a file only the user can read, and prints the public key for registration
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	alg := fs.String("alg", "ed25519", "key algorithm: ed25519 or rsa")
+	bits := fs.Int("bits", 3072, "RSA modulus size in bits")
+	out := fs.String("out", "client_key.pem", "file to write the PEM encoded private key to, must not exist")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s keygen [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Generates a key pair and prints the PEM encoded public key to register with the server.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var priv crypto.Signer
+	var err error
+	switch *alg {
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "rsa":
+		if *bits < 2048 {
+			log.Fatalf("invalid -bits %d: RSA keys must have at least 2048 bits", *bits)
+		}
+		priv, err = rsa.GenerateKey(rand.Reader, *bits)
+	default:
+		log.Fatalf("unknown -alg %q", *alg)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// never overwrite an existing key, and keep the new one readable by the user only
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = pem.Encode(file, &pem.Block{Type: "PRIVATE KEY", Bytes: privDER}); err != nil {
+		file.Close()
+		os.Remove(*out)
+		log.Fatal(err)
+	}
+	if err = file.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("%s private key written to %s", *alg, *out)
+	pem.Encode(os.Stdout, &pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+}
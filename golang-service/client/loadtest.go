@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// loadtest implements the loadtest subcommand: it sends DecryptRecord calls at a paced rate from a
+// pool of workers and reports throughput, latency percentiles and errors per interval.
+// Ticks of the pacer that find all workers busy are dropped rather than queued, so an
+// overloaded device sees the configured concurrency, not a growing backlog.
+func loadtest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	rate := fs.Float64("rate", 10, "DecryptRecord calls per second (0 for as fast as the workers go)")
+	concurrency := fs.Int("concurrency", 4, "calls in flight at most")
+	duration := fs.Duration("duration", 30*time.Second, "length of the test")
+	rampUp := fs.Duration("ramp-up", 0, "raise the rate linearly from zero over this long")
+	interval := fs.Duration("report-interval", 5*time.Second, "how often to report")
+	timeout := fs.Duration("timeout", 10*time.Second, "deadline of a single call")
+	synthetic := fs.Bool("synthetic", false, "send freshly encrypted random records instead of the dataset, the device rejects their proofs")
+	addTLSFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s loadtest [flags]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *concurrency < 1 {
+		log.Fatalf("invalid -concurrency %d", *concurrency)
+	}
+
+	transport, err := transportOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+	id := clientIdentifier()
+	conn, err := grpc.Dial(address, transport, grpc.WithUserAgent(id+" loadtest"), grpc.WithUnaryInterceptor(withClientID(id)))
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer conn.Close()
+	c := pb.NewDecryptionDeviceClient(conn)
+	client := dc.New(c)
+
+	var records []dc.Record
+	if *synthetic {
+		records, err = syntheticRecords(c, 64)
+	} else {
+		records, err = datasetRecords()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(records) == 0 {
+		log.Fatal("no records to send")
+	}
+
+	stats := &loadStats{}
+	work := make(chan dc.Record)
+	var wg sync.WaitGroup
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range work {
+				ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+				start := time.Now()
+				_, err := client.Decrypt(ctx, r)
+				cancel()
+				stats.add(time.Since(start), err)
+			}
+		}()
+	}
+
+	// every call is due at a time computed from the start, a wait never outlasts the end of the test
+	// or the next report
+	start := clk.Now()
+	end := clk.After(*duration)
+	report := clk.After(*interval)
+	next := 0
+
+	// without a rate the workers are fed as fast as they take the records
+	var unpaced chan<- dc.Record
+	if *rate <= 0 {
+		unpaced = work
+	}
+
+pace:
+	for n := 0; ; n++ {
+		var due <-chan time.Time
+		if *rate > 0 {
+			due = clk.After(start.Add(callDue(*rate, *rampUp, n)).Sub(clk.Now()))
+		}
+		r := records[next%len(records)]
+
+	wait:
+		for {
+			select {
+			case <-end:
+				break pace
+			case <-report:
+				log.Printf("t=%s %s", clk.Now().Sub(start).Round(time.Second), stats.interval(*interval))
+				report = clk.After(*interval)
+			case <-due:
+				select {
+				case work <- r:
+					next++
+				default:
+					stats.drop()
+				}
+				break wait
+			case unpaced <- r:
+				next++
+				break wait
+			}
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	elapsed := clk.Now().Sub(start)
+	log.Printf("total after %s: %s", elapsed.Round(time.Second), stats.total(elapsed))
+}
+
+// callDue returns when the nth call is due, counted from the start of the test. The rate rises
+// linearly from zero over the ramp-up, so the calls due by time t are the area under the rate:
+// rate*t²/(2*rampUp) during the ramp-up, and rate*rampUp/2 + rate*(t-rampUp) after it.
+func callDue(rate float64, rampUp time.Duration, n int) time.Duration {
+	ramp := rampUp.Seconds()
+	rampCalls := rate * ramp / 2
+	var t float64
+	if ramp > 0 && float64(n) <= rampCalls {
+		t = math.Sqrt(2 * ramp * float64(n) / rate)
+	} else {
+		t = ramp + (float64(n)-rampCalls)/rate
+	}
+	return time.Duration(t * float64(time.Second))
+}
+
+// datasetRecords returns the records of the dataset joined with their proofs
+func datasetRecords() ([]dc.Record, error) {
+	ctDB, err := readRecords(recordsFile)
+	if err != nil {
+		return nil, err
+	}
+	proofs, err := readProofs(proofsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	joined, _, _ := joinRecords(ctDB, proofs)
+	var records []dc.Record
+	for _, r := range joined {
+		records = append(records, dc.Record{Ciphertext: r.ct, ProofOfPresence: r.pop, ProofOfExtension: r.poe})
+	}
+	return records, nil
+}
+
+// syntheticRecords encrypts n random plaintexts with the device's encryption key
+func syntheticRecords(c pb.DecryptionDeviceClient, n int) ([]dc.Record, error) {
+	nonce, err := newNonce("GetPublicKey")
+	if err != nil {
+		return nil, err
+	}
+	pk, err := c.GetPublicKey(context.Background(), &pb.PublicKeyRequest{Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pk.RSA_EncryptionKey)
+	if block == nil {
+		return nil, errors.New("no PEM encoded encryption key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("encryption key is not an RSA key")
+	}
+	if err = checkExponent(rsaPub); err != nil {
+		return nil, err
+	}
+
+	records := make([]dc.Record, n)
+	plaintext := make([]byte, 32)
+	for i := range records {
+		if _, err = rand.Read(plaintext); err != nil {
+			return nil, err
+		}
+		ct, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, plaintext, []byte("record"))
+		if err != nil {
+			return nil, err
+		}
+		records[i] = dc.Record{Ciphertext: ct, ProofOfPresence: "{}", ProofOfExtension: "{}"}
+	}
+	return records, nil
+}
+
+// loadStats collects the latencies and errors of the calls, per report interval and in total
+type loadStats struct {
+	mu        sync.Mutex
+	latencies []time.Duration // of the current interval
+	errs      int
+	dropped   int
+
+	all        []time.Duration
+	allErrs    int
+	allDropped int
+}
+
+func (s *loadStats) add(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latencies = append(s.latencies, d)
+	s.all = append(s.all, d)
+	if err != nil {
+		s.errs++
+		s.allErrs++
+	}
+}
+
+func (s *loadStats) drop() {
+	s.mu.Lock()
+	s.dropped++
+	s.allDropped++
+	s.mu.Unlock()
+}
+
+// interval summarizes the current interval and starts the next one
+func (s *loadStats) interval(d time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line := summarize(s.latencies, s.errs, s.dropped, d)
+	s.latencies, s.errs, s.dropped = nil, 0, 0
+	return line
+}
+
+func (s *loadStats) total(d time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return summarize(s.all, s.allErrs, s.allDropped, d)
+}
+
+// summarize formats throughput, latency percentiles and error rate of the calls made over d
+func summarize(latencies []time.Duration, errs, dropped int, d time.Duration) string {
+	n := len(latencies)
+	if n == 0 {
+		return fmt.Sprintf("0 calls, %d dropped", dropped)
+	}
+
+	sorted := append([]time.Duration(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p := func(q float64) time.Duration { return sorted[int(q*float64(n-1))] }
+
+	return fmt.Sprintf("%d calls (%.1f/s), p50 %s p90 %s p99 %s, %d errors (%.1f%%), %d dropped",
+		n, float64(n)/d.Seconds(), p(0.5), p(0.9), p(0.99), errs, 100*float64(errs)/float64(n), dropped)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCallDue(t *testing.T) {
+	tests := []struct {
+		name   string
+		rate   float64
+		rampUp time.Duration
+		n      int
+		want   time.Duration
+	}{
+		{name: "first call", rate: 10, n: 0, want: 0},
+		{name: "steady rate", rate: 10, n: 25, want: 2500 * time.Millisecond},
+		{name: "first call of the ramp-up", rate: 10, rampUp: 30 * time.Second, n: 0, want: 0},
+		// 1 call is due once rate*t²/(2*rampUp) reaches 1, t = sqrt(6s²)
+		{name: "second call of the ramp-up", rate: 10, rampUp: 30 * time.Second, n: 1, want: 2449489742 * time.Nanosecond},
+		{name: "end of the ramp-up", rate: 10, rampUp: 30 * time.Second, n: 150, want: 30 * time.Second},
+		{name: "after the ramp-up", rate: 10, rampUp: 30 * time.Second, n: 160, want: 31 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := callDue(tt.rate, tt.rampUp, tt.n)
+			if d := got - tt.want; d < -time.Microsecond || d > time.Microsecond {
+				t.Errorf("call %d due at %s, want %s", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCallDuePacing checks that the gaps between calls shrink during the ramp-up, never exceed
+// the ramp-up, and settle at 1/rate
+func TestCallDuePacing(t *testing.T) {
+	const rate = 10
+	rampUp := 30 * time.Second
+
+	prev := callDue(rate, rampUp, 0)
+	prevGap := rampUp
+	for n := 1; n < 300; n++ {
+		due := callDue(rate, rampUp, n)
+		gap := due - prev
+		if gap <= 0 || gap > prevGap+time.Microsecond {
+			t.Fatalf("call %d due %s after the previous one, which came %s after its own", n, gap, prevGap)
+		}
+		prev, prevGap = due, gap
+	}
+	if d := prevGap - time.Second/rate; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("gap after the ramp-up %s, want %s", prevGap, time.Second/rate)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+	"golang.org/x/net/context"
+)
+
+// maxNDJSONLine bounds a line of ndjson input, proofs of large trees make long lines
+const maxNDJSONLine = 16 << 20
+
+// ndjsonRecord is one line of ndjson input. The proofs are JSON proof trees,
+// given as objects or as strings holding the JSON.
+type ndjsonRecord struct {
+	Ciphertext       []byte          `json:"ciphertext_b64"`
+	ProofOfPresence  json.RawMessage `json:"pop"`
+	ProofOfExtension json.RawMessage `json:"poe"`
+}
+
+// streamNDJSON decrypts the records read from r one line at a time, in order, and writes
+// one result per input line to w as soon as it is known. A line that is not a valid record,
+// or a record rejected by the local checks of the batch, gets an error result and does not
+// stop the stream. The RTH of the batch moves on with every record sent.
+func streamNDJSON(b *batch, r io.Reader, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxNDJSONLine)
+
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		res := result{Line: n}
+		rec, err := parseNDJSONRecord(scanner.Bytes())
+		if err == nil {
+			ctSum := sha256.Sum256(rec.Ciphertext)
+			res.Hash = hex.EncodeToString(ctSum[:])
+			res.Plaintext, err = b.stream(record{ct: rec.Ciphertext, proof: proof{ctSum: ctSum, pop: rec.ProofOfPresence, poe: rec.ProofOfExtension}})
+		}
+		if err != nil {
+			res.Plaintext, res.Error = nil, err.Error()
+		} else if merr := plaintextSchemaRules.check(res.Plaintext); merr != nil {
+			res.Malformed = merr.Error()
+		}
+
+		if err = enc.Encode(res); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// stream verifies a record locally against the RTH of the batch and decrypts it
+func (b *batch) stream(r record) ([]byte, error) {
+	newRTH, err := b.verify(r, b.rth)
+	if err != nil {
+		return nil, fmt.Errorf("rejected by local proof verification: %v", err)
+	}
+	b.rth = newRTH
+
+	plaintext, err := b.client.Decrypt(context.Background(), dc.Record{Ciphertext: r.ct, ProofOfPresence: r.pop, ProofOfExtension: r.poe, BaselineRTH: b.baseline})
+	if b.clog != nil {
+		if werr := b.clog.Append(r.ctSum, plaintext, err); werr != nil {
+			log.Fatalf("could not append to the client log: %v", werr)
+		}
+	}
+	return plaintext, err
+}
+
+// parseNDJSONRecord validates a line of ndjson input and returns the record to send
+func parseNDJSONRecord(line []byte) (dc.Record, error) {
+	var in ndjsonRecord
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		return dc.Record{}, err
+	}
+	if len(in.Ciphertext) == 0 {
+		return dc.Record{}, errors.New("missing ciphertext_b64")
+	}
+
+	pop, err := ndjsonProof("pop", in.ProofOfPresence)
+	if err != nil {
+		return dc.Record{}, err
+	}
+	poe, err := ndjsonProof("poe", in.ProofOfExtension)
+	if err != nil {
+		return dc.Record{}, err
+	}
+	return dc.Record{Ciphertext: in.Ciphertext, ProofOfPresence: pop, ProofOfExtension: poe}, nil
+}
+
+// ndjsonProof returns the JSON of a proof given as an object or a string, after checking it parses
+func ndjsonProof(name string, raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", errors.New("missing " + name)
+	}
+
+	proof := string(raw)
+	if raw[0] == '"' {
+		if err := json.Unmarshal(raw, &proof); err != nil {
+			return "", err
+		}
+	}
+	if _, err := pt.UnmarshalProofTree(proof); err != nil {
+		return "", errors.New("invalid " + name + ": " + err.Error())
+	}
+	return proof, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+)
+
+// presenceProof returns the JSON proof of presence of the leaf appended to the tree with the given RTH
+func presenceProof(t *testing.T, rth []byte, leaf [32]byte) string {
+	t.Helper()
+	pop := pt.ProofTree{Root: pt.ProofNode{Left: &pt.ProofNode{Hash: hex.EncodeToString(rth)}, Right: &pt.ProofNode{Hash: hex.EncodeToString(leaf[:])}}}
+	buf, err := json.Marshal(pop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// TestStreamNDJSONPinned streams records against a pinned RTH: a record whose proofs do not build
+// on the RTH the device is at is rejected without being sent, the others move the RTH on
+func TestStreamNDJSONPinned(t *testing.T) {
+	genesis := sha256.Sum256([]byte("genesis"))
+	ctA, a := testCiphertext("a")
+	ctB, b := testCiphertext("b")
+	rthA := pt.ComputeRTH([][]byte{genesis[:], a[:]})
+	rthB := pt.ComputeRTH([][]byte{genesis[:], a[:], b[:]})
+
+	line := func(ct []byte, rth []byte, leaf [32]byte) string {
+		return fmt.Sprintf(`{"ciphertext_b64": %q, "pop": %q, "poe": %q}`, base64.StdEncoding.EncodeToString(ct),
+			presenceProof(t, rth, leaf), appendProof(t, rth, leaf))
+	}
+	in := strings.Join([]string{
+		line(ctA, genesis[:], a),
+		line(ctB, genesis[:], b), // builds on the genesis RTH the device already moved away from
+		line(ctB, rthA, b),
+	}, "\n")
+
+	dev := new(echoDevice)
+	bt := &batch{client: dc.New(dev), rth: genesis[:], pinned: true}
+	var out bytes.Buffer
+	if err := streamNDJSON(bt, strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []result
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var res result
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, res)
+	}
+	if len(results) != 3 {
+		t.Fatalf("%d results, want 3", len(results))
+	}
+	for i, want := range [][]byte{ctA, nil, ctB} {
+		res := results[i]
+		if want == nil {
+			if !strings.Contains(res.Error, "rejected") {
+				t.Errorf("line %d: error %q, want a rejection", res.Line, res.Error)
+			}
+			continue
+		}
+		if res.Error != "" || !bytes.Equal(res.Plaintext, want) {
+			t.Errorf("line %d: plaintext %q, error %q, want %q", res.Line, res.Plaintext, res.Error, want)
+		}
+	}
+
+	if len(dev.got) != 2 || !bytes.Equal(dev.got[0], ctA) || !bytes.Equal(dev.got[1], ctB) {
+		t.Errorf("records sent %q, want %q", dev.got, [][]byte{ctA, ctB})
+	}
+	if !bytes.Equal(bt.rth, rthB) {
+		t.Errorf("RTH after the stream %x, want %x", bt.rth, rthB)
+	}
+}
+
+func TestNDJSONUnsupported(t *testing.T) {
+	defer func(keymap string, runtime time.Duration) { *keymapFile, *maxRuntime = keymap, runtime }(*keymapFile, *maxRuntime)
+
+	if flags := ndjsonUnsupported(); len(flags) != 0 {
+		t.Fatalf("flags %v reported without any set", flags)
+	}
+	*keymapFile, *maxRuntime = "ids.txt", time.Minute
+	if flags, want := ndjsonUnsupported(), []string{"-keymap", "-max-runtime"}; !reflect.DeepEqual(flags, want) {
+		t.Errorf("flags %v, want %v", flags, want)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"log"
+)
+
+// minNonceLen is the shortest nonce the client sends, 32 bytes are recommended
+const minNonceLen = 16
+
+// nonceSource is the source of the random bytes of nonces and challenges. Only builds with the
+// seednonce tag can replace crypto/rand, with -seed.
+var nonceSource io.Reader = rand.Reader
+
+// newNonce returns a fresh nonce of -nonce-len random bytes for a request.
+// With -nonce-bind the nonce is sha256(random || timestamp || client identifier) instead,
+// and its inputs are logged, so a request can be matched with the server's logs.
+func newNonce(rpc string) ([]byte, error) {
+	nonce := make([]byte, *nonceLen)
+	if _, err := io.ReadFull(nonceSource, nonce); err != nil {
+		return nil, err
+	}
+	if !*nonceBind {
+		return nonce, nil
+	}
+
+	timestamp := clk.Now().Unix()
+	id := clientIdentifier()
+	h := sha256.New()
+	h.Write(nonce)
+	binary.Write(h, binary.BigEndian, timestamp)
+	h.Write([]byte(id))
+	bound := h.Sum(nil)
+
+	log.Printf("%s nonce %x = sha256(%x || %d || %q)", rpc, bound, nonce, timestamp, id)
+	return bound, nil
+}
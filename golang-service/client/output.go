@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// result is the JSON output for one record
+type result struct {
+	Line      int    `json:"line,omitempty"` // input line of the record, ndjson input only
+	ID        string `json:"id,omitempty"`   // external ID of the record, with -keymap
+	Hash      string `json:"hash"`
+	Plaintext []byte `json:"plaintext,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Malformed string `json:"malformed,omitempty"` // why the plaintext does not conform to -plaintext-schema
+}
+
+// resultWriter writes results as JSON lines.
+// Results are buffered and flushed to disk every flush interval, or after
+// every result when the interval is zero.
+type resultWriter struct {
+	mu       sync.Mutex
+	file     *os.File
+	buf      *bufio.Writer
+	enc      *json.Encoder
+	interval time.Duration
+	done     chan struct{}
+	closed   bool
+}
+
+func newResultWriter(filename string, interval time.Duration) (*resultWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &resultWriter{file: file, buf: bufio.NewWriter(file), interval: interval, done: make(chan struct{})}
+	w.enc = json.NewEncoder(w.buf)
+
+	if interval > 0 {
+		go w.flushLoop()
+	}
+	return w, nil
+}
+
+// Write buffers a result
+func (w *resultWriter) Write(r result) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.enc.Encode(r); err != nil {
+		return err
+	}
+	if w.interval == 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+// Close flushes the buffered results and closes the file
+func (w *resultWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+
+	if err := w.flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *resultWriter) flushLoop() {
+	for {
+		select {
+		case <-clk.After(w.interval):
+			w.mu.Lock()
+			if !w.closed {
+				if err := w.flush(); err != nil {
+					log.Printf("could not flush results: %v", err)
+				}
+			}
+			w.mu.Unlock()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// flush writes the buffer to disk, the caller holds w.mu
+func (w *resultWriter) flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// dirWriter writes every plaintext to its own file in a directory.
+// Files are named after the hex encoded ciphertext hash or the record's position,
+// a record seen twice gets a numbered suffix. Files are written to a temporary file
+// and renamed, so a file that exists holds a complete plaintext.
+type dirWriter struct {
+	mu    sync.Mutex
+	dir   string
+	names map[string]int // times a name was used
+}
+
+func newDirWriter(dir string) (*dirWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &dirWriter{dir: dir, names: make(map[string]int)}, nil
+}
+
+// Write writes the plaintext under the given name
+func (w *dirWriter) Write(name string, plaintext []byte) error {
+	name = sanitizeName(name)
+	w.mu.Lock()
+	if n := w.names[name]; n > 0 {
+		w.names[name]++
+		name = fmt.Sprintf("%s-%d", name, n)
+	}
+	w.names[name]++
+	w.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(w.dir, "."+name+".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(plaintext); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(w.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// sanitizeName keeps a name to letters, digits, '-', '_' and '.', and never starting with a '.'
+func sanitizeName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] == '.' {
+		b = append([]byte{'_'}, b...)
+	}
+	return string(b)
+}
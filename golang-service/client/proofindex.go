@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Layout of a proofs index: a header with the size and sha256 of the proofs file it indexes,
+// followed by fixed size entries sorted by ciphertext hash, so a lookup is a binary search on disk
+const (
+	proofIndexMagic     = "SGXPIDX1"
+	proofIndexHeader    = len(proofIndexMagic) + 8 + sha256.Size
+	proofIndexEntrySize = sha256.Size + 8 + 4 + 4 // hash, offset, length and line number of the line
+)
+
+// proofIndexSuffix names the index of a proofs file
+const proofIndexSuffix = ".idx"
+
+// proofIndex looks up the proofs of a ciphertext in a proofs file, reading only the index
+// entries of the binary search and the line of the proofs
+type proofIndex struct {
+	proofs   *os.File
+	index    *os.File
+	name     string
+	nentries int64
+}
+
+// proofIndexEntry locates the line of the proofs of a ciphertext
+type proofIndexEntry struct {
+	ctSum  [32]byte
+	offset uint64
+	length uint32
+	line   uint32
+}
+
+// indexProofs implements the index-proofs subcommand: it writes the index of a proofs file
+// next to it, so -proofs-index can look up proofs without reading the whole file
+func indexProofs(args []string) {
+	fs := flag.NewFlagSet("index-proofs", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s index-proofs proofs.csv\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Writes the index to proofs.csv%s. Rebuild it whenever the proofs file changes,\n", proofIndexSuffix)
+		fmt.Fprintf(os.Stderr, "an index that does not match the file's checksum is refused.\n")
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	n, err := writeProofIndex(fs.Arg(0), fs.Arg(0)+proofIndexSuffix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("ok   %d proofs indexed in %s\n", n, fs.Arg(0)+proofIndexSuffix)
+}
+
+// writeProofIndex reads the proofs file once, checking every line, and writes its index.
+// The first line of a ciphertext is indexed, like joinRecords a later one is not looked up.
+func writeProofIndex(filename, indexName string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	r := bufio.NewReader(io.TeeReader(file, h))
+	if magic, err := r.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		return 0, fmt.Errorf("%s: compressed proofs files cannot be indexed, decompress it first", filename)
+	}
+
+	var entries []proofIndexEntry
+	seen := make(map[[32]byte]bool)
+	var offset uint64
+	for n := uint32(1); ; n++ {
+		text, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if text == "" {
+			break
+		}
+		length := uint64(len(text))
+		if length > 1<<32-1 {
+			return 0, fmt.Errorf("%s:%d: line too long to index", filename, n)
+		}
+
+		if strings.TrimSpace(text) != "" {
+			p, perr := parseProofLine(text)
+			if perr != nil {
+				return 0, fmt.Errorf("%s:%d: %v", filename, n, perr)
+			}
+			if !seen[p.ctSum] {
+				seen[p.ctSum] = true
+				entries = append(entries, proofIndexEntry{ctSum: p.ctSum, offset: offset, length: uint32(length), line: n})
+			}
+		}
+		offset += length
+		if err == io.EOF {
+			break
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].ctSum[:], entries[j].ctSum[:]) < 0 })
+
+	out, err := os.Create(indexName)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(out)
+	w.WriteString(proofIndexMagic)
+	binary.Write(w, binary.BigEndian, offset)
+	w.Write(h.Sum(nil))
+	for _, e := range entries {
+		w.Write(e.ctSum[:])
+		binary.Write(w, binary.BigEndian, e.offset)
+		binary.Write(w, binary.BigEndian, e.length)
+		binary.Write(w, binary.BigEndian, e.line)
+	}
+	if err = w.Flush(); err != nil {
+		out.Close()
+		return 0, err
+	}
+	return len(entries), out.Close()
+}
+
+// openProofIndex opens a proofs file with its index, after checking the index was built
+// from the file as it is now: same size and same sha256
+func openProofIndex(filename string) (*proofIndex, error) {
+	indexName := filename + proofIndexSuffix
+	index, err := os.Open(indexName)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: no index, run index-proofs %s", filename, filename)
+	} else if err != nil {
+		return nil, err
+	}
+
+	ix := &proofIndex{index: index, name: filename}
+	if err = ix.check(filename, indexName); err != nil {
+		index.Close()
+		return nil, err
+	}
+	if ix.proofs, err = os.Open(filename); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+func (ix *proofIndex) check(filename, indexName string) error {
+	header := make([]byte, proofIndexHeader)
+	if _, err := io.ReadFull(ix.index, header); err != nil || string(header[:len(proofIndexMagic)]) != proofIndexMagic {
+		return fmt.Errorf("%s: not a proofs index", indexName)
+	}
+	size := binary.BigEndian.Uint64(header[len(proofIndexMagic):])
+	sum := header[len(proofIndexMagic)+8:]
+
+	info, err := ix.index.Stat()
+	if err != nil {
+		return err
+	}
+	body := info.Size() - int64(proofIndexHeader)
+	if body%int64(proofIndexEntrySize) != 0 {
+		return fmt.Errorf("%s: truncated proofs index", indexName)
+	}
+	ix.nentries = body / int64(proofIndexEntrySize)
+
+	// the size catches most changes cheaply, the checksum the rest
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if info, err = file.Stat(); err != nil {
+		return err
+	}
+	stale := fmt.Errorf("%s changed since %s was built, run index-proofs %s again", filename, indexName, filename)
+	if uint64(info.Size()) != size {
+		return stale
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), sum) {
+		return stale
+	}
+	return nil
+}
+
+// lookup returns the proofs of a ciphertext and the line they are on, ok is false if the
+// proofs file has none
+func (ix *proofIndex) lookup(ctSum [32]byte) (p proof, line uint32, ok bool, err error) {
+	buf := make([]byte, proofIndexEntrySize)
+	var readErr error
+	i := sort.Search(int(ix.nentries), func(i int) bool {
+		if _, err := ix.index.ReadAt(buf, int64(proofIndexHeader)+int64(i)*int64(proofIndexEntrySize)); err != nil {
+			readErr = err
+			return true
+		}
+		return bytes.Compare(buf[:sha256.Size], ctSum[:]) >= 0
+	})
+	if readErr != nil {
+		return proof{}, 0, false, readErr
+	}
+	if int64(i) == ix.nentries {
+		return proof{}, 0, false, nil
+	}
+	if _, err = ix.index.ReadAt(buf, int64(proofIndexHeader)+int64(i)*int64(proofIndexEntrySize)); err != nil {
+		return proof{}, 0, false, err
+	}
+	if !bytes.Equal(buf[:sha256.Size], ctSum[:]) {
+		return proof{}, 0, false, nil
+	}
+
+	offset := binary.BigEndian.Uint64(buf[sha256.Size:])
+	length := binary.BigEndian.Uint32(buf[sha256.Size+8:])
+	line = binary.BigEndian.Uint32(buf[sha256.Size+12:])
+	text := make([]byte, length)
+	if _, err = ix.proofs.ReadAt(text, int64(offset)); err != nil {
+		return proof{}, 0, false, fmt.Errorf("%s:%d: %v", ix.name, line, err)
+	}
+	if p, err = parseProofLine(string(text)); err != nil {
+		return proof{}, 0, false, fmt.Errorf("%s:%d: %v", ix.name, line, err)
+	}
+	if p.ctSum != ctSum {
+		return proof{}, 0, false, errors.New(ix.name + ": index does not match the proofs file")
+	}
+	return p, line, true, nil
+}
+
+func (ix *proofIndex) Close() error {
+	ix.index.Close()
+	return ix.proofs.Close()
+}
+
+// readIndexedRecords joins the ciphertexts with their proofs looked up in the index, in proofs
+// file order, and the orphan ciphertexts sorted by hash. Proofs without a ciphertext are not read,
+// so they are not reported as orphans.
+func readIndexedRecords(ctDB map[[32]byte][]byte, ix *proofIndex) (records []record, orphanRecords [][32]byte, err error) {
+	lines := make(map[[32]byte]uint32)
+	for ctSum, ct := range ctDB {
+		p, line, ok, err := ix.lookup(ctSum)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			orphanRecords = append(orphanRecords, ctSum)
+			continue
+		}
+		records = append(records, record{ct: ct, proof: p})
+		lines[ctSum] = line
+	}
+	sort.Slice(records, func(i, j int) bool { return lines[records[i].ctSum] < lines[records[j].ctSum] })
+	sortSums(orphanRecords)
+	return records, orphanRecords, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeTestProofs writes a proofs file of n records and returns it with the ciphertext hashes, in file order
+func writeTestProofs(tb testing.TB, dir string, n int) (string, [][32]byte) {
+	var b strings.Builder
+	sums := make([][32]byte, n)
+	for i := range sums {
+		sums[i] = sha256.Sum256([]byte(fmt.Sprint("ciphertext ", i)))
+		fmt.Fprintf(&b, "%s {\"pop\":%d} {\"poe\":%d}\n", hex.EncodeToString(sums[i][:]), i, i)
+	}
+	filename := dir + "/proofs.csv"
+	if err := os.WriteFile(filename, []byte(b.String()), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return filename, sums
+}
+
+func indexTestProofs(tb testing.TB, filename string) *proofIndex {
+	if _, err := writeProofIndex(filename, filename+proofIndexSuffix); err != nil {
+		tb.Fatal(err)
+	}
+	ix, err := openProofIndex(filename)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return ix
+}
+
+func TestProofIndexLookup(t *testing.T) {
+	filename, sums := writeTestProofs(t, t.TempDir(), 100)
+	ix := indexTestProofs(t, filename)
+	defer ix.Close()
+
+	for i, sum := range sums {
+		p, line, ok, err := ix.lookup(sum)
+		if err != nil || !ok {
+			t.Fatalf("record %d: ok %v, %v", i, ok, err)
+		}
+		if p.ctSum != sum || p.pop != fmt.Sprintf("{\"pop\":%d}", i) || line != uint32(i+1) {
+			t.Fatalf("record %d: got %x %q on line %d", i, p.ctSum, p.pop, line)
+		}
+	}
+	if _, _, ok, err := ix.lookup(sha256.Sum256([]byte("absent"))); ok || err != nil {
+		t.Fatalf("absent record: ok %v, %v", ok, err)
+	}
+
+	// the index of a changed proofs file is refused
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n")
+	f.Close()
+	if _, err = openProofIndex(filename); err == nil || !strings.Contains(err.Error(), "changed since") {
+		t.Fatalf("stale index: %v, want it refused", err)
+	}
+}
+
+// BenchmarkProofIndexLookup looks up the proofs of every record of a dataset in the index,
+// against reading the whole proofs file with readProofs and joining them in memory
+func BenchmarkProofIndexLookup(b *testing.B) {
+	const n = 1 << 14
+	filename, sums := writeTestProofs(b, b.TempDir(), n)
+	ctDB := make(map[[32]byte][]byte, n)
+	for _, sum := range sums {
+		ctDB[sum] = nil
+	}
+
+	b.Run("index", func(b *testing.B) {
+		ix := indexTestProofs(b, filename)
+		defer ix.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := readIndexedRecords(ctDB, ix); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("readProofs", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			proofs, err := readProofs(filename)
+			if err != nil {
+				b.Fatal(err)
+			}
+			joinRecords(ctDB, proofs)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+)
+
+// maxRTHSourceBody bounds the signed RTH fetched from a URL source
+const maxRTHSourceBody = 1 << 20
+
+// rthSource is a source of the RTH other than the serving enclave: a monitor or transparency feed
+type rthSource struct {
+	spec string
+	rth  *pb.RootTreeHash
+	err  error // why the source is not counted
+}
+
+// rthSourceFlag collects the -rth-source specs
+type rthSourceFlag []*rthSource
+
+func (f *rthSourceFlag) String() string {
+	var specs []string
+	for _, s := range *f {
+		specs = append(specs, s.spec)
+	}
+	return strings.Join(specs, " ")
+}
+
+func (f *rthSourceFlag) Set(spec string) error {
+	if !strings.HasPrefix(spec, "file:") && !strings.HasPrefix(spec, "hex:") &&
+		!strings.HasPrefix(spec, "http://") && !strings.HasPrefix(spec, "https://") {
+		return errors.New("expected file:<signed RTH>, hex:<RTH> or an http(s) URL")
+	}
+	*f = append(*f, &rthSource{spec: spec})
+	return nil
+}
+
+// fetch reads the RTH of the source. A file or URL holds a signed GetRootTreeHash response in
+// JSON, as for -rth-sig, whose signature is checked with the key. A hex RTH is unsigned.
+func (s *rthSource) fetch(key *rsa.PublicKey) (*pb.RootTreeHash, error) {
+	if strings.HasPrefix(s.spec, "hex:") {
+		b, err := hex.DecodeString(strings.TrimPrefix(s.spec, "hex:"))
+		if err != nil || len(b) != sha256.Size {
+			return nil, errors.New("not a hex encoded RTH")
+		}
+		return &pb.RootTreeHash{Rth: b}, nil
+	}
+
+	var buf []byte
+	var err error
+	if strings.HasPrefix(s.spec, "file:") {
+		buf, err = ioutil.ReadFile(strings.TrimPrefix(s.spec, "file:"))
+	} else {
+		buf, err = fetchURL(s.spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rth := new(pb.RootTreeHash)
+	if err = json.Unmarshal(buf, rth); err != nil {
+		return nil, err
+	}
+	if len(rth.Rth) != sha256.Size {
+		return nil, fmt.Errorf("RTH is %d bytes, want %d", len(rth.Rth), sha256.Size)
+	}
+	if key == nil {
+		return nil, errors.New("no verification key to check the signature with")
+	}
+	if err = verifyRTHSig(key, rth); err != nil {
+		return nil, fmt.Errorf("signature does not verify: %v", err)
+	}
+	return rth, nil
+}
+
+func fetchURL(url string) ([]byte, error) {
+	hc := &http.Client{Timeout: 10 * time.Second}
+	resp, err := hc.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxRTHSourceBody))
+}
+
+// agreeRTH compares the RTH of the serving enclave with the RTHs of the sources and returns the
+// RTH at least quorum of them agree on, the enclave counting as a source. A source holding an
+// earlier RTH of the enclave's verified history (with -rth-history) is behind but consistent,
+// and counts for the enclave's RTH. Every source that disagrees or fails is reported.
+func agreeRTH(server *pb.RootTreeHash, key *rsa.PublicKey, history [][]byte, sources []*rthSource, quorum int) (*pb.RootTreeHash, error) {
+	if err := verifyRTHSig(key, server); err != nil {
+		return nil, fmt.Errorf("signed RTH of the server does not verify: %v", err)
+	}
+	all := append([]*rthSource{{spec: "server", rth: server}}, sources...)
+	for _, s := range sources {
+		s.rth, s.err = s.fetch(key)
+	}
+
+	// count the sources of every RTH, in the order they are first seen
+	var candidates []*pb.RootTreeHash
+	support := make(map[string]int)
+	for _, s := range all {
+		if s.err != nil {
+			continue
+		}
+		k := string(s.rth.Rth)
+		if support[k] == 0 {
+			candidates = append(candidates, s.rth)
+		}
+		support[k]++
+	}
+	behind := make(map[*rthSource]bool)
+	for _, s := range all {
+		if s.err == nil && !bytes.Equal(s.rth.Rth, server.Rth) && inHistory(history, s.rth.Rth) {
+			behind[s] = true
+			support[string(server.Rth)]++
+		}
+	}
+
+	agreed := candidates[0]
+	for _, c := range candidates[1:] {
+		if support[string(c.Rth)] > support[string(agreed.Rth)] {
+			agreed = c
+		}
+	}
+
+	for _, s := range all {
+		switch {
+		case s.err != nil:
+			log.Printf("RTH source %s not counted: %v", s.spec, s.err)
+		case behind[s]:
+			log.Printf("RTH source %s is behind: RTH %s (tree size %d) is in the server's history", s.spec, hex.EncodeToString(s.rth.Rth), s.rth.TreeSize)
+		case !bytes.Equal(s.rth.Rth, agreed.Rth):
+			log.Printf("RTH source %s diverges: RTH %s, tree size %d, timestamp %d", s.spec, hex.EncodeToString(s.rth.Rth), s.rth.TreeSize, s.rth.Timestamp)
+		}
+	}
+
+	if n := support[string(agreed.Rth)]; n < quorum {
+		return nil, fmt.Errorf("%d of %d RTH sources agree, -rth-quorum is %d", n, len(all), quorum)
+	}
+	return agreed, nil
+}
+
+func inHistory(history [][]byte, rth []byte) bool {
+	for _, h := range history {
+		if bytes.Equal(h, rth) {
+			return true
+		}
+	}
+	return false
+}
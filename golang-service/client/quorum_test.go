@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	"github.com/sewelol/sgx-decryption-service/rthsig"
+)
+
+// signedRTH returns the RTH signed by key in the canonical format
+func signedRTH(t *testing.T, key *rsa.PrivateKey, rth []byte, treeSize uint64) *pb.RootTreeHash {
+	t.Helper()
+	r := &pb.RootTreeHash{Rth: rth, Nonce: []byte("nonce"), TreeSize: treeSize, Timestamp: 1500000000, Version: rthsig.Canonical}
+	h := rthsig.Digest(rthsig.Canonical, r.Rth, r.Nonce, r.TreeSize, r.Timestamp)
+	var err error
+	if r.Sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:]); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// fileSource writes the signed RTH as JSON and returns the file: spec of it
+func fileSource(t *testing.T, rth *pb.RootTreeHash) string {
+	t.Helper()
+	buf, err := json.Marshal(rth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "file:" + writeTestFile(t, "rth.json", string(buf))
+}
+
+func TestAgreeRTH(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r1, r2 := sha256.Sum256([]byte("rth 1")), sha256.Sum256([]byte("rth 2"))
+	hex1, hex2 := "hex:"+hex.EncodeToString(r1[:]), "hex:"+hex.EncodeToString(r2[:])
+
+	fed := signedRTH(t, key, r2[:], 2)
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(fed)
+	}))
+	defer feed.Close()
+
+	tests := []struct {
+		name    string
+		server  *pb.RootTreeHash
+		history [][]byte
+		sources []string
+		quorum  int
+		want    []byte // agreed RTH, nil when the quorum is not met
+		failed  []int  // sources whose fetch fails
+	}{
+		{
+			name:    "unanimous",
+			server:  signedRTH(t, key, r2[:], 2),
+			sources: []string{fileSource(t, signedRTH(t, key, r2[:], 2)), hex2, feed.URL},
+			quorum:  4,
+			want:    r2[:],
+		},
+		{
+			name:    "behind but in the history",
+			server:  signedRTH(t, key, r2[:], 2),
+			history: [][]byte{r1[:], r2[:]},
+			sources: []string{hex1},
+			quorum:  2,
+			want:    r2[:],
+		},
+		{
+			name:    "behind without the history",
+			server:  signedRTH(t, key, r2[:], 2),
+			sources: []string{hex1},
+			quorum:  2,
+		},
+		{
+			name:    "diverging source outvoted",
+			server:  signedRTH(t, key, r2[:], 2),
+			sources: []string{hex1, hex2},
+			quorum:  2,
+			want:    r2[:],
+		},
+		{
+			name:    "diverging majority",
+			server:  signedRTH(t, key, r2[:], 2),
+			sources: []string{hex1, fileSource(t, signedRTH(t, key, r1[:], 1))},
+			quorum:  2,
+			want:    r1[:],
+		},
+		{
+			name:    "failed fetches",
+			server:  signedRTH(t, key, r2[:], 2),
+			sources: []string{"file:" + filepath.Join(t.TempDir(), "missing"), fileSource(t, signedRTH(t, other, r2[:], 2)), "hex:00", hex2},
+			quorum:  2,
+			want:    r2[:],
+			failed:  []int{0, 1, 2},
+		},
+		{
+			name:    "quorum not met",
+			server:  signedRTH(t, key, r2[:], 2),
+			sources: []string{fileSource(t, signedRTH(t, other, r2[:], 2)), hex2},
+			quorum:  3,
+			failed:  []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sources rthSourceFlag
+			for _, spec := range tt.sources {
+				if err := sources.Set(spec); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			agreed, err := agreeRTH(tt.server, &key.PublicKey, tt.history, sources, tt.quorum)
+			switch {
+			case tt.want == nil && err == nil:
+				t.Errorf("RTH %x agreed, want the quorum not met", agreed.Rth)
+			case tt.want != nil && err != nil:
+				t.Errorf("quorum not met: %v", err)
+			case tt.want != nil && !bytes.Equal(agreed.Rth, tt.want):
+				t.Errorf("RTH %x agreed, want %x", agreed.Rth, tt.want)
+			}
+
+			failed := make(map[int]bool)
+			for _, i := range tt.failed {
+				failed[i] = true
+			}
+			for i, s := range sources {
+				if (s.err != nil) != failed[i] {
+					t.Errorf("source %s: error %v, want error %v", s.spec, s.err, failed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAgreeRTHServerSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := sha256.Sum256([]byte("rth"))
+
+	var sources rthSourceFlag
+	sources.Set("hex:" + hex.EncodeToString(r[:]))
+	if _, err := agreeRTH(signedRTH(t, other, r[:], 1), &key.PublicKey, nil, sources, 2); err == nil {
+		t.Error("RTH of the server signed by another key accepted")
+	}
+}
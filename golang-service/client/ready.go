@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	att "github.com/sewelol/sgx-decryption-service/attestation"
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	"github.com/sewelol/sgx-decryption-service/proofcodec"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// Exit codes of the ready subcommand, one per step of the pipeline
+const (
+	exitNotConnected = 10 // the server could not be reached
+	exitAttestation  = 11 // the quote or the device keys were rejected
+	exitRTH          = 12 // the signed RTH could not be fetched or verified
+	exitCanary       = 13 // the canary record could not be decrypted
+)
+
+// ready implements the ready subcommand: it runs the pipeline once end to end, connection,
+// attestation, RTH verification and the decryption of a canary record, and exits with the
+// code of the first step that fails. It takes the flags of the main command as well, so a
+// probe checks the enclave identity and the RTH the same way the client does.
+func ready(args []string) {
+	fs := flag.NewFlagSet("ready", flag.ExitOnError)
+	canaryFile := fs.String("canary", "", "file with the canary record as an ndjson line (see -format ndjson), required")
+	canarySum := fs.String("canary-sha256", "", "hex encoded sha256 the canary plaintext must have")
+	timeout := fs.Duration("timeout", 10*time.Second, "deadline of every step")
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s ready [flags]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Exits with 0 when the pipeline works, or with the code of the failed step:\n")
+		fmt.Fprintf(os.Stderr, "%d connection, %d attestation, %d RTH verification, %d canary decryption.\n", exitNotConnected, exitAttestation, exitRTH, exitCanary)
+		fmt.Fprintf(os.Stderr, "A canary whose proof of extension moves the RTH advances the device, repeated probes\n")
+		fmt.Fprintf(os.Stderr, "need a canary proved against the current RTH with an extension that appends nothing.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *canaryFile == "" {
+		// a dataset record would move the device's RTH on every probe, the next real run would not start from it
+		fmt.Fprintf(os.Stderr, "ready needs -canary\n")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// step exits with the code of the step if it failed
+	step := func(code int, name string, err error) {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "not ready: %s: %v\n", name, err)
+			os.Exit(code)
+		}
+		log.Printf("ok   %s", name)
+	}
+
+	var want []byte
+	if *canarySum != "" {
+		var err error
+		if want, err = hex.DecodeString(*canarySum); err != nil || len(want) != sha256.Size {
+			log.Fatalf("invalid -canary-sha256 %q", *canarySum)
+		}
+	}
+	if *nonceLen < minNonceLen {
+		log.Fatalf("invalid -nonce-len %d, nonces must be at least %d bytes", *nonceLen, minNonceLen)
+	}
+	verifier := newVerifier()
+	codec, err := proofcodec.ByName(*proofEncoding)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	transport, err := transportOption()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	id := clientIdentifier()
+	conn, err := grpc.DialContext(ctx, address, transport, grpc.WithBlock(), grpc.WithUserAgent(id+" ready"), grpc.WithUnaryInterceptor(withClientID(id)))
+	cancel()
+	step(exitNotConnected, "connection", err)
+	defer conn.Close()
+	c := pb.NewDecryptionDeviceClient(conn)
+
+	encKey, verKey, err := readyAttestation(c, verifier, *timeout)
+	step(exitAttestation, "attestation", err)
+
+	_, err = readyRTH(c, verKey, *timeout)
+	step(exitRTH, "RTH verification", err)
+
+	client := dc.New(c)
+	client.ProofCodec = codec
+	client.MaxPlaintext = dc.MaxPlaintextLen(encKey, dc.OAEP)
+	step(exitCanary, "canary decryption", readyCanary(client, *canaryFile, want, *timeout))
+
+	fmt.Println("ready")
+}
+
+// readyAttestation fetches the device keys, checks the enclave identity and the binding of the
+// verification key in the quote, when the identity is checked, and returns the keys
+func readyAttestation(c pb.DecryptionDeviceClient, verifier *att.Verifier, timeout time.Duration) (encKey, verKey *rsa.PublicKey, err error) {
+	nonce, err := newNonce("GetPublicKey")
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	pk, err := c.GetPublicKey(ctx, &pb.PublicKeyRequest{Nonce: nonce})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if encKey, _, err = parseRSAKey(pk.RSA_EncryptionKey); err != nil {
+		return nil, nil, fmt.Errorf("encryption key: %v", err)
+	}
+	verKey, verDER, err := parseRSAKey(pk.RSA_VerificationKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("verification key: %v", err)
+	}
+
+	if verifier.Enabled() {
+		report, err := att.ParseQuote(pk.Quote)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = verifier.Verify(report); err != nil {
+			return nil, nil, err
+		}
+		if err = att.VerifyKeyBinding(report, verDER); err != nil {
+			return nil, nil, err
+		}
+	}
+	return encKey, verKey, nil
+}
+
+// readyRTH fetches the signed RTH and verifies its nonce and signature
+func readyRTH(c pb.DecryptionDeviceClient, verKey *rsa.PublicKey, timeout time.Duration) (*pb.RootTreeHash, error) {
+	nonce, err := newNonce("GetRootTreeHash")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	rth, err := c.GetRootTreeHash(ctx, &pb.RootTreeHashRequest{Nonce: nonce, Version: uint32(*rthSigVersion)})
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(rth.Nonce, nonce) {
+		return nil, errors.New("server echoed another nonce")
+	}
+	if err = verifyRTHSig(verKey, rth); err != nil {
+		return nil, err
+	}
+	return rth, nil
+}
+
+// readyCanary decrypts the canary record, and checks the plaintext hash if one is expected
+func readyCanary(client *dc.Client, filename string, want []byte, timeout time.Duration) error {
+	line, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	canary, err := parseNDJSONRecord(bytes.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	plaintext, err := client.Decrypt(ctx, canary)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(plaintext); want != nil && !bytes.Equal(sum[:], want) {
+		return fmt.Errorf("plaintext hash %x, want %x", sum, want)
+	}
+	return nil
+}
+
+// parseRSAKey decodes a PEM encoded RSA public key, and returns it with its DER encoding
+func parseRSAKey(pemKey []byte) (*rsa.PublicKey, []byte, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, nil, errors.New("no PEM block")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, nil, errors.New("not an RSA public key")
+	}
+	if err = checkExponent(key); err != nil {
+		return nil, nil, err
+	}
+	return key, block.Bytes, nil
+}
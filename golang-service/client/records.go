@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+)
+
+// proof holds the proofs listed for one record in the proofs file
+type proof struct {
+	ctSum [32]byte // sha256 of the ciphertext the proofs are for
+	pop   string   // JSON proof of presence
+	poe   string   // JSON proof of extension
+}
+
+// record is a ciphertext joined with its proofs
+type record struct {
+	ct []byte
+	proof
+}
+
+// readRecords reads the base64 encoded ciphertexts of a records file into a map keyed by their hash
+func readRecords(filename string) (map[[32]byte][]byte, error) {
+	file, err := openInput(filename, *maxFileSize)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ctDB := make(map[[32]byte][]byte)
+
+	// create a new scanner and read the file line by line
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.Split(scanner.Text(), ",")
+		if len(line) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected index,ciphertext", filename, n)
+		}
+		// Decode b64 ciphertext
+		ct, err := base64.StdEncoding.DecodeString(line[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, n, err)
+		}
+		// Calculate hash of ciphertext
+		ctDB[sha256.Sum256(ct)] = ct
+	}
+
+	return ctDB, scanner.Err()
+}
+
+// readProofs reads the proofs file, one "hash proofOfPresence proofOfExtension" line per record,
+// the fields separated as set by -proof-delimiter. Blank lines are skipped.
+func readProofs(filename string) ([]proof, error) {
+	file, err := openInput(filename, *maxFileSize)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var proofs []proof
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		p, err := parseProofLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, n, err)
+		}
+		proofs = append(proofs, p)
+	}
+
+	return proofs, scanner.Err()
+}
+
+// parseProofLine parses a line of the proofs file
+func parseProofLine(text string) (proof, error) {
+	line := splitProofLine(text)
+	if len(line) != 3 {
+		return proof{}, fmt.Errorf("expected hash, proof of presence and proof of extension, got %d fields", len(line))
+	}
+	for i, f := range line {
+		if f == "" {
+			return proof{}, fmt.Errorf("field %d is empty", i+1)
+		}
+	}
+
+	ctSumSlice, err := hex.DecodeString(line[0])
+	if err != nil || len(ctSumSlice) != sha256.Size {
+		return proof{}, fmt.Errorf("invalid ciphertext hash %q", line[0])
+	}
+
+	p := proof{pop: line[1], poe: line[2]}
+	copy(p.ctSum[:], ctSumSlice)
+	return p, nil
+}
+
+// splitProofLine splits a line of the proofs file into its trimmed fields: at runs of
+// whitespace by default, or at every -proof-delimiter
+func splitProofLine(line string) []string {
+	delim := *proofDelimiter
+	switch delim {
+	case "", "whitespace":
+		return strings.Fields(line)
+	case "tab":
+		delim = "\t"
+	case "space":
+		delim = " "
+	}
+
+	fields := strings.Split(strings.TrimSpace(line), delim)
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+// joinRecords joins ciphertexts and proofs by ciphertext hash, in proofs file order.
+// Proofs without a ciphertext and ciphertexts without proofs are returned as orphans,
+// the orphan ciphertexts sorted by hash.
+func joinRecords(ctDB map[[32]byte][]byte, proofs []proof) (records []record, orphanProofs []proof, orphanRecords [][32]byte) {
+	joined := make(map[[32]byte]bool)
+
+	for _, p := range proofs {
+		ct, ok := ctDB[p.ctSum]
+		if !ok {
+			orphanProofs = append(orphanProofs, p)
+			continue
+		}
+		records = append(records, record{ct: ct, proof: p})
+		joined[p.ctSum] = true
+	}
+
+	for ctSum := range ctDB {
+		if !joined[ctSum] {
+			orphanRecords = append(orphanRecords, ctSum)
+		}
+	}
+	sortSums(orphanRecords)
+
+	return
+}
+
+// sortSums sorts hashes in byte order
+func sortSums(s [][32]byte) {
+	sort.Slice(s, func(i, j int) bool { return bytes.Compare(s[i][:], s[j][:]) < 0 })
+}
+
+// readCTProofs reads RFC 6962 inclusion proofs, one "hash {get-proof-by-hash JSON}" line per record
+func readCTProofs(filename string) (map[[32]byte]pt.CTInclusionProof, error) {
+	file, err := openInput(filename, *maxFileSize)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ctProofs := make(map[[32]byte]pt.CTInclusionProof)
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.SplitN(scanner.Text(), " ", 2)
+		if len(line) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected hash and inclusion proof", filename, n)
+		}
+
+		var ctSum [32]byte
+		ctSumSlice, err := hex.DecodeString(line[0])
+		if err != nil || len(ctSumSlice) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid ciphertext hash %q", filename, n, line[0])
+		}
+		copy(ctSum[:], ctSumSlice)
+
+		var p pt.CTInclusionProof
+		if err = json.Unmarshal([]byte(line[1]), &p); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, n, err)
+		}
+		ctProofs[ctSum] = p
+	}
+
+	return ctProofs, scanner.Err()
+}
+
+// readExpected reads the expected plaintexts, one "hash plaintext" line per record, and returns
+// the sha256 of the expected plaintext by ciphertext hash. The plaintext is base64 encoded,
+// or given by its hash as "sha256:<hex>" so the file need not hold plaintexts.
+func readExpected(filename string) (map[[32]byte][32]byte, error) {
+	file, err := openInput(filename, *maxFileSize)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	expected := make(map[[32]byte][32]byte)
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.Fields(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected hash and plaintext", filename, n)
+		}
+
+		var ctSum [32]byte
+		ctSumSlice, err := hex.DecodeString(line[0])
+		if err != nil || len(ctSumSlice) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid ciphertext hash %q", filename, n, line[0])
+		}
+		copy(ctSum[:], ctSumSlice)
+
+		var sum [32]byte
+		if strings.HasPrefix(line[1], "sha256:") {
+			b, err := hex.DecodeString(strings.TrimPrefix(line[1], "sha256:"))
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("%s:%d: invalid plaintext hash %q", filename, n, line[1])
+			}
+			copy(sum[:], b)
+		} else {
+			plaintext, err := base64.StdEncoding.DecodeString(line[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", filename, n, err)
+			}
+			sum = sha256.Sum256(plaintext)
+		}
+		expected[ctSum] = sum
+	}
+
+	return expected, scanner.Err()
+}
+
+// readKeymap reads the external IDs of records, one "id hash" line per record, and returns the
+// ciphertext hash by ID. Blank lines and lines starting with '#' are skipped. IDs and hashes
+// must both be unique: of two IDs of one record, only one could name its output.
+func readKeymap(filename string) (map[string][32]byte, error) {
+	file, err := openInput(filename, *maxFileSize)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keymap := make(map[string][32]byte)
+	ids := make(map[[32]byte]string) // id of every hash, one record is decrypted under one id
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.Fields(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line[0], "#") {
+			continue
+		}
+		if len(line) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected id and ciphertext hash", filename, n)
+		}
+
+		ctSumSlice, err := hex.DecodeString(line[1])
+		if err != nil || len(ctSumSlice) != sha256.Size {
+			return nil, fmt.Errorf("%s:%d: invalid ciphertext hash %q", filename, n, line[1])
+		}
+		if _, ok := keymap[line[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate id %q", filename, n, line[0])
+		}
+		var ctSum [32]byte
+		copy(ctSum[:], ctSumSlice)
+		if id, ok := ids[ctSum]; ok {
+			return nil, fmt.Errorf("%s:%d: id %q maps to the ciphertext hash of id %q", filename, n, line[0], id)
+		}
+		keymap[line[0]] = ctSum
+		ids[ctSum] = line[0]
+	}
+
+	return keymap, scanner.Err()
+}
+
+// resolveIDs looks up the requested IDs, all IDs of the keymap when none are requested, and returns
+// the ID of every selected ciphertext hash. IDs missing from the keymap, or mapped to a hash
+// without a record, are returned as unresolved.
+func resolveIDs(keymap map[string][32]byte, ids []string, records []record) (selected map[[32]byte]string, unresolved []string) {
+	if len(ids) == 0 {
+		for id := range keymap {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+
+	known := make(map[[32]byte]bool, len(records))
+	for _, r := range records {
+		known[r.ctSum] = true
+	}
+
+	selected = make(map[[32]byte]string)
+	for _, id := range ids {
+		ctSum, ok := keymap[id]
+		if !ok || !known[ctSum] {
+			unresolved = append(unresolved, id)
+			continue
+		}
+		// the keymap has one id per hash, a hash is selected twice only by an id requested twice
+		selected[ctSum] = id
+	}
+	return selected, unresolved
+}
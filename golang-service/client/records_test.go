@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testCiphertext(name string) ([]byte, [32]byte) {
+	ct := []byte("ciphertext " + name)
+	return ct, sha256.Sum256(ct)
+}
+
+func testProof(ctSum [32]byte, name string) proof {
+	return proof{ctSum: ctSum, pop: `{"pop":"` + name + `"}`, poe: `{"poe":"` + name + `"}`}
+}
+
+// writeTestFile writes the content to a file of the test's temporary directory
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestJoinRecords(t *testing.T) {
+	ctA, a := testCiphertext("a")
+	ctB, b := testCiphertext("b")
+	ctC, c := testCiphertext("c")
+	_, d := testCiphertext("d")
+
+	tests := []struct {
+		name          string
+		records       map[[32]byte][]byte
+		proofs        []proof
+		want          [][32]byte // joined records, in proofs file order
+		orphanProofs  [][32]byte
+		orphanRecords [][32]byte
+	}{
+		{
+			name:    "same records, shuffled",
+			records: map[[32]byte][]byte{a: ctA, b: ctB, c: ctC},
+			proofs:  []proof{testProof(c, "c"), testProof(a, "a"), testProof(b, "b")},
+			want:    [][32]byte{c, a, b},
+		},
+		{
+			name:          "overlapping",
+			records:       map[[32]byte][]byte{a: ctA, b: ctB},
+			proofs:        []proof{testProof(b, "b"), testProof(d, "d")},
+			want:          [][32]byte{b},
+			orphanProofs:  [][32]byte{d},
+			orphanRecords: [][32]byte{a},
+		},
+		{
+			name:          "only orphan records",
+			records:       map[[32]byte][]byte{a: ctA, c: ctC},
+			orphanRecords: [][32]byte{a, c},
+		},
+		{
+			name:         "only orphan proofs",
+			records:      map[[32]byte][]byte{},
+			proofs:       []proof{testProof(d, "d"), testProof(a, "a")},
+			orphanProofs: [][32]byte{d, a},
+		},
+		{
+			name:    "empty",
+			records: map[[32]byte][]byte{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, orphanProofs, orphanRecords := joinRecords(tt.records, tt.proofs)
+
+			var got [][32]byte
+			for _, r := range records {
+				if !bytes.Equal(r.ct, tt.records[r.ctSum]) {
+					t.Errorf("record %x joined with another ciphertext", r.ctSum)
+				}
+				got = append(got, r.ctSum)
+			}
+			if !equalSums(got, tt.want) {
+				t.Errorf("records %x, want %x", got, tt.want)
+			}
+
+			var gotProofs [][32]byte
+			for _, p := range orphanProofs {
+				gotProofs = append(gotProofs, p.ctSum)
+			}
+			if !equalSums(gotProofs, tt.orphanProofs) {
+				t.Errorf("orphan proofs %x, want %x", gotProofs, tt.orphanProofs)
+			}
+
+			want := append([][32]byte(nil), tt.orphanRecords...)
+			sortSums(want)
+			if !equalSums(orphanRecords, want) {
+				t.Errorf("orphan records %x, want %x", orphanRecords, want)
+			}
+		})
+	}
+}
+
+func TestParseProofLine(t *testing.T) {
+	_, sum := testCiphertext("a")
+	hash := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		delimiter string
+		line      string
+		wantErr   string
+	}{
+		{name: "spaces", line: hash + " {pop} {poe}"},
+		{name: "tabs and runs of spaces", line: hash + "\t {pop}   {poe}\n"},
+		{name: "tab delimiter", delimiter: "tab", line: hash + "\t{pop}\t{poe}"},
+		{name: "literal delimiter", delimiter: "|", line: hash + " | {pop} | {poe}"},
+		{name: "two fields", line: hash + " {pop}", wantErr: "got 2 fields"},
+		{name: "four fields", line: hash + " {pop} {poe} {x}", wantErr: "got 4 fields"},
+		{name: "empty field", delimiter: "tab", line: hash + "\t\t{poe}", wantErr: "field 2 is empty"},
+		{name: "short hash", line: hash[:62] + " {pop} {poe}", wantErr: "invalid ciphertext hash"},
+		{name: "not hex", line: strings.Repeat("zz", 32) + " {pop} {poe}", wantErr: "invalid ciphertext hash"},
+	}
+
+	defer func(d string) { *proofDelimiter = d }(*proofDelimiter)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*proofDelimiter = tt.delimiter
+			p, err := parseProofLine(tt.line)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.ctSum != sum || p.pop != "{pop}" || p.poe != "{poe}" {
+				t.Errorf("parsed %x %q %q", p.ctSum, p.pop, p.poe)
+			}
+		})
+	}
+}
+
+func TestReadProofs(t *testing.T) {
+	_, a := testCiphertext("a")
+	_, b := testCiphertext("b")
+	lineA := hex.EncodeToString(a[:]) + " {popA} {poeA}\n"
+	lineB := hex.EncodeToString(b[:]) + " {popB} {poeB}\n"
+
+	tests := []struct {
+		name    string
+		content string
+		want    [][32]byte
+		wantErr string
+	}{
+		{name: "in file order", content: lineB + lineA, want: [][32]byte{b, a}},
+		{name: "blank lines skipped", content: "\n" + lineA + "  \n" + lineB, want: [][32]byte{a, b}},
+		{name: "no final newline", content: lineA + strings.TrimSuffix(lineB, "\n"), want: [][32]byte{a, b}},
+		{name: "empty file", content: ""},
+		{name: "bad line numbered", content: lineA + "\n" + "nothex {pop} {poe}\n", wantErr: "proofs.csv:3: invalid ciphertext hash"},
+	}
+
+	defer func(d string) { *proofDelimiter = d }(*proofDelimiter)
+	*proofDelimiter = "whitespace"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proofs, err := readProofs(writeTestFile(t, "proofs.csv", tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got [][32]byte
+			for _, p := range proofs {
+				got = append(got, p.ctSum)
+			}
+			if !equalSums(got, tt.want) {
+				t.Errorf("proofs %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func equalSums(a, b [][32]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReadKeymap(t *testing.T) {
+	_, a := testCiphertext("a")
+	_, b := testCiphertext("b")
+	hexA, hexB := hex.EncodeToString(a[:]), hex.EncodeToString(b[:])
+
+	tests := []struct {
+		name    string
+		content string
+		want    map[string][32]byte
+		wantErr string
+	}{
+		{name: "ids", content: "# id hash\norder-1 " + hexA + "\n\norder-2 " + hexB + "\n", want: map[string][32]byte{"order-1": a, "order-2": b}},
+		{name: "duplicate id", content: "order-1 " + hexA + "\norder-1 " + hexB + "\n", wantErr: "keymap:2: duplicate id"},
+		{name: "duplicate hash", content: "order-1 " + hexA + "\norder-2 " + hexA + "\n", wantErr: `keymap:2: id "order-2" maps to the ciphertext hash of id "order-1"`},
+		{name: "bad hash", content: "order-1 " + hexA[:10] + "\n", wantErr: "invalid ciphertext hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keymap, err := readKeymap(writeTestFile(t, "keymap", tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keymap) != len(tt.want) {
+				t.Fatalf("keymap %v, want %v", keymap, tt.want)
+			}
+			for id, sum := range tt.want {
+				if keymap[id] != sum {
+					t.Errorf("id %s maps to %x, want %x", id, keymap[id], sum)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// schemaRule is one check of -plaintext-schema
+type schemaRule struct {
+	spec  string
+	check func(plaintext []byte) error
+}
+
+// plaintextSchema collects the -plaintext-schema rules, a plaintext must pass all of them.
+// A wrong key or a corrupted record yields a plaintext that decrypts but is garbage, the
+// rules catch the ones whose format is known.
+type plaintextSchema []schemaRule
+
+func (s *plaintextSchema) String() string {
+	var specs []string
+	for _, r := range *s {
+		specs = append(specs, r.spec)
+	}
+	return strings.Join(specs, " ")
+}
+
+func (s *plaintextSchema) Set(spec string) error {
+	r, err := parseSchemaRule(spec)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, r)
+	return nil
+}
+
+// parseSchemaRule parses a rule: len=<n> or len=<min>-<max>, magic=<hex prefix>,
+// regex=<RE2 expression the whole plaintext must match>, utf8 or json
+func parseSchemaRule(spec string) (schemaRule, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	r := schemaRule{spec: spec}
+
+	switch kind {
+	case "len":
+		min, max, err := parseLengthRange(arg)
+		if err != nil {
+			return r, err
+		}
+		r.check = func(p []byte) error {
+			if len(p) < min || len(p) > max {
+				return fmt.Errorf("plaintext is %d bytes, want %s", len(p), arg)
+			}
+			return nil
+		}
+	case "magic":
+		magic, err := hex.DecodeString(arg)
+		if err != nil || len(magic) == 0 {
+			return r, fmt.Errorf("invalid magic %q, want hex encoded bytes", arg)
+		}
+		r.check = func(p []byte) error {
+			if !bytes.HasPrefix(p, magic) {
+				return fmt.Errorf("plaintext does not start with %s", arg)
+			}
+			return nil
+		}
+	case "regex":
+		if _, err := regexp.Compile(arg); err != nil {
+			return r, err
+		}
+		re := regexp.MustCompile(`^(?:` + arg + `)$`)
+		r.check = func(p []byte) error {
+			if !re.Match(p) {
+				return fmt.Errorf("plaintext does not match %s", arg)
+			}
+			return nil
+		}
+	case "utf8":
+		r.check = func(p []byte) error {
+			if !utf8.Valid(p) {
+				return errors.New("plaintext is not valid UTF-8")
+			}
+			return nil
+		}
+	case "json":
+		r.check = func(p []byte) error {
+			if !json.Valid(p) {
+				return errors.New("plaintext is not valid JSON")
+			}
+			return nil
+		}
+	default:
+		return r, errors.New("expected len=<n>, len=<min>-<max>, magic=<hex>, regex=<expression>, utf8 or json")
+	}
+	if (kind == "utf8" || kind == "json") && arg != "" {
+		return r, fmt.Errorf("%s takes no argument", kind)
+	}
+	return r, nil
+}
+
+func parseLengthRange(s string) (min, max int, err error) {
+	lo, hi := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+	if min, err = strconv.Atoi(lo); err == nil {
+		max, err = strconv.Atoi(hi)
+	}
+	if err != nil || min < 0 || max < min {
+		return 0, 0, fmt.Errorf("invalid length %q, want <n> or <min>-<max>", s)
+	}
+	return min, max, nil
+}
+
+// check returns why the plaintext does not conform to the schema, nil if it does
+func (s plaintextSchema) check(plaintext []byte) error {
+	for _, r := range s {
+		if err := r.check(plaintext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+//go:build seednonce
+// +build seednonce
+
+package main
+
+import (
+	"flag"
+	"log"
+	mrand "math/rand"
+	"strconv"
+	"sync"
+)
+
+// This file is only built with -tags seednonce, for tests of the nonce and challenge handling.
+// A production build has no -seed flag, so it cannot be given one by mistake.
+
+func init() {
+	flag.Var(new(seedFlag), "seed", "TEST BUILDS ONLY: draw the nonces and challenges from math/rand seeded with this value instead of crypto/rand, making them predictable")
+}
+
+// seedFlag replaces the nonce source with a seeded math/rand source when it is set
+type seedFlag struct {
+	seed string
+}
+
+func (f *seedFlag) String() string {
+	return f.seed
+}
+
+func (f *seedFlag) Set(s string) error {
+	seed, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	f.seed = s
+	nonceSource = &lockedReader{r: mrand.New(mrand.NewSource(seed))}
+	log.Printf("WARNING: nonces and challenges are drawn from math/rand with -seed %d, they are predictable, for tests only", seed)
+	return nil
+}
+
+// lockedReader serializes the reads of a math/rand source, which is not safe for concurrent use
+type lockedReader struct {
+	mu sync.Mutex
+	r  *mrand.Rand
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	dc "github.com/sewelol/sgx-decryption-service/decryptclient"
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+)
+
+// timingStats sums the internal timings the server returns, to tell whether decryptions are
+// bound by the proofs or by the RSA decryption
+type timingStats struct {
+	mu                      sync.Mutex
+	n                       int
+	decode, verify, decrypt time.Duration
+}
+
+// add is the Timings callback of the client, with -verbose it logs the timings of every record
+func (s *timingStats) add(r dc.Record, t *pb.Timings) {
+	decode, verify, decrypt := time.Duration(t.ProofDecode), time.Duration(t.ProofVerification), time.Duration(t.Decryption)
+	if *verbose {
+		ctSum := sha256.Sum256(r.Ciphertext)
+		log.Printf("timings of record %s: proof decode %s, proof verification %s, decryption %s", hex.EncodeToString(ctSum[:]), decode, verify, decrypt)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	s.decode += decode
+	s.verify += verify
+	s.decrypt += decrypt
+}
+
+// report logs the mean of every step and its share of the server's time
+func (s *timingStats) report() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.n == 0 {
+		log.Printf("server returned no timings, is it running with -debug-timings?")
+		return
+	}
+
+	total := s.decode + s.verify + s.decrypt
+	share := func(d time.Duration) float64 {
+		if total == 0 {
+			return 0
+		}
+		return 100 * float64(d) / float64(total)
+	}
+	n := time.Duration(s.n)
+	log.Printf("server timings over %d decryptions, mean: proof decode %s (%.0f%%), proof verification %s (%.0f%%), decryption %s (%.0f%%)",
+		s.n, s.decode/n, share(s.decode), s.verify/n, share(s.verify), s.decrypt/n, share(s.decrypt))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// tlsFlags are the flags of the connection, registered by the subcommands that dial the server too
+var tlsFlags = []string{"tls", "tls-ca", "tls-server-name", "tls-min-version", "tls-cipher-suites"}
+
+// addTLSFlags registers the TLS flags of the main command in the flag set of a subcommand
+func addTLSFlags(fs *flag.FlagSet) {
+	for _, name := range tlsFlags {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+// transportOption returns the dial option securing the connection: plaintext, or TLS as set by the -tls flags
+func transportOption() (grpc.DialOption, error) {
+	if !*useTLS {
+		return grpc.WithInsecure(), nil
+	}
+	config, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+// tlsConfig builds the client TLS config. The handshake fails below the minimum version, and
+// the negotiated version and cipher suite are checked again once it completes: crypto/tls does not
+// let the TLS 1.3 suites be restricted, so a pinned 1.3 suite is only enforced by that check.
+func tlsConfig() (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := parseCipherSuites(*tlsCipherSuites, minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{MinVersion: minVersion, ServerName: *tlsServerName}
+	for _, cs := range suites {
+		if cs.SupportedVersions[0] < tls.VersionTLS13 {
+			config.CipherSuites = append(config.CipherSuites, cs.ID)
+		}
+	}
+	if *tlsCA != "" {
+		buf, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("%s: no PEM certificate", *tlsCA)
+		}
+	}
+
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		if cs.Version < minVersion {
+			return fmt.Errorf("server negotiated %s, -tls-min-version is %s", tls.VersionName(cs.Version), tls.VersionName(minVersion))
+		}
+		if suites == nil {
+			return nil
+		}
+		for _, suite := range suites {
+			if suite.ID == cs.CipherSuite {
+				return nil
+			}
+		}
+		return fmt.Errorf("server negotiated cipher suite %s, not one of -tls-cipher-suites", tls.CipherSuiteName(cs.CipherSuite))
+	}
+	return config, nil
+}
+
+// parseTLSVersion parses a TLS version, only 1.2 and later are accepted
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("invalid -tls-min-version %q, want 1.2 or 1.3", s)
+}
+
+// parseCipherSuites parses a comma separated list of secure cipher suite names, requiring one
+// usable at the minimum version or above. Returns nil for an empty list.
+func parseCipherSuites(s string, minVersion uint16) ([]*tls.CipherSuite, error) {
+	if s == "" {
+		return nil, nil
+	}
+	known := make(map[string]*tls.CipherSuite)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs
+	}
+
+	var suites []*tls.CipherSuite
+	usable := false
+	for _, name := range strings.Split(s, ",") {
+		cs, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		for _, v := range cs.SupportedVersions {
+			if v >= minVersion {
+				usable = true
+			}
+		}
+		suites = append(suites, cs)
+	}
+	if !usable {
+		return nil, errors.New("none of -tls-cipher-suites can be negotiated at -tls-min-version")
+	}
+	return suites, nil
+}
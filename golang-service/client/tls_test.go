@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testServerCert returns a self-signed certificate for the server name "device", and its PEM encoding for -tls-ca
+func testServerCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "device"},
+		DNSNames:              []string{"device"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return cert, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// handshake runs a TLS handshake of the client config of the -tls flags with a server of at most
+// maxVersion and of the given TLS 1.2 suites, and returns the client's error and the negotiated version
+func handshake(t *testing.T, maxVersion uint16, serverSuites []uint16, minVersion, cipherSuites string) (uint16, error) {
+	t.Helper()
+	cert, ca := testServerCert(t)
+
+	defer func(v, cs, file, name string) {
+		*tlsMinVersion, *tlsCipherSuites, *tlsCA, *tlsServerName = v, cs, file, name
+	}(*tlsMinVersion, *tlsCipherSuites, *tlsCA, *tlsServerName)
+	*tlsMinVersion, *tlsCipherSuites, *tlsServerName = minVersion, cipherSuites, "device"
+	*tlsCA = writeTestFile(t, "ca.pem", ca)
+
+	config, err := tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go func() {
+		server := tls.Server(serverConn, &tls.Config{MaxVersion: maxVersion, CipherSuites: serverSuites, Certificates: []tls.Certificate{cert}})
+		server.Handshake()
+		server.Close()
+	}()
+	client := tls.Client(clientConn, config)
+	err = client.Handshake()
+	return client.ConnectionState().Version, err
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxVersion   uint16
+		serverSuites []uint16
+		minVersion   string
+		suites       string
+		wantErr      bool
+	}{
+		{name: "1.2-only server, 1.3 required", maxVersion: tls.VersionTLS12, minVersion: "1.3", wantErr: true},
+		{name: "1.2-only server, 1.2 allowed", maxVersion: tls.VersionTLS12, minVersion: "1.2"},
+		{name: "1.3 server, 1.3 required", maxVersion: tls.VersionTLS13, minVersion: "1.3"},
+		{name: "pinned 1.3 suites", maxVersion: tls.VersionTLS13, minVersion: "1.3", suites: "TLS_AES_128_GCM_SHA256,TLS_AES_256_GCM_SHA384,TLS_CHACHA20_POLY1305_SHA256"},
+		{name: "pinned 1.2 suite", maxVersion: tls.VersionTLS12, minVersion: "1.2", suites: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+		{
+			name:         "pinned 1.2 suite the server lacks",
+			maxVersion:   tls.VersionTLS12,
+			serverSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			minVersion:   "1.2",
+			suites:       "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			wantErr:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version, err := handshake(t, tt.maxVersion, tt.serverSuites, tt.minVersion, tt.suites)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("handshake succeeded with %s", tls.VersionName(version))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if min, _ := parseTLSVersion(tt.minVersion); version < min {
+				t.Fatalf("negotiated %s below -tls-min-version %s", tls.VersionName(version), tt.minVersion)
+			}
+		})
+	}
+}
+
+func TestTLSConfigRejectsFlags(t *testing.T) {
+	if _, err := parseTLSVersion("1.1"); err == nil {
+		t.Error("-tls-min-version 1.1 accepted")
+	}
+	if _, err := parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA", tls.VersionTLS12); err == nil {
+		t.Error("insecure cipher suite accepted")
+	}
+	if _, err := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", tls.VersionTLS13); err == nil {
+		t.Error("TLS 1.2 suite accepted with -tls-min-version 1.3")
+	}
+}
@@ -0,0 +1,93 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the expiry, flush and run time checks, so tests can replace
+// the wall clock with a Fake
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the wall clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Fake is a Clock that only moves when advanced
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []waiter
+	added   chan struct{} // closed and replaced whenever a waiter is added
+}
+
+// waiter is a pending After call
+type waiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewFake returns a Fake clock set to now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, added: make(chan struct{})}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel the current time is sent on once the clock was advanced by d
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.waiters = append(f.waiters, waiter{deadline: f.now.Add(d), c: c})
+	close(f.added)
+	f.added = make(chan struct{})
+	return c
+}
+
+// Advance moves the clock forward by d, firing the After channels whose time has come
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.now = f.now.Add(d)
+	waiters := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.deadline.After(f.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- f.now
+		}
+	}
+	f.waiters = waiters
+}
+
+// BlockUntil waits until n After calls are pending, so a test knows the code under test is
+// waiting on the clock before advancing it
+func (f *Fake) BlockUntil(n int) {
+	for {
+		f.mu.Lock()
+		pending, added := len(f.waiters), f.added
+		f.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		<-added
+	}
+}
@@ -0,0 +1,52 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	f := NewFake(start)
+
+	short, long := f.After(time.Second), f.After(time.Minute)
+	f.BlockUntil(2)
+
+	f.Advance(time.Second)
+	select {
+	case now := <-short:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Errorf("fired at %v, want %v", now, start.Add(time.Second))
+		}
+	default:
+		t.Fatal("After(1s) did not fire after advancing 1s")
+	}
+	select {
+	case <-long:
+		t.Fatal("After(1m) fired after advancing 1s")
+	default:
+	}
+
+	f.Advance(time.Minute)
+	select {
+	case <-long:
+	default:
+		t.Fatal("After(1m) did not fire after advancing 61s")
+	}
+	if got := f.Now(); !got.Equal(start.Add(61 * time.Second)) {
+		t.Errorf("Now() = %v, want %v", got, start.Add(61*time.Second))
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+	fired := make(chan struct{})
+	go func() {
+		<-f.After(time.Second)
+		close(fired)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+	<-fired
+}
@@ -0,0 +1,355 @@
+package decryptclient
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	"github.com/sewelol/sgx-decryption-service/proofcodec"
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+	"github.com/sewelol/sgx-decryption-service/rthsig"
+	"golang.org/x/net/context"
+)
+
+const (
+	maxChunks    = 64 // max Records followed for a single chunked plaintext
+	challengeLen = 32 // random bytes in the challenge of a request
+)
+
+// Record is a ciphertext with the proofs the device needs to decrypt it
+type Record struct {
+	Ciphertext       []byte
+	ProofOfPresence  string // JSON proof of presence
+	ProofOfExtension string // JSON proof of extension
+	BaselineRTH      []byte // optional RTH the record must have been logged after
+}
+
+// DecryptionResult holds the outcome of decrypting one record
+type DecryptionResult struct {
+	Record    Record
+	Plaintext []byte // nil when the plaintext was spilled to disk, see Open
+	Err       error
+
+	spill  *spillFile
+	offset int64
+	length int
+}
+
+// Results are the results of DecryptAll, in record order
+type Results []DecryptionResult
+
+// Close releases the file the plaintexts beyond the memory budget were spilled to.
+// Spilled plaintexts can no longer be opened afterwards.
+func (rs Results) Close() error {
+	for _, r := range rs {
+		if r.spill != nil {
+			return r.spill.close()
+		}
+	}
+	return nil
+}
+
+// Open returns the plaintext, reading it back from disk if it was spilled
+func (r *DecryptionResult) Open() ([]byte, error) {
+	if r.spill == nil {
+		return r.Plaintext, r.Err
+	}
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return r.spill.read(r.offset, r.length)
+}
+
+// Client decrypts records with a decryption device
+type Client struct {
+	c pb.DecryptionDeviceClient
+
+	// Concurrency is the number of records decrypted in parallel by DecryptAll.
+	// The device moves its RTH forward with every decryption, so records whose
+	// proofs of extension build on each other must be decrypted one at a time.
+	Concurrency int
+
+	// MemBudget bounds the plaintext bytes DecryptAll holds in memory, zero disables the bound.
+	// Plaintexts completed after the budget is used up are spilled to an encrypted temporary file.
+	MemBudget int64
+
+	// MaxPlaintext bounds the length of a decrypted plaintext, zero disables the check.
+	// Set it with MaxPlaintextLen once the encryption key of the device is known.
+	MaxPlaintext int
+
+	// ProofCodec encodes the proofs sent to the device, nil sends the JSON proofs as they are
+	ProofCodec proofcodec.Codec
+
+	// Timings, when set, asks the device for its internal timings and is called with those of every
+	// decryption it returns them for. It may be called from several goroutines at once.
+	Timings func(r Record, t *pb.Timings)
+
+	// ChallengeKey, when set, sends a fresh random challenge with every record and requires the final chunk
+	// to carry the signature of the device over it, the ciphertext hash and the tag, made with this key.
+	// Set it to the attested verification key, so a plaintext replayed by a cache or proxy is rejected.
+	ChallengeKey *rsa.PublicKey
+
+	// Rand is the source of the challenges, crypto/rand when nil. It may be read from several goroutines at once.
+	Rand io.Reader
+}
+
+// New returns a Client decrypting one record at a time
+func New(c pb.DecryptionDeviceClient) *Client {
+	return &Client{c: c, Concurrency: 1}
+}
+
+// request builds the DecryptionRequest of a record, re-encoding its proofs with the ProofCodec
+func (cl *Client) request(r Record) (*pb.DecryptionRequest, error) {
+	req := &pb.DecryptionRequest{Ciphertext: r.Ciphertext, BaselineRth: r.BaselineRTH, Timings: cl.Timings != nil}
+	if cl.ChallengeKey != nil {
+		req.Challenge = make([]byte, challengeLen)
+		random := cl.Rand
+		if random == nil {
+			random = rand.Reader
+		}
+		if _, err := io.ReadFull(random, req.Challenge); err != nil {
+			return nil, err
+		}
+	}
+	if cl.ProofCodec == nil || cl.ProofCodec == proofcodec.JSON {
+		req.ProofOfPresence, req.ProofOfExtension = r.ProofOfPresence, r.ProofOfExtension
+		return req, nil
+	}
+
+	var err error
+	req.ProofEncoding = cl.ProofCodec.Name()
+	if req.EncodedProofOfPresence, err = encodeProof(cl.ProofCodec, r.ProofOfPresence); err != nil {
+		return nil, fmt.Errorf("proof of presence: %v", err)
+	}
+	if req.EncodedProofOfExtension, err = encodeProof(cl.ProofCodec, r.ProofOfExtension); err != nil {
+		return nil, fmt.Errorf("proof of extension: %v", err)
+	}
+	return req, nil
+}
+
+// encodeProof converts a JSON proof to the encoding of the codec
+func encodeProof(codec proofcodec.Codec, proof string) ([]byte, error) {
+	t, err := pt.UnmarshalProofTree(proof)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Marshal(t)
+}
+
+// Padding is the RSA padding scheme the device decrypts records with
+type Padding int
+
+const (
+	OAEP     Padding = iota // OAEP with SHA-256, the device's scheme
+	PKCS1v15                // PKCS#1 v1.5, for devices built without RSAOAEP
+)
+
+// MaxPlaintextLen returns the longest plaintext a single RSA block of the key can carry with the padding:
+// k-66 bytes with OAEP and SHA-256 (two hashes and two bytes), k-11 bytes with PKCS#1 v1.5
+func MaxPlaintextLen(pub *rsa.PublicKey, padding Padding) int {
+	k := (pub.N.BitLen() + 7) / 8
+	if padding == PKCS1v15 {
+		return k - 11
+	}
+	return k - 2*sha256.Size - 2
+}
+
+// Decrypt calls DecryptRecord and follows continuation tokens until the final chunk,
+// then verifies the reassembled plaintext against the tag of the final chunk
+func (cl *Client) Decrypt(ctx context.Context, r Record) ([]byte, error) {
+	req, err := cl.request(r)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cl.c.DecryptRecord(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if cl.Timings != nil && resp.Timings != nil {
+		cl.Timings(r, resp.Timings)
+	}
+	plaintext := resp.Plaintext
+	if err = cl.checkLength(plaintext); err != nil {
+		return nil, err
+	}
+
+	for chunks := 1; resp.ContinuationToken != ""; chunks++ {
+		if chunks >= maxChunks {
+			return nil, fmt.Errorf("plaintext exceeds %d chunks", maxChunks)
+		}
+		resp, err = cl.c.DecryptRecord(ctx, &pb.DecryptionRequest{Ciphertext: r.Ciphertext, ContinuationToken: resp.ContinuationToken})
+		if err != nil {
+			return nil, err
+		}
+		plaintext = append(plaintext, resp.Plaintext...)
+		if err = cl.checkLength(plaintext); err != nil {
+			return nil, err
+		}
+	}
+
+	// constant time, the tag is computed over the secret plaintext
+	tag := sha256.Sum256(plaintext)
+	if subtle.ConstantTimeCompare(tag[:], resp.Tag) != 1 {
+		return nil, errors.New("reassembled plaintext does not match tag")
+	}
+	if cl.ChallengeKey != nil {
+		if len(resp.ChallengeSig) == 0 {
+			return nil, errors.New("response does not answer the challenge of the request")
+		}
+		if err = rthsig.VerifyChallenge(cl.ChallengeKey, req.Challenge, sha256.Sum256(r.Ciphertext), tag[:], resp.ChallengeSig); err != nil {
+			return nil, fmt.Errorf("challenge signature does not verify: %v", err)
+		}
+	}
+	return plaintext, nil
+}
+
+// checkLength rejects plaintexts longer than the encryption key could have produced
+func (cl *Client) checkLength(plaintext []byte) error {
+	if cl.MaxPlaintext > 0 && len(plaintext) > cl.MaxPlaintext {
+		return fmt.Errorf("plaintext of %d bytes exceeds the %d bytes the encryption key can carry", len(plaintext), cl.MaxPlaintext)
+	}
+	return nil
+}
+
+// ErrNotAttempted is the error of the records DecryptAllUntil did not dispatch before it was stopped
+var ErrNotAttempted = errors.New("record not attempted before the run was stopped")
+
+// DecryptAll decrypts all records and returns the results in record order.
+// Failures of single records are captured in their result. The error is
+// non-nil only when ctx ends before all records are done, the results of
+// the records not attempted carry the context's error.
+// With a memory budget, read the plaintexts with DecryptionResult.Open and close the results when done.
+func (cl *Client) DecryptAll(ctx context.Context, records []Record) (Results, error) {
+	results, stopped := cl.decryptAll(ctx, ctx.Done(), records)
+	if stopped {
+		markStopped(results, ctx.Err())
+		return results, ctx.Err()
+	}
+	return results, nil
+}
+
+// DecryptAllUntil is DecryptAll, but stops dispatching records once stop is closed.
+// Records in flight finish and keep their result, the records not attempted carry
+// ErrNotAttempted, which is also returned.
+func (cl *Client) DecryptAllUntil(ctx context.Context, stop <-chan struct{}, records []Record) (Results, error) {
+	results, stopped := cl.decryptAll(ctx, stop, records)
+	if stopped {
+		markStopped(results, ErrNotAttempted)
+		return results, ErrNotAttempted
+	}
+	return results, nil
+}
+
+// errStopped marks the results of the records decryptAll did not attempt
+var errStopped = errors.New("stopped")
+
+// markStopped replaces errStopped in the results with err
+func markStopped(results Results, err error) {
+	for i := range results {
+		if results[i].Err == errStopped {
+			results[i].Err = err
+		}
+	}
+}
+
+// decryptAll decrypts the records with a pool of workers until stop is closed, and returns
+// the results and whether any record was not attempted. Those carry errStopped.
+func (cl *Client) decryptAll(ctx context.Context, stop <-chan struct{}, records []Record) (Results, bool) {
+	results := make(Results, len(records))
+	store := &plaintextStore{budget: cl.MemBudget}
+
+	workers := cl.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// a record dispatched while stop was being closed is not attempted either
+				select {
+				case <-stop:
+					results[i].Err = errStopped
+					continue
+				default:
+				}
+				plaintext, err := cl.Decrypt(ctx, records[i])
+				if err == nil {
+					err = store.keep(&results[i], plaintext)
+				}
+				results[i].Err = err
+			}
+		}()
+	}
+
+	next := 0
+dispatch:
+	for ; next < len(records); next++ {
+		results[next].Record = records[next]
+		select {
+		case jobs <- next:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i := next; i < len(records); i++ {
+		results[i].Record = records[i]
+		results[i].Err = errStopped
+	}
+	for i := range results {
+		if results[i].Err == errStopped {
+			return results, true
+		}
+	}
+	return results, false
+}
+
+// plaintextStore keeps the plaintexts of DecryptAll in memory up to the budget, and spills the rest to disk
+type plaintextStore struct {
+	mu     sync.Mutex
+	budget int64
+	used   int64
+	spill  *spillFile
+}
+
+// keep stores the plaintext in the result
+func (s *plaintextStore) keep(r *DecryptionResult, plaintext []byte) error {
+	s.mu.Lock()
+	if s.budget <= 0 || s.used+int64(len(plaintext)) <= s.budget {
+		s.used += int64(len(plaintext))
+		s.mu.Unlock()
+		r.Plaintext = plaintext
+		return nil
+	}
+
+	if s.spill == nil {
+		spill, err := newSpillFile()
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.spill = spill
+	}
+	spill := s.spill
+	s.mu.Unlock()
+
+	off, n, err := spill.write(plaintext)
+	if err != nil {
+		return err
+	}
+	r.spill, r.offset, r.length = spill, off, n
+	return nil
+}
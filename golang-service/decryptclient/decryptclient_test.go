@@ -0,0 +1,311 @@
+package decryptclient
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"testing"
+
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	"github.com/sewelol/sgx-decryption-service/rthsig"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// challengeDevice answers DecryptRecord like the device, or like a cache replaying earlier responses
+type challengeDevice struct {
+	pb.DecryptionDeviceClient
+	key *rsa.PrivateKey
+
+	replay   bool // answer every request after the first with the response to the first
+	unsigned bool // answer without a challenge signature
+	first    *pb.Record
+}
+
+func (d *challengeDevice) DecryptRecord(ctx context.Context, in *pb.DecryptionRequest, opts ...grpc.CallOption) (*pb.Record, error) {
+	if d.replay && d.first != nil {
+		return d.first, nil
+	}
+	plaintext := []byte("plaintext")
+	tag := sha256.Sum256(plaintext)
+	r := &pb.Record{Plaintext: plaintext, Tag: tag[:]}
+	if !d.unsigned {
+		digest := sha256.Sum256(rthsig.ChallengeSignedBytes(in.Challenge, sha256.Sum256(in.Ciphertext), tag[:]))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, d.key, crypto.SHA256, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		r.ChallengeSig = sig
+	}
+	d.first = r
+	return r, nil
+}
+
+func TestChallenge(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := Record{Ciphertext: []byte("ciphertext")}
+
+	tests := []struct {
+		name         string
+		device       *challengeDevice
+		challengeKey *rsa.PublicKey
+		wantErr      []bool // of the first and second decryption
+	}{
+		{name: "live device", device: &challengeDevice{key: key}, challengeKey: &key.PublicKey, wantErr: []bool{false, false}},
+		{name: "replayed response", device: &challengeDevice{key: key, replay: true}, challengeKey: &key.PublicKey, wantErr: []bool{false, true}},
+		{name: "no challenge signature", device: &challengeDevice{key: key, unsigned: true}, challengeKey: &key.PublicKey, wantErr: []bool{true, true}},
+		{name: "signed by another key", device: &challengeDevice{key: other}, challengeKey: &key.PublicKey, wantErr: []bool{true, true}},
+		{name: "challenges disabled", device: &challengeDevice{key: key, unsigned: true}, wantErr: []bool{false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := New(tt.device)
+			cl.ChallengeKey = tt.challengeKey
+			for i, wantErr := range tt.wantErr {
+				_, err := cl.Decrypt(context.Background(), record)
+				if (err != nil) != wantErr {
+					t.Errorf("decryption %d: error %v, want error %v", i+1, err, wantErr)
+				}
+			}
+		})
+	}
+}
+
+// TestMaxPlaintextLen checks the bounds against what crypto/rsa encrypts in one block
+func TestMaxPlaintextLen(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &key.PublicKey
+
+	encrypt := map[Padding]func(msg []byte) error{
+		OAEP: func(msg []byte) error {
+			_, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, msg, []byte("record"))
+			return err
+		},
+		PKCS1v15: func(msg []byte) error {
+			_, err := rsa.EncryptPKCS1v15(rand.Reader, pub, msg)
+			return err
+		},
+	}
+	for padding, want := range map[Padding]int{OAEP: 256 - 66, PKCS1v15: 256 - 11} {
+		n := MaxPlaintextLen(pub, padding)
+		if n != want {
+			t.Errorf("padding %d: %d bytes, want %d", padding, n, want)
+		}
+		if err := encrypt[padding](make([]byte, n)); err != nil {
+			t.Errorf("padding %d: %d bytes do not fit: %v", padding, n, err)
+		}
+		if err := encrypt[padding](make([]byte, n+1)); err == nil {
+			t.Errorf("padding %d: %d bytes fit, the bound is too low", padding, n+1)
+		}
+	}
+}
+
+// echoDevice decrypts every record to its ciphertext and fails the records whose ciphertext starts with "fail".
+// With started and release set, every decryption announces itself on started and waits for release to be closed.
+type echoDevice struct {
+	pb.DecryptionDeviceClient
+	started chan []byte
+	release chan struct{}
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (d *echoDevice) DecryptRecord(ctx context.Context, in *pb.DecryptionRequest, opts ...grpc.CallOption) (*pb.Record, error) {
+	d.mu.Lock()
+	d.inFlight++
+	if d.inFlight > d.maxInFlight {
+		d.maxInFlight = d.inFlight
+	}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.inFlight--
+		d.mu.Unlock()
+	}()
+
+	if d.started != nil {
+		d.started <- in.Ciphertext
+		<-d.release
+	}
+	if bytes.HasPrefix(in.Ciphertext, []byte("fail")) {
+		return nil, fmt.Errorf("cannot decrypt %s", in.Ciphertext)
+	}
+	tag := sha256.Sum256(in.Ciphertext)
+	return &pb.Record{Plaintext: in.Ciphertext, Tag: tag[:]}, nil
+}
+
+// newBlockingDevice returns an echoDevice whose decryptions wait for release to be closed
+func newBlockingDevice(records int) *echoDevice {
+	return &echoDevice{started: make(chan []byte, records), release: make(chan struct{})}
+}
+
+// testRecords returns n records, every third of which the echoDevice fails
+func testRecords(n int) []Record {
+	records := make([]Record, n)
+	for i := range records {
+		ct := fmt.Sprintf("record %d", i)
+		if i%3 == 2 {
+			ct = fmt.Sprintf("fail %d", i)
+		}
+		records[i] = Record{Ciphertext: []byte(ct)}
+	}
+	return records
+}
+
+// checkResults checks that the results are in record order, and that the records before
+// attempted are decrypted or failed by the echoDevice while the rest carry notAttempted
+func checkResults(t *testing.T, results []DecryptionResult, records []Record, attempted int, notAttempted error) {
+	t.Helper()
+	if len(results) != len(records) {
+		t.Fatalf("%d results for %d records", len(results), len(records))
+	}
+	for i, r := range results {
+		if !bytes.Equal(r.Record.Ciphertext, records[i].Ciphertext) {
+			t.Errorf("result %d is for record %q, want %q", i, r.Record.Ciphertext, records[i].Ciphertext)
+		}
+		switch {
+		case i >= attempted:
+			if r.Err != notAttempted {
+				t.Errorf("record %d: error %v, want %v", i, r.Err, notAttempted)
+			}
+		case bytes.HasPrefix(records[i].Ciphertext, []byte("fail")):
+			if r.Err == nil {
+				t.Errorf("record %d: failure of the device not captured", i)
+			}
+		default:
+			plaintext, err := r.Open()
+			if err != nil || !bytes.Equal(plaintext, records[i].Ciphertext) {
+				t.Errorf("record %d: plaintext %q, %v, want %q", i, plaintext, err, records[i].Ciphertext)
+			}
+		}
+	}
+}
+
+func TestDecryptAll(t *testing.T) {
+	records := testRecords(50)
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %d", concurrency), func(t *testing.T) {
+			dev := new(echoDevice)
+			cl := New(dev)
+			cl.Concurrency = concurrency
+
+			results, err := cl.DecryptAll(context.Background(), records)
+			if err != nil {
+				t.Fatalf("failures of single records returned as %v", err)
+			}
+			checkResults(t, results, records, len(records), nil)
+			if dev.maxInFlight > concurrency {
+				t.Errorf("%d records in flight, concurrency %d", dev.maxInFlight, concurrency)
+			}
+		})
+	}
+}
+
+// TestDecryptAllCanceled cancels the context while the first record is in flight: it completes,
+// the records not attempted carry the context's error
+func TestDecryptAllCanceled(t *testing.T) {
+	records := testRecords(10)
+	dev := newBlockingDevice(len(records))
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	var results []DecryptionResult
+	var err error
+	go func() {
+		results, err = New(dev).DecryptAll(ctx, records)
+		close(done)
+	}()
+
+	<-dev.started
+	cancel()
+	close(dev.release)
+	<-done
+
+	if err != context.Canceled {
+		t.Errorf("error %v, want %v", err, context.Canceled)
+	}
+	checkResults(t, results, records, 1, context.Canceled)
+}
+
+// TestDecryptAllSpills decrypts four plaintexts with a budget for two: the budget is used up exactly,
+// the other two are spilled and read back with Open until the results are closed
+func TestDecryptAllSpills(t *testing.T) {
+	records := make([]Record, 4)
+	for i := range records {
+		records[i] = Record{Ciphertext: []byte(fmt.Sprintf("record %d", i))}
+	}
+	cl := New(new(echoDevice))
+	cl.MemBudget = int64(2 * len(records[0].Ciphertext))
+
+	results, err := cl.DecryptAll(context.Background(), records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if spilled := r.Plaintext == nil; spilled != (i >= 2) {
+			t.Errorf("record %d: spilled %v, want %v", i, spilled, i >= 2)
+		}
+	}
+	checkResults(t, results, records, len(records), nil)
+
+	if err := results.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := results.Close(); err != nil {
+		t.Errorf("closing twice: %v", err)
+	}
+	if _, err := results[2].Open(); err == nil {
+		t.Error("spilled plaintext opened after the results were closed")
+	}
+	if plaintext, err := results[0].Open(); err != nil || !bytes.Equal(plaintext, records[0].Ciphertext) {
+		t.Errorf("plaintext in memory after closing: %q, %v", plaintext, err)
+	}
+}
+
+// TestDecryptAllUntil closes stop while two records are in flight: they complete, the rest are not attempted
+func TestDecryptAllUntil(t *testing.T) {
+	records := testRecords(10)
+	dev := newBlockingDevice(len(records))
+	cl := New(dev)
+	cl.Concurrency = 2
+	stop := make(chan struct{})
+
+	done := make(chan struct{})
+	var results Results
+	var err error
+	go func() {
+		results, err = cl.DecryptAllUntil(context.Background(), stop, records)
+		close(done)
+	}()
+
+	<-dev.started
+	<-dev.started
+	close(stop)
+	close(dev.release)
+	<-done
+
+	if err != ErrNotAttempted {
+		t.Errorf("error %v, want %v", err, ErrNotAttempted)
+	}
+	checkResults(t, results, records, 2, ErrNotAttempted)
+	if n := len(dev.started); n != 0 {
+		t.Errorf("%d records started after stop was closed", n)
+	}
+}
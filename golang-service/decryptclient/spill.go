@@ -0,0 +1,90 @@
+package decryptclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// spillFile holds plaintexts that did not fit in the memory budget.
+// They are sealed with AES-GCM under a key that only lives in memory. The file
+// is unlinked as soon as it is created, so nothing is left on disk once the
+// process exits, and its space is freed when it is closed.
+type spillFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	aead   cipher.AEAD
+	size   int64
+	count  uint64 // plaintexts sealed, the nonce of the next one
+	closed bool
+}
+
+func newSpillFile() (*spillFile, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ioutil.TempFile("", "decryptclient-spill-")
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &spillFile{f: f, aead: aead}, nil
+}
+
+// write seals the plaintext and appends it to the file, returning where it was written
+func (s *spillFile) write(plaintext []byte) (off int64, n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], s.count)
+	sealed := s.aead.Seal(nonce, nonce, plaintext, nil)
+
+	if _, err = s.f.WriteAt(sealed, s.size); err != nil {
+		return 0, 0, err
+	}
+	off = s.size
+	s.size += int64(len(sealed))
+	s.count++
+	return off, len(sealed), nil
+}
+
+// read reads back and opens the plaintext written at off
+func (s *spillFile) read(off int64, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := s.f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+
+	ns := s.aead.NonceSize()
+	return s.aead.Open(nil, buf[:ns], buf[ns:], nil)
+}
+
+// close closes the file, closing it again does nothing
+func (s *spillFile) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.f.Close()
+}
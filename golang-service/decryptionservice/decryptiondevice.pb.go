@@ -10,8 +10,14 @@ It is generated from these files:
 It has these top-level messages:
 	DecryptionRequest
 	Record
+	Timings
 	RootTreeHashRequest
 	RootTreeHash
+	AnchorProof
+	RootTreeHashHistoryRequest
+	RootTreeHashHistory
+	ProofTree
+	ProofNode
 	PublicKeyRequest
 	Quote
 */
@@ -40,10 +46,22 @@ const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
 // Decryption Request
 // - Byte array containing ciphertext
 // - Proofs represented as JSON trees
+// - Continuation token when asking for the next chunk of a partial record
+// - Optional baseline RTH the record must have been appended after
+// - Proofs in another encoding than JSON, named by proofEncoding, replace the JSON proofs
+// - Timings asks for the internal timings of the decryption, returned only by servers with debug timings enabled
+// - Optional random challenge the device signs with the plaintext tag, see Record
 type DecryptionRequest struct {
-	Ciphertext       []byte `protobuf:"bytes,1,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
-	ProofOfPresence  string `protobuf:"bytes,2,opt,name=proofOfPresence" json:"proofOfPresence,omitempty"`
-	ProofOfExtension string `protobuf:"bytes,3,opt,name=proofOfExtension" json:"proofOfExtension,omitempty"`
+	Ciphertext              []byte `protobuf:"bytes,1,opt,name=ciphertext,proto3" json:"ciphertext,omitempty"`
+	ProofOfPresence         string `protobuf:"bytes,2,opt,name=proofOfPresence" json:"proofOfPresence,omitempty"`
+	ProofOfExtension        string `protobuf:"bytes,3,opt,name=proofOfExtension" json:"proofOfExtension,omitempty"`
+	ContinuationToken       string `protobuf:"bytes,4,opt,name=continuationToken" json:"continuationToken,omitempty"`
+	BaselineRth             []byte `protobuf:"bytes,5,opt,name=baselineRth,proto3" json:"baselineRth,omitempty"`
+	ProofEncoding           string `protobuf:"bytes,6,opt,name=proofEncoding" json:"proofEncoding,omitempty"`
+	EncodedProofOfPresence  []byte `protobuf:"bytes,7,opt,name=encodedProofOfPresence,proto3" json:"encodedProofOfPresence,omitempty"`
+	EncodedProofOfExtension []byte `protobuf:"bytes,8,opt,name=encodedProofOfExtension,proto3" json:"encodedProofOfExtension,omitempty"`
+	Timings                 bool   `protobuf:"varint,9,opt,name=timings" json:"timings,omitempty"`
+	Challenge               []byte `protobuf:"bytes,10,opt,name=challenge,proto3" json:"challenge,omitempty"`
 }
 
 func (m *DecryptionRequest) Reset()                    { *m = DecryptionRequest{} }
@@ -72,9 +90,67 @@ func (m *DecryptionRequest) GetProofOfExtension() string {
 	return ""
 }
 
+func (m *DecryptionRequest) GetContinuationToken() string {
+	if m != nil {
+		return m.ContinuationToken
+	}
+	return ""
+}
+
+func (m *DecryptionRequest) GetBaselineRth() []byte {
+	if m != nil {
+		return m.BaselineRth
+	}
+	return nil
+}
+
+func (m *DecryptionRequest) GetProofEncoding() string {
+	if m != nil {
+		return m.ProofEncoding
+	}
+	return ""
+}
+
+func (m *DecryptionRequest) GetEncodedProofOfPresence() []byte {
+	if m != nil {
+		return m.EncodedProofOfPresence
+	}
+	return nil
+}
+
+func (m *DecryptionRequest) GetEncodedProofOfExtension() []byte {
+	if m != nil {
+		return m.EncodedProofOfExtension
+	}
+	return nil
+}
+
+func (m *DecryptionRequest) GetTimings() bool {
+	if m != nil {
+		return m.Timings
+	}
+	return false
+}
+
+func (m *DecryptionRequest) GetChallenge() []byte {
+	if m != nil {
+		return m.Challenge
+	}
+	return nil
+}
+
 // A plaintext record
+//   - Large plaintexts are returned in chunks with a continuation token
+//   - The final chunk carries a SHA-256 tag over the reassembled plaintext
+//   - The first chunk carries the timings, when asked for and enabled
+//   - The final chunk of a challenged request carries the device's signature over the challenge,
+//     the sha256 of the ciphertext and the tag
 type Record struct {
-	Plaintext []byte `protobuf:"bytes,1,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+	Plaintext         []byte   `protobuf:"bytes,1,opt,name=plaintext,proto3" json:"plaintext,omitempty"`
+	ContinuationToken string   `protobuf:"bytes,2,opt,name=continuationToken" json:"continuationToken,omitempty"`
+	Tag               []byte   `protobuf:"bytes,3,opt,name=tag,proto3" json:"tag,omitempty"`
+	Timings           *Timings `protobuf:"bytes,4,opt,name=timings" json:"timings,omitempty"`
+	ChallengeSig      []byte   `protobuf:"bytes,5,opt,name=challengeSig,proto3" json:"challengeSig,omitempty"`
 }
 
 func (m *Record) Reset()                    { *m = Record{} }
@@ -89,16 +165,84 @@ func (m *Record) GetPlaintext() []byte {
 	return nil
 }
 
+func (m *Record) GetContinuationToken() string {
+	if m != nil {
+		return m.ContinuationToken
+	}
+	return ""
+}
+
+func (m *Record) GetTag() []byte {
+	if m != nil {
+		return m.Tag
+	}
+	return nil
+}
+
+func (m *Record) GetTimings() *Timings {
+	if m != nil {
+		return m.Timings
+	}
+	return nil
+}
+
+func (m *Record) GetChallengeSig() []byte {
+	if m != nil {
+		return m.ChallengeSig
+	}
+	return nil
+}
+
+// Time spent by the server on a decryption, in nanoseconds
+// - Decoding the proofs of the request
+// - Verifying the proofs of presence and extension (and the baseline)
+// - The RSA decryption of the ciphertext
+type Timings struct {
+	ProofDecode       int64 `protobuf:"varint,1,opt,name=proofDecode" json:"proofDecode,omitempty"`
+	ProofVerification int64 `protobuf:"varint,2,opt,name=proofVerification" json:"proofVerification,omitempty"`
+	Decryption        int64 `protobuf:"varint,3,opt,name=decryption" json:"decryption,omitempty"`
+}
+
+func (m *Timings) Reset()                    { *m = Timings{} }
+func (m *Timings) String() string            { return proto.CompactTextString(m) }
+func (*Timings) ProtoMessage()               {}
+func (*Timings) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+
+func (m *Timings) GetProofDecode() int64 {
+	if m != nil {
+		return m.ProofDecode
+	}
+	return 0
+}
+
+func (m *Timings) GetProofVerification() int64 {
+	if m != nil {
+		return m.ProofVerification
+	}
+	return 0
+}
+
+func (m *Timings) GetDecryption() int64 {
+	if m != nil {
+		return m.Decryption
+	}
+	return 0
+}
+
 // RTH request contains
 // - A random nonce
+// - The signature format, 0 or 1 for the legacy sha256(rth || nonce), 2 for the canonical format
+// - Optional tree size of the external log head to prove the RTH's anchor against
 type RootTreeHashRequest struct {
-	Nonce []byte `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Nonce          []byte `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Version        uint32 `protobuf:"varint,2,opt,name=version" json:"version,omitempty"`
+	AnchorTreeSize uint64 `protobuf:"varint,3,opt,name=anchorTreeSize" json:"anchorTreeSize,omitempty"`
 }
 
 func (m *RootTreeHashRequest) Reset()                    { *m = RootTreeHashRequest{} }
 func (m *RootTreeHashRequest) String() string            { return proto.CompactTextString(m) }
 func (*RootTreeHashRequest) ProtoMessage()               {}
-func (*RootTreeHashRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{2} }
+func (*RootTreeHashRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
 
 func (m *RootTreeHashRequest) GetNonce() []byte {
 	if m != nil {
@@ -107,19 +251,38 @@ func (m *RootTreeHashRequest) GetNonce() []byte {
 	return nil
 }
 
+func (m *RootTreeHashRequest) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *RootTreeHashRequest) GetAnchorTreeSize() uint64 {
+	if m != nil {
+		return m.AnchorTreeSize
+	}
+	return 0
+}
+
 // Root Tree Hash
 // Random nonce used as message ID
-// Signature over rth and nonce
+// Signature over rth and nonce, and the tree size and timestamp in the canonical format
+// Tree size is 0 when the device does not know it
 type RootTreeHash struct {
-	Rth   []byte `protobuf:"bytes,1,opt,name=rth,proto3" json:"rth,omitempty"`
-	Nonce []byte `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
-	Sig   []byte `protobuf:"bytes,3,opt,name=sig,proto3" json:"sig,omitempty"`
+	Rth       []byte       `protobuf:"bytes,1,opt,name=rth,proto3" json:"rth,omitempty"`
+	Nonce     []byte       `protobuf:"bytes,2,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Sig       []byte       `protobuf:"bytes,3,opt,name=sig,proto3" json:"sig,omitempty"`
+	TreeSize  uint64       `protobuf:"varint,4,opt,name=treeSize" json:"treeSize,omitempty"`
+	Timestamp int64        `protobuf:"varint,5,opt,name=timestamp" json:"timestamp,omitempty"`
+	Version   uint32       `protobuf:"varint,6,opt,name=version" json:"version,omitempty"`
+	Anchor    *AnchorProof `protobuf:"bytes,7,opt,name=anchor" json:"anchor,omitempty"`
 }
 
 func (m *RootTreeHash) Reset()                    { *m = RootTreeHash{} }
 func (m *RootTreeHash) String() string            { return proto.CompactTextString(m) }
 func (*RootTreeHash) ProtoMessage()               {}
-func (*RootTreeHash) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+func (*RootTreeHash) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
 
 func (m *RootTreeHash) GetRth() []byte {
 	if m != nil {
@@ -142,6 +305,262 @@ func (m *RootTreeHash) GetSig() []byte {
 	return nil
 }
 
+func (m *RootTreeHash) GetTreeSize() uint64 {
+	if m != nil {
+		return m.TreeSize
+	}
+	return 0
+}
+
+func (m *RootTreeHash) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *RootTreeHash) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *RootTreeHash) GetAnchor() *AnchorProof {
+	if m != nil {
+		return m.Anchor
+	}
+	return nil
+}
+
+// Inclusion of an RTH in the external append-only log it is anchored in
+// - RFC 6962 audit path of the leaf holding the RTH
+// - Leaf index and tree size of the log head the path is for
+type AnchorProof struct {
+	LeafIndex uint64   `protobuf:"varint,1,opt,name=leafIndex" json:"leafIndex,omitempty"`
+	TreeSize  uint64   `protobuf:"varint,2,opt,name=treeSize" json:"treeSize,omitempty"`
+	AuditPath [][]byte `protobuf:"bytes,3,rep,name=auditPath,proto3" json:"auditPath,omitempty"`
+}
+
+func (m *AnchorProof) Reset()                    { *m = AnchorProof{} }
+func (m *AnchorProof) String() string            { return proto.CompactTextString(m) }
+func (*AnchorProof) ProtoMessage()               {}
+func (*AnchorProof) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *AnchorProof) GetLeafIndex() uint64 {
+	if m != nil {
+		return m.LeafIndex
+	}
+	return 0
+}
+
+func (m *AnchorProof) GetTreeSize() uint64 {
+	if m != nil {
+		return m.TreeSize
+	}
+	return 0
+}
+
+func (m *AnchorProof) GetAuditPath() [][]byte {
+	if m != nil {
+		return m.AuditPath
+	}
+	return nil
+}
+
+// RTH history request contains
+// - A random nonce
+// - The position of the first RTH, and the number of RTHs (0 for all up to the current one, the server may return fewer)
+type RootTreeHashHistoryRequest struct {
+	Nonce []byte `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Start uint64 `protobuf:"varint,2,opt,name=start" json:"start,omitempty"`
+	Count uint64 `protobuf:"varint,3,opt,name=count" json:"count,omitempty"`
+}
+
+func (m *RootTreeHashHistoryRequest) Reset()                    { *m = RootTreeHashHistoryRequest{} }
+func (m *RootTreeHashHistoryRequest) String() string            { return proto.CompactTextString(m) }
+func (*RootTreeHashHistoryRequest) ProtoMessage()               {}
+func (*RootTreeHashHistoryRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *RootTreeHashHistoryRequest) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *RootTreeHashHistoryRequest) GetStart() uint64 {
+	if m != nil {
+		return m.Start
+	}
+	return 0
+}
+
+func (m *RootTreeHashHistoryRequest) GetCount() uint64 {
+	if m != nil {
+		return m.Count
+	}
+	return 0
+}
+
+// Consecutive RTHs of the device, from its initial RTH on
+// Tree sizes are 0 when the device does not know them
+// One signature over the canonical serialization of all fields but sig
+type RootTreeHashHistory struct {
+	Start     uint64   `protobuf:"varint,1,opt,name=start" json:"start,omitempty"`
+	Rths      [][]byte `protobuf:"bytes,2,rep,name=rths,proto3" json:"rths,omitempty"`
+	TreeSizes []uint64 `protobuf:"varint,3,rep,packed,name=treeSizes" json:"treeSizes,omitempty"`
+	Nonce     []byte   `protobuf:"bytes,4,opt,name=nonce,proto3" json:"nonce,omitempty"`
+	Timestamp int64    `protobuf:"varint,5,opt,name=timestamp" json:"timestamp,omitempty"`
+	Sig       []byte   `protobuf:"bytes,6,opt,name=sig,proto3" json:"sig,omitempty"`
+}
+
+func (m *RootTreeHashHistory) Reset()                    { *m = RootTreeHashHistory{} }
+func (m *RootTreeHashHistory) String() string            { return proto.CompactTextString(m) }
+func (*RootTreeHashHistory) ProtoMessage()               {}
+func (*RootTreeHashHistory) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *RootTreeHashHistory) GetStart() uint64 {
+	if m != nil {
+		return m.Start
+	}
+	return 0
+}
+
+func (m *RootTreeHashHistory) GetRths() [][]byte {
+	if m != nil {
+		return m.Rths
+	}
+	return nil
+}
+
+func (m *RootTreeHashHistory) GetTreeSizes() []uint64 {
+	if m != nil {
+		return m.TreeSizes
+	}
+	return nil
+}
+
+func (m *RootTreeHashHistory) GetNonce() []byte {
+	if m != nil {
+		return m.Nonce
+	}
+	return nil
+}
+
+func (m *RootTreeHashHistory) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
+func (m *RootTreeHashHistory) GetSig() []byte {
+	if m != nil {
+		return m.Sig
+	}
+	return nil
+}
+
+// Proof tree, the "protobuf" proof encoding of the JSON proofs
+// Hashes are raw bytes instead of hex strings
+type ProofTree struct {
+	Rth      []byte     `protobuf:"bytes,1,opt,name=rth,proto3" json:"rth,omitempty"`
+	Value    string     `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	Proof    *ProofNode `protobuf:"bytes,3,opt,name=proof" json:"proof,omitempty"`
+	OldProof *ProofNode `protobuf:"bytes,4,opt,name=oldProof" json:"oldProof,omitempty"`
+	NewProof *ProofNode `protobuf:"bytes,5,opt,name=newProof" json:"newProof,omitempty"`
+	TreeSize uint64     `protobuf:"varint,6,opt,name=treeSize" json:"treeSize,omitempty"`
+}
+
+func (m *ProofTree) Reset()                    { *m = ProofTree{} }
+func (m *ProofTree) String() string            { return proto.CompactTextString(m) }
+func (*ProofTree) ProtoMessage()               {}
+func (*ProofTree) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *ProofTree) GetRth() []byte {
+	if m != nil {
+		return m.Rth
+	}
+	return nil
+}
+
+func (m *ProofTree) GetValue() string {
+	if m != nil {
+		return m.Value
+	}
+	return ""
+}
+
+func (m *ProofTree) GetProof() *ProofNode {
+	if m != nil {
+		return m.Proof
+	}
+	return nil
+}
+
+func (m *ProofTree) GetOldProof() *ProofNode {
+	if m != nil {
+		return m.OldProof
+	}
+	return nil
+}
+
+func (m *ProofTree) GetNewProof() *ProofNode {
+	if m != nil {
+		return m.NewProof
+	}
+	return nil
+}
+
+func (m *ProofTree) GetTreeSize() uint64 {
+	if m != nil {
+		return m.TreeSize
+	}
+	return 0
+}
+
+// Node of a proof tree, either a hash or two children
+type ProofNode struct {
+	Left  *ProofNode `protobuf:"bytes,1,opt,name=left" json:"left,omitempty"`
+	Right *ProofNode `protobuf:"bytes,2,opt,name=right" json:"right,omitempty"`
+	Hash  []byte     `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
+	Leaf  string     `protobuf:"bytes,4,opt,name=leaf" json:"leaf,omitempty"`
+}
+
+func (m *ProofNode) Reset()                    { *m = ProofNode{} }
+func (m *ProofNode) String() string            { return proto.CompactTextString(m) }
+func (*ProofNode) ProtoMessage()               {}
+func (*ProofNode) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *ProofNode) GetLeft() *ProofNode {
+	if m != nil {
+		return m.Left
+	}
+	return nil
+}
+
+func (m *ProofNode) GetRight() *ProofNode {
+	if m != nil {
+		return m.Right
+	}
+	return nil
+}
+
+func (m *ProofNode) GetHash() []byte {
+	if m != nil {
+		return m.Hash
+	}
+	return nil
+}
+
+func (m *ProofNode) GetLeaf() string {
+	if m != nil {
+		return m.Leaf
+	}
+	return ""
+}
+
 // Public key request message
 type PublicKeyRequest struct {
 	Nonce []byte `protobuf:"bytes,1,opt,name=nonce,proto3" json:"nonce,omitempty"`
@@ -150,7 +569,7 @@ type PublicKeyRequest struct {
 func (m *PublicKeyRequest) Reset()                    { *m = PublicKeyRequest{} }
 func (m *PublicKeyRequest) String() string            { return proto.CompactTextString(m) }
 func (*PublicKeyRequest) ProtoMessage()               {}
-func (*PublicKeyRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+func (*PublicKeyRequest) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
 
 func (m *PublicKeyRequest) GetNonce() []byte {
 	if m != nil {
@@ -170,7 +589,7 @@ type Quote struct {
 func (m *Quote) Reset()                    { *m = Quote{} }
 func (m *Quote) String() string            { return proto.CompactTextString(m) }
 func (*Quote) ProtoMessage()               {}
-func (*Quote) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+func (*Quote) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
 
 func (m *Quote) GetQuote() string {
 	if m != nil {
@@ -196,8 +615,14 @@ func (m *Quote) GetRSA_VerificationKey() []byte {
 func init() {
 	proto.RegisterType((*DecryptionRequest)(nil), "decryptiondevice.DecryptionRequest")
 	proto.RegisterType((*Record)(nil), "decryptiondevice.Record")
+	proto.RegisterType((*Timings)(nil), "decryptiondevice.Timings")
 	proto.RegisterType((*RootTreeHashRequest)(nil), "decryptiondevice.RootTreeHashRequest")
 	proto.RegisterType((*RootTreeHash)(nil), "decryptiondevice.RootTreeHash")
+	proto.RegisterType((*AnchorProof)(nil), "decryptiondevice.AnchorProof")
+	proto.RegisterType((*RootTreeHashHistoryRequest)(nil), "decryptiondevice.RootTreeHashHistoryRequest")
+	proto.RegisterType((*RootTreeHashHistory)(nil), "decryptiondevice.RootTreeHashHistory")
+	proto.RegisterType((*ProofTree)(nil), "decryptiondevice.ProofTree")
+	proto.RegisterType((*ProofNode)(nil), "decryptiondevice.ProofNode")
 	proto.RegisterType((*PublicKeyRequest)(nil), "decryptiondevice.PublicKeyRequest")
 	proto.RegisterType((*Quote)(nil), "decryptiondevice.Quote")
 }
@@ -223,6 +648,11 @@ type DecryptionDeviceClient interface {
 	// Caller provides a nonce
 	// Returns a signed RTH and nonce
 	GetRootTreeHash(ctx context.Context, in *RootTreeHashRequest, opts ...grpc.CallOption) (*RootTreeHash, error)
+	// Get Root Tree Hash History RPC
+	//
+	// Caller provides a nonce and the range of RTHs
+	// Returns the RTHs the device has held, covered by a single signature
+	GetRootTreeHashHistory(ctx context.Context, in *RootTreeHashHistoryRequest, opts ...grpc.CallOption) (*RootTreeHashHistory, error)
 	// Get Public key RPC
 	//
 	// Returns a Remote attestation report containing the public key as user data
@@ -255,6 +685,15 @@ func (c *decryptionDeviceClient) GetRootTreeHash(ctx context.Context, in *RootTr
 	return out, nil
 }
 
+func (c *decryptionDeviceClient) GetRootTreeHashHistory(ctx context.Context, in *RootTreeHashHistoryRequest, opts ...grpc.CallOption) (*RootTreeHashHistory, error) {
+	out := new(RootTreeHashHistory)
+	err := grpc.Invoke(ctx, "/decryptiondevice.DecryptionDevice/GetRootTreeHashHistory", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *decryptionDeviceClient) GetPublicKey(ctx context.Context, in *PublicKeyRequest, opts ...grpc.CallOption) (*Quote, error) {
 	out := new(Quote)
 	err := grpc.Invoke(ctx, "/decryptiondevice.DecryptionDevice/GetPublicKey", in, out, c.cc, opts...)
@@ -277,6 +716,11 @@ type DecryptionDeviceServer interface {
 	// Caller provides a nonce
 	// Returns a signed RTH and nonce
 	GetRootTreeHash(context.Context, *RootTreeHashRequest) (*RootTreeHash, error)
+	// Get Root Tree Hash History RPC
+	//
+	// Caller provides a nonce and the range of RTHs
+	// Returns the RTHs the device has held, covered by a single signature
+	GetRootTreeHashHistory(context.Context, *RootTreeHashHistoryRequest) (*RootTreeHashHistory, error)
 	// Get Public key RPC
 	//
 	// Returns a Remote attestation report containing the public key as user data
@@ -323,6 +767,24 @@ func _DecryptionDevice_GetRootTreeHash_Handler(srv interface{}, ctx context.Cont
 	return interceptor(ctx, in, info, handler)
 }
 
+func _DecryptionDevice_GetRootTreeHashHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RootTreeHashHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DecryptionDeviceServer).GetRootTreeHashHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/decryptiondevice.DecryptionDevice/GetRootTreeHashHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DecryptionDeviceServer).GetRootTreeHashHistory(ctx, req.(*RootTreeHashHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _DecryptionDevice_GetPublicKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(PublicKeyRequest)
 	if err := dec(in); err != nil {
@@ -353,6 +815,10 @@ var _DecryptionDevice_serviceDesc = grpc.ServiceDesc{
 			MethodName: "GetRootTreeHash",
 			Handler:    _DecryptionDevice_GetRootTreeHash_Handler,
 		},
+		{
+			MethodName: "GetRootTreeHashHistory",
+			Handler:    _DecryptionDevice_GetRootTreeHashHistory_Handler,
+		},
 		{
 			MethodName: "GetPublicKey",
 			Handler:    _DecryptionDevice_GetPublicKey_Handler,
@@ -365,30 +831,63 @@ var _DecryptionDevice_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("decryptiondevice.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 391 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x93, 0x5f, 0xcb, 0xda, 0x30,
-	0x14, 0xc6, 0xad, 0x2f, 0xef, 0x0b, 0x1e, 0x3a, 0xac, 0x71, 0x7f, 0x8a, 0x0c, 0x91, 0x8c, 0x8d,
-	0x32, 0xc1, 0xc1, 0xfc, 0x04, 0x8a, 0xa2, 0x20, 0x63, 0x5d, 0x1c, 0xbb, 0xd8, 0xcd, 0xd0, 0x78,
-	0xd4, 0x80, 0x34, 0x35, 0x8d, 0x43, 0xd9, 0x27, 0xd8, 0xd5, 0xbe, 0xf2, 0x48, 0x5b, 0xb5, 0x36,
-	0x2f, 0xde, 0x25, 0xcf, 0xf9, 0x1d, 0xce, 0xe1, 0x79, 0x12, 0x78, 0xbd, 0x42, 0xae, 0x4e, 0xb1,
-	0x16, 0x32, 0x5a, 0xe1, 0x6f, 0xc1, 0xb1, 0x17, 0x2b, 0xa9, 0x25, 0xf1, 0xca, 0x3a, 0xfd, 0xeb,
-	0x40, 0x63, 0x74, 0x11, 0x19, 0xee, 0x0f, 0x98, 0x68, 0xd2, 0x06, 0xe0, 0x22, 0xde, 0xa2, 0xd2,
-	0x78, 0xd4, 0xbe, 0xd3, 0x71, 0x02, 0x97, 0x15, 0x14, 0x12, 0x40, 0x3d, 0x56, 0x52, 0xae, 0xbf,
-	0xae, 0x43, 0x85, 0x09, 0x46, 0x1c, 0xfd, 0x6a, 0xc7, 0x09, 0x6a, 0xac, 0x2c, 0x93, 0x8f, 0xe0,
-	0xe5, 0xd2, 0xf8, 0xa8, 0x31, 0x4a, 0x84, 0x8c, 0xfc, 0x87, 0x14, 0xb5, 0x74, 0xfa, 0x01, 0x9e,
-	0x18, 0x72, 0xa9, 0x56, 0xe4, 0x2d, 0xd4, 0xe2, 0xdd, 0x42, 0x44, 0x85, 0xf1, 0x57, 0x81, 0x76,
-	0xa1, 0xc9, 0xa4, 0xd4, 0xdf, 0x15, 0xe2, 0x74, 0x91, 0x6c, 0xcf, 0x4b, 0xbf, 0x84, 0xc7, 0x48,
-	0x9a, 0x55, 0xb2, 0x86, 0xec, 0x42, 0xa7, 0xe0, 0x16, 0x61, 0xe2, 0xc1, 0x83, 0xd2, 0xdb, 0x9c,
-	0x31, 0xc7, 0x6b, 0x5f, 0xb5, 0xd0, 0x67, 0xb8, 0x44, 0x6c, 0xd2, 0x5d, 0x5d, 0x66, 0x8e, 0x34,
-	0x00, 0x2f, 0x3c, 0x2c, 0x77, 0x82, 0xcf, 0xf0, 0x74, 0x7f, 0xe6, 0x1f, 0x78, 0xfc, 0x76, 0x90,
-	0x1a, 0x4d, 0x79, 0x6f, 0x0e, 0x69, 0xb9, 0xc6, 0xb2, 0x0b, 0xe9, 0x42, 0x83, 0xcd, 0x07, 0xbf,
-	0xc6, 0xd1, 0xd9, 0xf6, 0x19, 0x9e, 0xf2, 0xe1, 0x1e, 0x9b, 0x0f, 0x6e, 0x74, 0xf2, 0x09, 0x9a,
-	0x06, 0xfe, 0x81, 0x4a, 0xac, 0x05, 0x5f, 0x9c, 0xf1, 0x6c, 0x2f, 0xc2, 0xe6, 0x83, 0x52, 0xe5,
-	0xf3, 0xbf, 0x2a, 0x78, 0xd7, 0x44, 0x47, 0x69, 0xcc, 0x24, 0x84, 0x17, 0xb9, 0x96, 0x3b, 0xfc,
-	0xae, 0x67, 0x3d, 0x11, 0xeb, 0x19, 0xb4, 0x7c, 0x1b, 0xca, 0xda, 0x69, 0x85, 0xfc, 0x84, 0xfa,
-	0x04, 0xf5, 0x8d, 0xb5, 0xef, 0x9f, 0xc1, 0xed, 0x9c, 0x5a, 0xed, 0xfb, 0x18, 0xad, 0x90, 0x2f,
-	0xe0, 0x4e, 0x50, 0x5f, 0xcc, 0x26, 0xd4, 0xee, 0x28, 0x27, 0xd1, 0x7a, 0x63, 0x33, 0x69, 0x06,
-	0xb4, 0x32, 0xec, 0x83, 0x2f, 0x64, 0x6f, 0xa3, 0x62, 0x6e, 0x31, 0xc3, 0x57, 0x65, 0xab, 0x42,
-	0xf3, 0x51, 0x42, 0x67, 0xf9, 0x94, 0xfe, 0x98, 0xfe, 0xff, 0x00, 0x00, 0x00, 0xff, 0xff, 0x5d,
-	0xb0, 0x61, 0x0d, 0x4b, 0x03, 0x00, 0x00,
+	// 923 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x56, 0xdd, 0x6e, 0xe3, 0x44,
+	0x14, 0xae, 0xeb, 0x24, 0x6d, 0x4e, 0x52, 0x36, 0x9d, 0x2e, 0x5d, 0x13, 0x60, 0x15, 0x0d, 0x2c,
+	0x8a, 0x60, 0xd5, 0x15, 0xad, 0xf8, 0xb9, 0xed, 0xaa, 0xd5, 0x2e, 0x5a, 0x01, 0x61, 0x52, 0x71,
+	0xc1, 0x05, 0xc8, 0x75, 0x4e, 0xe2, 0x11, 0xee, 0x4c, 0xd6, 0x9e, 0x94, 0x16, 0x6e, 0x78, 0x0b,
+	0x1e, 0x80, 0x2b, 0x9e, 0x82, 0x87, 0xe0, 0x55, 0x78, 0x80, 0xd5, 0x1c, 0xdb, 0xb1, 0x1d, 0xa7,
+	0xe9, 0xde, 0xcd, 0x7c, 0xf3, 0xcd, 0x39, 0xdf, 0x39, 0xdf, 0xc9, 0x38, 0x70, 0x38, 0xc1, 0x20,
+	0xbe, 0x9d, 0x1b, 0xa9, 0xd5, 0x04, 0xaf, 0x65, 0x80, 0x47, 0xf3, 0x58, 0x1b, 0xcd, 0x7a, 0xab,
+	0x38, 0xff, 0xc7, 0x85, 0xfd, 0xb3, 0x25, 0x28, 0xf0, 0xf5, 0x02, 0x13, 0xc3, 0x1e, 0x03, 0x04,
+	0x72, 0x1e, 0x62, 0x6c, 0xf0, 0xc6, 0x78, 0xce, 0xc0, 0x19, 0x76, 0x45, 0x09, 0x61, 0x43, 0x78,
+	0x30, 0x8f, 0xb5, 0x9e, 0x7e, 0x3f, 0x1d, 0xc5, 0x98, 0xa0, 0x0a, 0xd0, 0xdb, 0x1e, 0x38, 0xc3,
+	0xb6, 0x58, 0x85, 0xd9, 0xa7, 0xd0, 0xcb, 0xa0, 0xf3, 0x1b, 0x83, 0x2a, 0x91, 0x5a, 0x79, 0x2e,
+	0x51, 0x6b, 0x38, 0x7b, 0x0a, 0xfb, 0x81, 0x56, 0x46, 0xaa, 0x85, 0x6f, 0xc5, 0x5c, 0xe8, 0x5f,
+	0x51, 0x79, 0x0d, 0x22, 0xd7, 0x0f, 0xd8, 0x00, 0x3a, 0x97, 0x7e, 0x82, 0x91, 0x54, 0x28, 0x4c,
+	0xe8, 0x35, 0x49, 0x64, 0x19, 0x62, 0x1f, 0xc3, 0x1e, 0xe5, 0x38, 0x57, 0x81, 0x9e, 0x48, 0x35,
+	0xf3, 0x5a, 0x14, 0xab, 0x0a, 0xb2, 0x2f, 0xe1, 0x10, 0xed, 0x1a, 0x27, 0xa3, 0x95, 0x92, 0x76,
+	0x28, 0xe4, 0x1d, 0xa7, 0xec, 0x6b, 0x78, 0x54, 0x3d, 0x29, 0x0a, 0xdc, 0xa5, 0x8b, 0x77, 0x1d,
+	0x33, 0x0f, 0x76, 0x8c, 0xbc, 0x92, 0x6a, 0x96, 0x78, 0xed, 0x81, 0x33, 0xdc, 0x15, 0xf9, 0x96,
+	0x7d, 0x00, 0xed, 0x20, 0xf4, 0xa3, 0x08, 0xd5, 0x0c, 0x3d, 0xa0, 0x28, 0x05, 0xc0, 0xff, 0x75,
+	0xa0, 0x25, 0x30, 0xd0, 0xf1, 0xc4, 0x12, 0xe7, 0x91, 0x2f, 0x55, 0xc9, 0x9f, 0x02, 0x58, 0xdf,
+	0xc8, 0xed, 0xbb, 0x1a, 0xd9, 0x03, 0xd7, 0xf8, 0x33, 0x72, 0xa5, 0x2b, 0xec, 0x92, 0x9d, 0x14,
+	0x02, 0x6d, 0xfb, 0x3b, 0xc7, 0xef, 0x1d, 0xd5, 0x06, 0xea, 0x22, 0x25, 0x14, 0xda, 0x39, 0x74,
+	0x97, 0x52, 0xc7, 0x72, 0x96, 0x19, 0x52, 0xc1, 0xf8, 0x2d, 0xec, 0x64, 0xf7, 0xac, 0x7d, 0xe4,
+	0xc3, 0x19, 0xda, 0x26, 0x51, 0x0d, 0xae, 0x28, 0x43, 0xb6, 0x0a, 0xda, 0xfe, 0x88, 0xb1, 0x9c,
+	0xca, 0x80, 0x14, 0x53, 0x15, 0xae, 0xa8, 0x1f, 0xd8, 0x91, 0x2d, 0x34, 0x52, 0x31, 0xae, 0x28,
+	0x21, 0xfc, 0x0a, 0x0e, 0x84, 0xd6, 0xe6, 0x22, 0x46, 0x7c, 0xe9, 0x27, 0x61, 0x3e, 0xe9, 0x0f,
+	0xa1, 0xa9, 0xb4, 0x0a, 0x52, 0x01, 0x5d, 0x91, 0x6e, 0xac, 0x43, 0xd7, 0x18, 0x27, 0x79, 0xc2,
+	0x3d, 0x91, 0x6f, 0xd9, 0x27, 0xf0, 0x8e, 0xaf, 0x82, 0x50, 0xc7, 0x36, 0xd0, 0x58, 0xfe, 0x8e,
+	0x94, 0xaa, 0x21, 0x56, 0x50, 0xfe, 0x9f, 0x03, 0xdd, 0x72, 0x3e, 0xdb, 0xe5, 0xd8, 0x84, 0x59,
+	0x1a, 0xbb, 0x2c, 0x52, 0x6f, 0x97, 0x53, 0xf7, 0xc0, 0x4d, 0xe4, 0xd2, 0x8d, 0x44, 0xce, 0x58,
+	0x1f, 0x76, 0x4d, 0x9e, 0xac, 0x41, 0xc9, 0x96, 0x7b, 0x3b, 0x07, 0x46, 0x5e, 0x61, 0x62, 0xfc,
+	0xab, 0x39, 0x75, 0xdc, 0x15, 0x05, 0x50, 0x2e, 0xa3, 0x55, 0x2d, 0xe3, 0x0b, 0x68, 0xa5, 0x82,
+	0x69, 0xc8, 0x3b, 0xc7, 0x1f, 0xd6, 0x0d, 0x3e, 0xa5, 0x73, 0x1a, 0x5e, 0x91, 0x91, 0x39, 0x42,
+	0xa7, 0x04, 0xdb, 0xec, 0x11, 0xfa, 0xd3, 0x6f, 0xd4, 0x04, 0x6f, 0xa8, 0xb2, 0x86, 0x28, 0x80,
+	0x8a, 0xee, 0xed, 0xba, 0x6e, 0x7f, 0x31, 0x91, 0x66, 0xe4, 0x9b, 0xd0, 0x73, 0x07, 0xae, 0x9d,
+	0xdf, 0x25, 0xc0, 0x7f, 0x86, 0x7e, 0xb9, 0x77, 0x2f, 0x65, 0x62, 0x74, 0x7c, 0xbb, 0xd9, 0xb2,
+	0x87, 0xd0, 0x4c, 0x8c, 0x1f, 0x9b, 0x2c, 0x55, 0xba, 0xb1, 0x68, 0xa0, 0x17, 0xca, 0x64, 0x2e,
+	0xa5, 0x1b, 0xfe, 0xb7, 0x03, 0x07, 0x6b, 0x12, 0x14, 0x31, 0x9c, 0x72, 0x0c, 0x06, 0x8d, 0xd8,
+	0x84, 0x89, 0xb7, 0x4d, 0x32, 0x69, 0x4d, 0x7d, 0xcf, 0x6a, 0x49, 0x48, 0x7f, 0x43, 0x14, 0x40,
+	0xa1, 0xb0, 0x51, 0x56, 0xb8, 0xd9, 0xab, 0xcc, 0xf7, 0xd6, 0xd2, 0x77, 0xfe, 0xbf, 0x03, 0x6d,
+	0xea, 0xb3, 0x95, 0xb9, 0x7e, 0x7e, 0xae, 0xfd, 0x68, 0x91, 0x3f, 0xbd, 0xe9, 0x86, 0x7d, 0x0e,
+	0x4d, 0xfa, 0x71, 0x50, 0xc5, 0x9d, 0xe3, 0xf7, 0xeb, 0xc6, 0x52, 0xcc, 0xef, 0xf4, 0x04, 0x45,
+	0xca, 0x64, 0x5f, 0xc1, 0xae, 0x8e, 0xd2, 0x67, 0xca, 0x6b, 0xdc, 0x7f, 0x6b, 0x49, 0xb6, 0x17,
+	0x15, 0xfe, 0x96, 0x5e, 0x6c, 0xbe, 0xc5, 0xc5, 0x9c, 0x5c, 0x19, 0x8d, 0x56, 0x75, 0x34, 0xf8,
+	0x5f, 0x79, 0xd9, 0xf6, 0x0e, 0x7b, 0x06, 0x8d, 0x08, 0xa7, 0xa9, 0x23, 0xf7, 0x84, 0x27, 0xa2,
+	0xad, 0x3f, 0x96, 0xb3, 0x30, 0x9d, 0x83, 0xfb, 0xea, 0x27, 0xa6, 0x35, 0x38, 0xf4, 0x93, 0x30,
+	0xfb, 0xcd, 0xd1, 0xda, 0x62, 0x76, 0x92, 0xb3, 0xcf, 0x0f, 0xad, 0xf9, 0x10, 0x7a, 0xa3, 0xc5,
+	0x65, 0x24, 0x83, 0x57, 0xb8, 0x79, 0x18, 0xf9, 0x1f, 0xd0, 0xfc, 0x61, 0xa1, 0x0d, 0x4d, 0xe5,
+	0x6b, 0xbb, 0xa0, 0xe3, 0xb6, 0x48, 0x37, 0xec, 0x33, 0xd8, 0x17, 0xe3, 0xd3, 0x5f, 0xce, 0x55,
+	0xae, 0xec, 0x15, 0xde, 0x66, 0xaf, 0x40, 0x4f, 0x8c, 0x4f, 0x2b, 0x38, 0x7b, 0x06, 0x07, 0x96,
+	0x5c, 0x7e, 0xec, 0x2c, 0x3d, 0x15, 0xcb, 0xc4, 0xf8, 0x74, 0xe5, 0xe4, 0xf8, 0x4f, 0x17, 0x7a,
+	0xc5, 0x27, 0xfd, 0x8c, 0x8a, 0x66, 0x23, 0xd8, 0xcb, 0xb0, 0xec, 0x0b, 0xf2, 0x51, 0xbd, 0x31,
+	0xb5, 0xff, 0x01, 0x7d, 0xaf, 0x4e, 0x4a, 0xaf, 0xf3, 0x2d, 0xf6, 0x13, 0x3c, 0x78, 0x81, 0xa6,
+	0xf2, 0xc6, 0x3d, 0x59, 0x43, 0xaf, 0xbf, 0xb9, 0xfd, 0xc7, 0x9b, 0x69, 0x7c, 0x8b, 0x69, 0x38,
+	0x5c, 0x89, 0x9d, 0xff, 0x44, 0x9f, 0x6e, 0xbe, 0x5b, 0x7d, 0x2a, 0xfa, 0x4f, 0xde, 0x8a, 0xcd,
+	0xb7, 0xd8, 0xb7, 0xd0, 0x7d, 0x81, 0x66, 0xe9, 0x2e, 0xe3, 0x6b, 0xc6, 0x66, 0xc5, 0xfa, 0xfe,
+	0xa3, 0x3a, 0x87, 0x4c, 0xe7, 0x5b, 0xcf, 0x4f, 0xc0, 0x93, 0xfa, 0x68, 0x16, 0xcf, 0x83, 0x1a,
+	0xe7, 0xf9, 0xbb, 0xab, 0xde, 0x8c, 0x62, 0x6d, 0xf4, 0xc8, 0xb9, 0x6c, 0xd1, 0x7f, 0xb4, 0x93,
+	0x37, 0x03, 0x00, 0x02, 0xdb, 0xf6, 0x45, 0xbd, 0x09, 0x00, 0x00,
 }
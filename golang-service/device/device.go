@@ -1,19 +1,23 @@
 package device
 
 import (
-	"bytes"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"sync"
+	"time"
 
 	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+	"github.com/sewelol/sgx-decryption-service/rthsig"
 )
 
 // DEBUG - use key pairs from file
@@ -22,9 +26,19 @@ const RSAOAEP = true
 
 // Device global state data
 type Device struct {
-	signKey  *rsa.PrivateKey // Signing key-pair
-	decKey   *rsa.PrivateKey // Decryption key-pair
-	rootHash []byte          // Root hash in the Merkle Tree Log
+	signKey  *rsa.PrivateKey   // Signing key-pair
+	decKey   *rsa.PrivateKey   // Decryption key-pair
+	mu       sync.Mutex        // gRPC serves the ECALLs concurrently, mu guards the log state below
+	rootHash []byte            // Root hash in the Merkle Tree Log
+	treeSize uint64            // Number of leafs under rootHash, 0 when unknown
+	seen     map[[32]byte]bool // Root hashes the device has held, the log extends all of them
+	history  []historyEntry    // Root hashes the device has held, in order
+}
+
+// historyEntry is a root hash the device has held
+type historyEntry struct {
+	rth      []byte
+	treeSize uint64
 }
 
 // Init initializes the device
@@ -32,6 +46,11 @@ type Device struct {
 // Generate RSA keys
 func (d *Device) Init(initialHash []byte) *Device {
 	d.rootHash = initialHash
+	d.history = []historyEntry{{rth: initialHash}}
+	d.seen = make(map[[32]byte]bool)
+	if h, err := pt.SliceToHash(initialHash); err == nil {
+		d.seen[h] = true
+	}
 
 	if DEBUG == true {
 		d.decKey = debugImportRSAKey("test_set/crypt.pem")
@@ -46,8 +65,23 @@ func (d *Device) Init(initialHash []byte) *Device {
 
 // ----------- ECALLs (Interface functions) -------------
 
-// Decrypt some ciphertext after verifying proofs that the request have been logged
-func (d *Device) Decrypt(ciphertext []byte, pop, poe pt.ProofTree) (plaintext []byte, err error) {
+// Decrypt some ciphertext after verifying proofs that the request have been logged.
+// A non-empty baseline RTH must be one the device has held, and the proof of extension
+// must append the record, so it is known to be logged after the baseline.
+func (d *Device) Decrypt(ciphertext []byte, pop, poe pt.ProofTree, baseline []byte) (plaintext []byte, err error) {
+	plaintext, _, err = d.DecryptTimed(ciphertext, pop, poe, baseline)
+	return plaintext, err
+}
+
+// Timings is the time Decrypt spends verifying the proofs and decrypting the ciphertext
+type Timings struct {
+	ProofVerification time.Duration
+	Decryption        time.Duration
+}
+
+// DecryptTimed is Decrypt, and returns the time spent in its steps
+func (d *Device) DecryptTimed(ciphertext []byte, pop, poe pt.ProofTree, baseline []byte) (plaintext []byte, t Timings, err error) {
+	start := time.Now()
 
 	// Measure given ciphertext
 	ctSum := sha256.Sum256(ciphertext)
@@ -55,27 +89,21 @@ func (d *Device) Decrypt(ciphertext []byte, pop, poe pt.ProofTree) (plaintext []
 	// Verify π: R in H'
 	posRTH, err := d.verifyProofOfPresence(ctSum, pop)
 	if err != nil {
-		return nil, err
+		return nil, t, err
 	}
 
-	// Verify ρ: H' extends H
-	poeRTH, err := d.verifyProofOfExtension(ctSum, poe)
+	// Verify ρ: H' extends H, and move to H'
+	newRTH, err := d.advance(ctSum, pop, poe, posRTH, baseline)
 	if err != nil {
-		return nil, err
-	}
-
-	// Check if proofs match
-	if posRTH != poeRTH {
-		err = errors.New("Proofs could not be verified: Proof of presence/extension RTH missmatch")
-		return nil, err
+		return nil, t, err
 	}
 
-	// new root tree hash after decryption
-	newRTH := poeRTH
+	t.ProofVerification = time.Since(start)
 
 	// result := dec(dk, R)
 	label := []byte("record") //OAEP label
 	rng := rand.Reader
+	start = time.Now()
 
 	if RSAOAEP == true {
 
@@ -92,23 +120,116 @@ func (d *Device) Decrypt(ciphertext []byte, pop, poe pt.ProofTree) (plaintext []
 		}
 	}
 
-	// H := H'
+	t.Decryption = time.Since(start)
+
 	log.Printf("Record decrypted! New RTH: %s", hex.EncodeToString(newRTH[:]))
-	d.rootHash = newRTH[:]
-	return plaintext, err
+	return plaintext, t, err
+}
+
+// advance verifies the proof of extension against the device's RTH and moves the device to the
+// RTH it leads to, whether or not the record then decrypts. The lock is held from the comparison
+// with the device's RTH to the update, so two requests cannot both extend the same RTH.
+func (d *Device) advance(ctSum [32]byte, pop, poe pt.ProofTree, posRTH [32]byte, baseline []byte) (newRTH [32]byte, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	poeRTH, err := d.verifyProofOfExtension(ctSum, poe)
+	if err != nil {
+		return
+	}
+
+	// Check if proofs match
+	if !equalHash(posRTH[:], poeRTH[:]) {
+		err = errors.New("Proofs could not be verified: Proof of presence/extension RTH missmatch")
+		return
+	}
+
+	// Check that both proofs are for the record
+	if err = pt.VerifySameLeaf(pop, poe, ctSum); err != nil {
+		return
+	}
+
+	// Verify the record was logged after the baseline
+	if len(baseline) > 0 {
+		if err = d.verifyBaseline(ctSum, poe, baseline); err != nil {
+			return
+		}
+	}
+
+	// H := H'
+	newSize := poeTreeSize(ctSum, poe)
+	if !d.seen[poeRTH] || newSize != d.treeSize {
+		d.history = append(d.history, historyEntry{rth: poeRTH[:], treeSize: newSize})
+	}
+	d.rootHash = poeRTH[:]
+	d.treeSize = newSize
+	d.seen[poeRTH] = true
+	return poeRTH, nil
 }
 
-// SignRootTreeHash returns  RTH and sign(sha256(RTH + nonce)) from device
-func (d *Device) SignRootTreeHash(nonce []byte) (rth []byte, sig []byte) {
+// DecryptChallenge is DecryptTimed, and answers the challenge of the request in the same call: it signs
+// the challenge, the hash of the ciphertext and the sha256 tag over the plaintext, so the signature shows
+// this device decrypted this request and the plaintext was not replayed from a cache
+func (d *Device) DecryptChallenge(challenge, ciphertext []byte, pop, poe pt.ProofTree, baseline []byte) (plaintext, sig []byte, t Timings, err error) {
+	plaintext, t, err = d.DecryptTimed(ciphertext, pop, poe, baseline)
+	if err != nil {
+		return nil, nil, t, err
+	}
+
+	tag := sha256.Sum256(plaintext)
+	digest := sha256.Sum256(rthsig.ChallengeSignedBytes(challenge, sha256.Sum256(ciphertext), tag[:]))
+	sig, err = rsa.SignPKCS1v15(rand.Reader, d.signKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, nil, t, err
+	}
+	return plaintext, sig, t, nil
+}
+
+// SignRootTreeHash returns RTH, tree size, timestamp and the signature over them and the nonce.
+// Versions other than rthsig.Canonical get the legacy sign(sha256(RTH + nonce)).
+func (d *Device) SignRootTreeHash(nonce []byte, version uint32) (rth []byte, treeSize uint64, timestamp int64, sig []byte) {
+
+	d.mu.Lock()
+	rth, treeSize = d.rootHash, d.treeSize
+	d.mu.Unlock()
 
 	rng := rand.Reader
-	h := sha256.Sum256(append(d.rootHash, nonce...))
+	timestamp = time.Now().Unix()
+	h := rthsig.Digest(version, rth, nonce, treeSize, timestamp)
 
 	signature, err := rsa.SignPKCS1v15(rng, d.signKey, crypto.SHA256, h[:])
 	if err != nil {
 		log.Fatal(err)
 	}
-	return d.rootHash, signature
+	return rth, treeSize, timestamp, signature
+}
+
+// SignRootTreeHashHistory returns count root hashes the device has held from start on,
+// all of them up to the current one for count 0, covered by one signature
+func (d *Device) SignRootTreeHashHistory(nonce []byte, start, count uint64) (h *rthsig.History, sig []byte, err error) {
+	d.mu.Lock()
+	if held := len(d.history); start >= uint64(held) {
+		d.mu.Unlock()
+		return nil, nil, fmt.Errorf("RTH history starts at %d, the device has held %d RTHs", start, held)
+	}
+	end := uint64(len(d.history))
+	if count > 0 && start+count < end {
+		end = start + count
+	}
+
+	h = &rthsig.History{Start: start, Nonce: nonce, Timestamp: time.Now().Unix()}
+	for _, e := range d.history[start:end] {
+		h.RTHs = append(h.RTHs, e.rth)
+		h.TreeSizes = append(h.TreeSizes, e.treeSize)
+	}
+	d.mu.Unlock()
+
+	digest := sha256.Sum256(h.SignedBytes())
+	sig, err = rsa.SignPKCS1v15(rand.Reader, d.signKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, sig, nil
 }
 
 // ExportPubKey returns the public keys generated by the device (handeled during attestation to provide authentication)
@@ -120,39 +241,6 @@ func (d *Device) ExportPubKey() (encryptionKey, verificationKey []byte) {
 
 // ---------- Proof verification functions ------------
 
-// traverseProof traverses the proof tree
-func traverseProof(node pt.ProofNode, order *[][32]byte) [32]byte {
-	var l, r [32]byte
-
-	if node.Hash != "" {
-		b, err := hex.DecodeString(node.Hash)
-		if err != nil {
-			log.Fatal(err)
-		}
-		ret, err := sliceToHash(b)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		*order = append(*order, ret)
-
-		return ret
-	}
-
-	l = traverseProof(*node.Left, order)
-	r = traverseProof(*node.Right, order)
-
-	// hack  to comply with Dom's hash tree
-	// TODO: Dom should hash the byte array, not the hex encoded string..
-	ls := hex.EncodeToString(l[:])
-	rs := hex.EncodeToString(r[:])
-	buf := []byte(ls + rs)
-
-	// buf := append(l[:], r[:]...)
-
-	return sha256.Sum256(buf)
-}
-
 // verifyProofOfPresence parses the json formatted proof, and verifies the result, returns true or false
 func (d *Device) verifyProofOfPresence(ctSum [32]byte, p pt.ProofTree) (computedRTH [32]byte, err error) {
 
@@ -160,26 +248,30 @@ func (d *Device) verifyProofOfPresence(ctSum [32]byte, p pt.ProofTree) (computed
 	order := new([][32]byte)
 
 	// Traverse proof tree, compute the new RTH and add leafs to order
-	computedRTH = traverseProof(p.Root, order)
+	// A declared tree size bounds the depth of the proof
+	computedRTH, err = pt.ComputeRootDepth(p.Root, order, pt.MaxDepth(p.TreeSize))
+	if err != nil {
+		return
+	}
 
 	// Decode Hex string and copy to an array
 	buf, err := hex.DecodeString(p.RTH)
 	if err != nil {
 		return
 	}
-	declaredRTH, err := sliceToHash(buf)
+	declaredRTH, err := pt.SliceToHash(buf)
 	if err != nil {
 		return
 	}
 
 	// Check if declared RTH and computed RTH are equal
-	if declaredRTH != computedRTH {
+	if !equalHash(declaredRTH[:], computedRTH[:]) {
 		err = errors.New("Presence could not be verified: Declared and computed RTH missmatch")
 		return
 	}
 
 	// Check if proof_val actually is included in the proof
-	if containsHash(*order, ctSum) != true {
+	if !pt.ContainsHash(*order, ctSum) {
 		err = errors.New("Presence could not be verified: Record not present in proof tree")
 		return
 	}
@@ -190,34 +282,55 @@ func (d *Device) verifyProofOfPresence(ctSum [32]byte, p pt.ProofTree) (computed
 }
 
 // verifyProofOfExtension parses the json formatted proof, and verifies the result, returns true or false
+// d.mu must be held
 func (d *Device) verifyProofOfExtension(ctSum [32]byte, p pt.ProofTree) (RTH [32]byte, err error) {
 
-	// Presence lists
-	var oldOrder [][32]byte
-	var newOrder [][32]byte
-
-	// Compute old and new RTH
-	oldComputedRTH := traverseProof(p.OldProof, &oldOrder)
-	newComputedRTH := traverseProof(p.NewProof, &newOrder)
+	// Compute old and new RTH, and check that the new proof extends the old one
+	oldComputedRTH, newComputedRTH, err := pt.VerifyExtension(p)
+	if err != nil {
+		return
+	}
 
 	// Check if computed old RTH match device's RTH
-	if bytes.Compare(oldComputedRTH[:], d.rootHash) > 0 {
+	if !equalHash(oldComputedRTH[:], d.rootHash) {
 		err = errors.New("Proof RTH does not match current internal state")
 		return
 	}
 
-	// Check that oldOrder is a subset of newOrder
-	for i, v := range oldOrder {
-		if v != newOrder[i] {
-			err = errors.New("Old proof is not a subset of new proof")
-			return
-		}
-	}
-
 	RTH = newComputedRTH
 	return RTH, nil
 }
 
+// verifyBaseline checks that the device's log extends the baseline RTH and that the record
+// is appended by the proof of extension, i.e. after the device's current RTH. d.mu must be held.
+func (d *Device) verifyBaseline(ctSum [32]byte, p pt.ProofTree, baseline []byte) error {
+	h, err := pt.SliceToHash(baseline)
+	if err != nil {
+		return err
+	}
+	if !d.seen[h] {
+		return errors.New("Baseline RTH is unknown to the device")
+	}
+
+	if err = pt.VerifyAppended(p, ctSum); err != nil {
+		return errors.New("Record predates the baseline RTH: " + err.Error())
+	}
+	return nil
+}
+
+// poeTreeSize returns the tree size a proof of extension declares for its new tree, if the
+// path to the record in the new tree has the shape of a tree of that size. Returns 0 otherwise.
+func poeTreeSize(ctSum [32]byte, p pt.ProofTree) uint64 {
+	if p.TreeSize == 0 {
+		return 0
+	}
+	if _, _, err := pt.ServiceAuditPath(p.NewProof, ctSum, p.TreeSize); err != nil {
+		log.Printf("Ignoring tree size of proof of extension: %v", err)
+		return 0
+	}
+	return p.TreeSize
+}
+
 // ---------- AUX functions ------------
 
 // generateKeyPair will generate a pair of RSA keys
@@ -276,21 +389,10 @@ func debugImportRSAKey(filename string) *rsa.PrivateKey {
 	return key
 }
 
-func containsHash(s [][32]byte, e [32]byte) bool {
-	for _, a := range s {
-		if a == e {
-			return true
-		}
-	}
-	return false
-}
-
-func sliceToHash(slice []byte) (hash [32]byte, err error) {
-	if len(slice) > len(hash) {
-		err = errors.New("sliceToHash: slice is to long")
-		return
-	}
-
-	copy(hash[:], slice)
-	return
+// equalHash compares hashes in constant time.
+// The comparisons deciding whether the device decrypts (declared and computed RTH,
+// presence and extension RTH, proof and device RTH, record in proof) are security
+// sensitive: their timing must not tell a caller how much of a forged hash matched.
+func equalHash(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
 }
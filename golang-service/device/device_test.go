@@ -0,0 +1,169 @@
+package device
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+)
+
+// newTestDevice returns a device holding the tree of the single leaf, with the debug keys of test_set
+func newTestDevice(t *testing.T, leaf [32]byte) *Device {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	return new(Device).Init(leaf[:])
+}
+
+// appendProofs returns the proofs of presence and extension of the record appended to the tree of
+// the single leaf first
+func appendProofs(first, record [32]byte) (pop, poe pt.ProofTree) {
+	newTree := pt.ProofNode{Left: &pt.ProofNode{Hash: hex.EncodeToString(first[:])}, Right: &pt.ProofNode{Hash: hex.EncodeToString(record[:])}}
+	rth := pt.ComputeRTH([][]byte{first[:], record[:]})
+	pop = pt.ProofTree{RTH: hex.EncodeToString(rth), Root: newTree}
+	poe = pt.ProofTree{OldProof: pt.ProofNode{Hash: hex.EncodeToString(first[:])}, NewProof: newTree}
+	return pop, poe
+}
+
+// TestConcurrentDecryptExtendsOnce sends proofs of extension of the same RTH at once: only one of
+// them may be accepted, and the history must hold the RTH the device moved to
+func TestConcurrentDecryptExtendsOnce(t *testing.T) {
+	first := sha256.Sum256([]byte("first"))
+	d := newTestDevice(t, first)
+
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		ct, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &d.decKey.PublicKey, []byte(fmt.Sprint("record ", i)), []byte("record"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pop, poe := appendProofs(first, sha256.Sum256(ct))
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = d.Decrypt(ct, pop, poe, nil)
+		}(i)
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, err := range errs {
+		if err == nil {
+			accepted++
+		}
+	}
+	if accepted != 1 {
+		t.Fatalf("%d of %d extensions of the same RTH accepted, want 1: %v", accepted, n, errs)
+	}
+	if len(d.history) != 2 {
+		t.Fatalf("history holds %d RTHs, want 2", len(d.history))
+	}
+	if !equalHash(d.history[1].rth, d.rootHash) {
+		t.Fatal("last RTH of the history is not the device's RTH")
+	}
+}
+
+// TestSignWhileDecrypting reads the device state in the Sign ECALLs while records are decrypted
+func TestSignWhileDecrypting(t *testing.T) {
+	first := sha256.Sum256([]byte("first"))
+	d := newTestDevice(t, first)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		ct, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &d.decKey.PublicKey, []byte(fmt.Sprint("record ", i)), []byte("record"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pop, poe := appendProofs(first, sha256.Sum256(ct))
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			d.Decrypt(ct, pop, poe, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			d.SignRootTreeHash([]byte("nonce"), 1)
+			if _, _, err := d.SignRootTreeHashHistory([]byte("nonce"), 0, 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestDecryptPadding round-trips a plaintext encrypted with each padding scheme through Decrypt:
+// OAEP with SHA-256 and the label "record", and PKCS#1 v1.5, which only a device built without
+// RSAOAEP decrypts. An OAEP ciphertext under another label must not decrypt.
+func TestDecryptPadding(t *testing.T) {
+	plaintext := []byte("Decrypt RPC successfull")
+
+	tests := []struct {
+		name    string
+		encrypt func(pub *rsa.PublicKey) ([]byte, error)
+		wantErr bool
+	}{
+		{
+			name: "OAEP",
+			encrypt: func(pub *rsa.PublicKey) ([]byte, error) {
+				return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, plaintext, []byte("record"))
+			},
+			wantErr: !RSAOAEP,
+		},
+		{
+			name: "OAEP with another label",
+			encrypt: func(pub *rsa.PublicKey) ([]byte, error) {
+				return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, plaintext, []byte("other"))
+			},
+			wantErr: true,
+		},
+		{
+			name: "PKCS#1 v1.5",
+			encrypt: func(pub *rsa.PublicKey) ([]byte, error) {
+				return rsa.EncryptPKCS1v15(rand.Reader, pub, plaintext)
+			},
+			wantErr: RSAOAEP,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := sha256.Sum256([]byte("first"))
+			d := newTestDevice(t, first)
+			ct, err := tt.encrypt(&d.decKey.PublicKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pop, poe := appendProofs(first, sha256.Sum256(ct))
+
+			got, err := d.Decrypt(ct, pop, poe, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decrypted to %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(plaintext) {
+				t.Errorf("decrypted to %q, want %q", got, plaintext)
+			}
+		})
+	}
+}
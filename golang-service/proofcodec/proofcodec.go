@@ -0,0 +1,140 @@
+package proofcodec
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+)
+
+// Codec encodes proof trees for the wire. The device verifies the decoded
+// pt.ProofTree, whatever encoding it was sent in.
+type Codec interface {
+	Name() string // proofEncoding of the DecryptionRequest
+	Marshal(t *pt.ProofTree) ([]byte, error)
+	Unmarshal(b []byte) (*pt.ProofTree, error)
+}
+
+// JSON is the proof format of the proofs files and the string proof fields
+var JSON Codec = jsonCodec{}
+
+// Protobuf encodes proofs as pb.ProofTree messages, with raw instead of hex encoded hashes
+var Protobuf Codec = protoCodec{}
+
+// ByName returns the codec of a proofEncoding, "" is JSON
+func ByName(name string) (Codec, error) {
+	switch name {
+	case "", "json":
+		return JSON, nil
+	case "protobuf":
+		return Protobuf, nil
+	}
+	return nil, fmt.Errorf("Unknown proof encoding %q", name)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Marshal(t *pt.ProofTree) ([]byte, error) {
+	return json.Marshal(t)
+}
+
+func (jsonCodec) Unmarshal(b []byte) (*pt.ProofTree, error) {
+	return pt.UnmarshalProofTree(string(b))
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Name() string { return "protobuf" }
+
+func (protoCodec) Marshal(t *pt.ProofTree) ([]byte, error) {
+	p, err := ToProto(t)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(p)
+}
+
+func (protoCodec) Unmarshal(b []byte) (*pt.ProofTree, error) {
+	p := new(pb.ProofTree)
+	if err := proto.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	return FromProto(p), nil
+}
+
+// ToProto converts a proof tree to its protobuf message, decoding the hex encoded hashes
+func ToProto(t *pt.ProofTree) (*pb.ProofTree, error) {
+	rth, err := hex.DecodeString(t.RTH)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RTH: %v", err)
+	}
+	p := &pb.ProofTree{Rth: rth, Value: t.Record, TreeSize: t.TreeSize}
+	if p.Proof, err = nodeToProto(t.Root); err != nil {
+		return nil, err
+	}
+	if p.OldProof, err = nodeToProto(t.OldProof); err != nil {
+		return nil, err
+	}
+	if p.NewProof, err = nodeToProto(t.NewProof); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// FromProto converts a protobuf proof tree message to a proof tree
+func FromProto(p *pb.ProofTree) *pt.ProofTree {
+	return &pt.ProofTree{
+		RTH:      hex.EncodeToString(p.Rth),
+		Record:   p.Value,
+		Root:     nodeFromProto(p.Proof),
+		OldProof: nodeFromProto(p.OldProof),
+		NewProof: nodeFromProto(p.NewProof),
+		TreeSize: p.TreeSize,
+	}
+}
+
+// nodeToProto converts a subtree, an empty node (a proof left out) becomes nil
+func nodeToProto(n pt.ProofNode) (*pb.ProofNode, error) {
+	if n.Hash == "" && n.Leaf == "" && n.Left == nil && n.Right == nil {
+		return nil, nil
+	}
+
+	hash, err := hex.DecodeString(n.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid hash in proof node: %v", err)
+	}
+	p := &pb.ProofNode{Hash: hash, Leaf: n.Leaf}
+	if n.Left != nil {
+		if p.Left, err = nodeToProto(*n.Left); err != nil {
+			return nil, err
+		}
+	}
+	if n.Right != nil {
+		if p.Right, err = nodeToProto(*n.Right); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func nodeFromProto(p *pb.ProofNode) pt.ProofNode {
+	if p == nil {
+		return pt.ProofNode{}
+	}
+
+	n := pt.ProofNode{Hash: hex.EncodeToString(p.Hash), Leaf: p.Leaf}
+	if p.Left != nil {
+		l := nodeFromProto(p.Left)
+		n.Left = &l
+	}
+	if p.Right != nil {
+		r := nodeFromProto(p.Right)
+		n.Right = &r
+	}
+	return n
+}
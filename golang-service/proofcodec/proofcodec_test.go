@@ -0,0 +1,90 @@
+package proofcodec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+)
+
+func hashNode(i byte) *pt.ProofNode {
+	h := sha256.Sum256([]byte{i})
+	return &pt.ProofNode{Hash: hex.EncodeToString(h[:])}
+}
+
+// testProofs returns a proof of presence and a proof of extension on the tree of three leafs
+func testProofs() []pt.ProofTree {
+	var leafs [][]byte
+	for i := byte(0); i < 3; i++ {
+		h := sha256.Sum256([]byte{i})
+		leafs = append(leafs, h[:])
+	}
+	full := pt.ProofNode{Left: &pt.ProofNode{Left: hashNode(0), Right: hashNode(1)}, Right: hashNode(2)}
+	return []pt.ProofTree{
+		{RTH: hex.EncodeToString(pt.ComputeRTH(leafs)), Record: "record", Root: full, TreeSize: 3},
+		{OldProof: pt.ProofNode{Hash: hex.EncodeToString(pt.ComputeRTH(leafs[:2]))}, NewProof: full, TreeSize: 3},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSON, Protobuf} {
+		for i, proof := range testProofs() {
+			proof := proof
+			b, err := codec.Marshal(&proof)
+			if err != nil {
+				t.Fatalf("%s: proof %d: %v", codec.Name(), i, err)
+			}
+			back, err := codec.Unmarshal(b)
+			if err != nil {
+				t.Fatalf("%s: proof %d: %v", codec.Name(), i, err)
+			}
+			if !reflect.DeepEqual(&proof, back) {
+				t.Errorf("%s: proof %d decodes to %+v, want %+v", codec.Name(), i, back, proof)
+			}
+
+			// the verifier sees the same tree whatever the encoding
+			var want, got [][32]byte
+			r1, _ := pt.ComputeRoot(proof.Root, &want)
+			r2, _ := pt.ComputeRoot(back.Root, &got)
+			if r1 != r2 || !reflect.DeepEqual(want, got) {
+				t.Errorf("%s: proof %d verifies differently once decoded", codec.Name(), i)
+			}
+		}
+	}
+}
+
+func TestProtoConversion(t *testing.T) {
+	for i, proof := range testProofs() {
+		proof := proof
+		p, err := ToProto(&proof)
+		if err != nil {
+			t.Fatalf("proof %d: %v", i, err)
+		}
+		if proof.RTH != "" && len(p.Rth) != sha256.Size {
+			t.Errorf("proof %d: RTH of %d bytes, want the raw hash", i, len(p.Rth))
+		}
+		if back := FromProto(p); !reflect.DeepEqual(&proof, back) {
+			t.Errorf("proof %d converts back to %+v", i, back)
+		}
+	}
+
+	if _, err := ToProto(&pt.ProofTree{RTH: "zz"}); err == nil {
+		t.Error("RTH that is not hex accepted")
+	}
+	if _, err := ToProto(&pt.ProofTree{Root: pt.ProofNode{Hash: "zz"}}); err == nil {
+		t.Error("node hash that is not hex accepted")
+	}
+}
+
+func TestByName(t *testing.T) {
+	for name, want := range map[string]Codec{"": JSON, "json": JSON, "protobuf": Protobuf} {
+		if c, err := ByName(name); err != nil || c != want {
+			t.Errorf("ByName(%q) = %v, %v", name, c, err)
+		}
+	}
+	if _, err := ByName("cbor"); err == nil {
+		t.Error("unknown encoding accepted")
+	}
+}
@@ -0,0 +1,79 @@
+package prooftree
+
+import "sync"
+
+// VerifierCache remembers the hashes decoded and computed while verifying proofs against one RTH.
+// Proofs of the records of one tree share the roots of its stable left subtrees (the frontier)
+// and the top of the tree, so when a whole dataset is verified against a static tree, every
+// proof after the first decodes and rehashes only the part of its path no earlier proof covered.
+//
+// A decoded hash depends only on its hex encoding, and the hash of an inner node only on the
+// hashes of its children, so an entry is correct whatever proof it came from. The cache is
+// emptied when it is used with another RTH, and when it holds maxEntries hashes, which bounds
+// what forged proofs can make it hold.
+type VerifierCache struct {
+	mu         sync.Mutex
+	rth        [32]byte
+	decoded    map[string][32]byte
+	nodes      map[[64]byte][32]byte
+	maxEntries int
+}
+
+// NewVerifierCache returns an empty cache holding at most maxEntries hashes
+func NewVerifierCache(maxEntries int) *VerifierCache {
+	c := &VerifierCache{maxEntries: maxEntries}
+	c.reset(c.rth)
+	return c
+}
+
+// ComputeRoot is ComputeRootDepth for a proof verified against rth, reusing the hashes of the
+// earlier proofs against the same RTH. The caller still compares the root with rth.
+func (c *VerifierCache) ComputeRoot(rth [32]byte, node ProofNode, order *[][32]byte, maxDepth int) ([32]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rth != c.rth {
+		c.reset(rth)
+	}
+	return computeRoot(node, order, maxDepth, c)
+}
+
+func (c *VerifierCache) decodeHash(s string) ([32]byte, error) {
+	if h, ok := c.decoded[s]; ok {
+		return h, nil
+	}
+	h, err := decodeHash(s)
+	if err != nil {
+		return h, err
+	}
+	c.makeRoom()
+	c.decoded[s] = h
+	return h, nil
+}
+
+func (c *VerifierCache) hashChildren(l, r [32]byte) [32]byte {
+	var key [64]byte
+	copy(key[:32], l[:])
+	copy(key[32:], r[:])
+	if h, ok := c.nodes[key]; ok {
+		return h
+	}
+	h := hashChildren(l[:], r[:])
+	c.makeRoom()
+	c.nodes[key] = h
+	return h
+}
+
+// makeRoom empties a full cache
+func (c *VerifierCache) makeRoom() {
+	if len(c.decoded)+len(c.nodes) >= c.maxEntries {
+		c.reset(c.rth)
+	}
+}
+
+// reset empties the cache and binds it to rth
+func (c *VerifierCache) reset(rth [32]byte) {
+	c.rth = rth
+	c.decoded = make(map[string][32]byte)
+	c.nodes = make(map[[64]byte][32]byte)
+}
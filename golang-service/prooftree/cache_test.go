@@ -0,0 +1,187 @@
+package prooftree
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+)
+
+// subtreeRoots memoizes the roots of the subtrees of a tree, by their first and last leaf
+type subtreeRoots struct {
+	leafs [][]byte
+	roots map[[2]int][]byte
+}
+
+func (s *subtreeRoots) root(lo, hi int) []byte {
+	if hi-lo == 1 {
+		return s.leafs[lo]
+	}
+	if r, ok := s.roots[[2]int{lo, hi}]; ok {
+		return r
+	}
+	k := int(splitPoint(uint64(hi - lo)))
+	h := hashChildren(s.root(lo, lo+k), s.root(lo+k, hi))
+	s.roots[[2]int{lo, hi}] = h[:]
+	return h[:]
+}
+
+// presenceProof returns the proof of presence of leaf i in the subtree over the leafs lo to hi:
+// the path to the leaf, with the roots of the other subtrees as hashes
+func (s *subtreeRoots) presenceProof(lo, hi, i int) ProofNode {
+	if hi-lo == 1 {
+		return *hashNode(s.leafs[lo])
+	}
+	k := lo + int(splitPoint(uint64(hi-lo)))
+	if i < k {
+		l := s.presenceProof(lo, k, i)
+		return ProofNode{Left: &l, Right: hashNode(s.root(k, hi))}
+	}
+	r := s.presenceProof(k, hi, i)
+	return ProofNode{Left: hashNode(s.root(lo, k)), Right: &r}
+}
+
+// datasetProofs returns the proofs of presence of all n leafs of a tree
+func datasetProofs(n int) ([]ProofTree, [][32]byte) {
+	leafs := make([][]byte, n)
+	for i := range leafs {
+		h := sha256.Sum256([]byte(strconv.Itoa(i)))
+		leafs[i] = h[:]
+	}
+	proofs := treeProofs(leafs)
+
+	hashes := make([][32]byte, n)
+	for i := range hashes {
+		hashes[i] = leafArray(leafs[i])
+	}
+	return proofs, hashes
+}
+
+// treeProofs returns the proofs of presence of the leafs in the tree over them, in leaf order
+func treeProofs(leafs [][]byte) []ProofTree {
+	n := len(leafs)
+	s := &subtreeRoots{leafs: leafs, roots: make(map[[2]int][]byte)}
+	rth := hex.EncodeToString(s.root(0, n))
+
+	proofs := make([]ProofTree, n)
+	for i := range proofs {
+		proofs[i] = ProofTree{RTH: rth, Root: s.presenceProof(0, n, i)}
+	}
+	return proofs
+}
+
+func TestVerifierCache(t *testing.T) {
+	proofs, leafs := datasetProofs(64)
+	a, b := NewVerifierCache(1<<10), NewVerifierCache(1<<10)
+	for i := range proofs {
+		if err := VerifyStableLeafCached(proofs[i], proofs[i], leafs[i], a, b); err != nil {
+			t.Fatalf("leaf %d: %v", i, err)
+		}
+	}
+
+	// forged proofs are still rejected through the warm caches
+	wrongLeaf := proofs[5]
+	wrongLeaf.Root = proofs[6].Root
+	if err := VerifyStableLeafCached(wrongLeaf, proofs[5], leafs[5], a, b); err == nil {
+		t.Error("proof of another leaf accepted")
+	}
+	forged := proofs[7]
+	forged.Root.Left = hashNode(leafs[0][:])
+	if err := VerifyStableLeafCached(forged, proofs[7], leafs[7], a, b); err == nil {
+		t.Error("proof with a forged sibling accepted")
+	}
+	otherRTH := proofs[8]
+	otherRTH.RTH = hex.EncodeToString(leafs[3][:])
+	if err := VerifyStableLeafCached(otherRTH, proofs[8], leafs[8], a, b); err == nil {
+		t.Error("proof against another RTH accepted")
+	}
+	if err := VerifyStableLeafCached(proofs[9], proofs[9], leafs[9], a, b); err != nil {
+		t.Errorf("leaf 9 after the cache was reset: %v", err)
+	}
+
+	// a full cache is emptied instead of growing
+	small := NewVerifierCache(16)
+	for i := range proofs {
+		if err := VerifyStableLeafCached(proofs[i], proofs[i], leafs[i], small, nil); err != nil {
+			t.Fatalf("leaf %d with a small cache: %v", i, err)
+		}
+		if n := len(small.decoded) + len(small.nodes); n > 16 {
+			t.Fatalf("cache holds %d hashes, at most 16 allowed", n)
+		}
+	}
+}
+
+// TestVerifyStableLeaf compares the proofs of presence of a leaf in two tree states
+func TestVerifyStableLeaf(t *testing.T) {
+	leafs := testLeafs(12)
+	leaf := leafArray(leafs[3])
+
+	// the old tree holds the first 8 leafs, an append-only log extends it to 12
+	old := treeProofs(leafs[:8])[3]
+	appended := treeProofs(leafs)[3]
+
+	// a rewritten history holding the leaf at index 4 instead
+	rewritten := append([][]byte(nil), leafs...)
+	rewritten[3], rewritten[4] = rewritten[4], rewritten[3]
+	moved := treeProofs(rewritten)[4]
+
+	withSize := func(p ProofTree, size uint64) ProofTree {
+		p.TreeSize = size
+		return p
+	}
+	withRecord := func(p ProofTree, record string) ProofTree {
+		p.Record = record
+		return p
+	}
+
+	tests := []struct {
+		name string
+		a, b ProofTree
+		want error
+	}{
+		{name: "appended", a: withSize(old, 8), b: withSize(appended, 12)},
+		{name: "same leaf at another index", a: withSize(old, 8), b: withSize(moved, 12), want: ErrLeafMoved},
+		{name: "same record values", a: withRecord(old, "record"), b: withRecord(appended, "record")},
+		{name: "different record values", a: withRecord(old, "record"), b: withRecord(appended, "other"), want: ErrLeafMoved},
+		// without both tree sizes only the presence of the leaf is compared, diff-proofs reports those
+		{name: "moved without tree sizes", a: old, b: withSize(moved, 12)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifyStableLeaf(tt.a, tt.b, leaf); err != tt.want {
+				t.Errorf("VerifyStableLeaf: %v, want %v", err, tt.want)
+			}
+			a, b := NewVerifierCache(1<<10), NewVerifierCache(1<<10)
+			if err := VerifyStableLeafCached(tt.a, tt.b, leaf, a, b); err != tt.want {
+				t.Errorf("VerifyStableLeafCached: %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkVerifyStableLeafCached verifies every leaf of a 2^14 leaf tree against itself, as
+// diff-proofs does for a dataset against a static tree
+func BenchmarkVerifyStableLeafCached(b *testing.B) {
+	proofs, leafs := datasetProofs(1 << 14)
+
+	b.Run("uncached", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for i := range proofs {
+				if err := VerifyStableLeaf(proofs[i], proofs[i], leafs[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			ca, cb := NewVerifierCache(1<<16), NewVerifierCache(1<<16)
+			for i := range proofs {
+				if err := VerifyStableLeafCached(proofs[i], proofs[i], leafs[i], ca, cb); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package prooftree
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Interop with RFC 6962 (Certificate Transparency) logs.
+//
+// A CT log proves inclusion with an audit path: the sibling hashes from the
+// leaf up to the root, plus the leaf index and tree size the path is for.
+// The service's ProofNode trees carry the same information in a different
+// shape: the path from the root to the leaf is spelled out, and every
+// sibling on it is a Hash node (or a subtree that reduces to one). Both logs
+// split a tree of n leafs after the largest power of two smaller than n, so
+// walking a ProofNode tree from the root yields the leaf index and the audit
+// path, see ServiceAuditPath.
+//
+// The mapping does not make the hashes interchangeable: CT logs hash
+// SHA-256(0x00 || leaf) and SHA-256(0x01 || left || right), the service
+// hashes the hex encoded child hashes without domain separation. Proofs must
+// be verified with the Hasher of the log that produced them.
+
+// Hasher computes the leaf and inner node hashes of a Merkle tree
+type Hasher interface {
+	HashLeaf(data []byte) []byte
+	HashChildren(l, r []byte) []byte
+}
+
+// RFC6962 hashes like a Certificate Transparency log
+var RFC6962 Hasher = rfc6962Hasher{}
+
+// ServiceTree hashes like the decryption service's log, leafs are logged ciphertexts
+var ServiceTree Hasher = serviceHasher{}
+
+type rfc6962Hasher struct{}
+
+func (rfc6962Hasher) HashLeaf(data []byte) []byte {
+	h := sha256.Sum256(append([]byte{0x00}, data...))
+	return h[:]
+}
+
+func (rfc6962Hasher) HashChildren(l, r []byte) []byte {
+	buf := append([]byte{0x01}, l...)
+	h := sha256.Sum256(append(buf, r...))
+	return h[:]
+}
+
+type serviceHasher struct{}
+
+func (serviceHasher) HashLeaf(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+func (serviceHasher) HashChildren(l, r []byte) []byte {
+	h := hashChildren(l, r)
+	return h[:]
+}
+
+// CTInclusionProof is an audit path as returned by a CT log's get-proof-by-hash
+type CTInclusionProof struct {
+	LeafIndex uint64   `json:"leaf_index"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// VerifyInclusion checks that the audit path proves leafHash at index in the tree of the given size and root.
+// This is the algorithm of RFC 9162 section 2.1.3.2, after checking that the index lies in [0, size)
+// and that the path has the length the index and size call for.
+func VerifyInclusion(h Hasher, leafHash []byte, index, size uint64, path [][]byte, root []byte) error {
+	if index >= size {
+		return fmt.Errorf("Inclusion proof: leaf index %d out of range for tree size %d", index, size)
+	}
+	if n := inclusionPathLength(index, size); len(path) != n {
+		return fmt.Errorf("Inclusion proof: audit path has %d hashes, leaf %d of a tree of size %d needs %d", len(path), index, size, n)
+	}
+
+	if len(leafHash) != sha256.Size {
+		return fmt.Errorf("Inclusion proof: leaf hash is %d bytes, want %d", len(leafHash), sha256.Size)
+	}
+	for i, p := range path {
+		if len(p) != sha256.Size {
+			return fmt.Errorf("Inclusion proof: audit path hash %d is %d bytes, want %d", i, len(p), sha256.Size)
+		}
+	}
+
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range path {
+		if fn&1 == 1 || fn == sn {
+			r = h.HashChildren(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = h.HashChildren(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if subtle.ConstantTimeCompare(r, root) != 1 {
+		return errors.New("Inclusion proof: computed root does not match")
+	}
+	return nil
+}
+
+// TreeHead returns the root of the tree over the leaf hashes, the hash of the empty string for an empty tree
+func TreeHead(h Hasher, leafHashes [][]byte) []byte {
+	switch len(leafHashes) {
+	case 0:
+		e := sha256.Sum256(nil)
+		return e[:]
+	case 1:
+		return leafHashes[0]
+	}
+
+	k := splitPoint(uint64(len(leafHashes)))
+	return h.HashChildren(TreeHead(h, leafHashes[:k]), TreeHead(h, leafHashes[k:]))
+}
+
+// AuditPath returns the audit path of the leaf at index in the tree over the leaf hashes,
+// as verified by VerifyInclusion (RFC 9162 section 2.1.3.1)
+func AuditPath(h Hasher, leafHashes [][]byte, index uint64) [][]byte {
+	if len(leafHashes) <= 1 {
+		return nil
+	}
+
+	k := splitPoint(uint64(len(leafHashes)))
+	if index < k {
+		return append(AuditPath(h, leafHashes[:k], index), TreeHead(h, leafHashes[k:]))
+	}
+	return append(AuditPath(h, leafHashes[k:], index-k), TreeHead(h, leafHashes[:k]))
+}
+
+// splitPoint returns the largest power of two smaller than n, the size of the left subtree of a tree of n leafs
+func splitPoint(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// inclusionPathLength returns the length of the audit path of the leaf at index in a tree of the given size:
+// one hash per level below the point where the paths to the leaf and to the last leaf split,
+// plus one per left sibling above it
+func inclusionPathLength(index, size uint64) int {
+	inner := bits.Len64(index ^ (size - 1))
+	border := bits.OnesCount64(index >> uint(inner))
+	return inner + border
+}
+
+// ServiceAuditPath maps a service proof tree onto an RFC 6962 audit path for the given leaf.
+// treeSize is the number of leafs in the tree the proof is for.
+func ServiceAuditPath(root ProofNode, leaf [32]byte, treeSize uint64) (index uint64, path [][]byte, err error) {
+	node := root
+	size := treeSize
+
+	for size > 1 {
+		if node.Left == nil || node.Right == nil {
+			return 0, nil, errors.New("Proof tree is shallower than the tree size")
+		}
+
+		k := splitPoint(size)
+
+		var leftOrder, rightOrder [][32]byte
+		l, err := ComputeRoot(*node.Left, &leftOrder)
+		if err != nil {
+			return 0, nil, err
+		}
+		r, err := ComputeRoot(*node.Right, &rightOrder)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		// descend towards the leaf, the other child is the sibling on the path
+		if ContainsHash(leftOrder, leaf) {
+			path = append([][]byte{r[:]}, path...)
+			node, size = *node.Left, k
+		} else if ContainsHash(rightOrder, leaf) {
+			path = append([][]byte{l[:]}, path...)
+			node, size = *node.Right, size-k
+			index += k
+		} else {
+			return 0, nil, errors.New("Leaf not present in proof tree")
+		}
+	}
+
+	if node.Left != nil || node.Right != nil {
+		return 0, nil, errors.New("Proof tree is deeper than the tree size")
+	}
+	return index, path, nil
+}
+
+// ContainsHash looks for e in s in constant time, without stopping at the first match.
+// Whether a proof holds a leaf decides whether the device decrypts, so the time taken
+// must not tell a caller where in the proof, or how closely, a forged hash matched.
+func ContainsHash(s [][32]byte, e [32]byte) bool {
+	found := 0
+	for _, a := range s {
+		found |= subtle.ConstantTimeCompare(a[:], e[:])
+	}
+	return found == 1
+}
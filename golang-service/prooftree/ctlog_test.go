@@ -0,0 +1,114 @@
+package prooftree
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestServiceAuditPath maps the proof trees of a service tree of 3 leafs onto audit paths, and
+// verifies the paths against the RTH of the tree
+func TestServiceAuditPath(t *testing.T) {
+	l := testLeafs(3)
+	a, b, c := l[0], l[1], l[2]
+	ab := ComputeRTH(l[:2])
+	root := ComputeRTH(l)
+
+	// the tree of 3 leafs is ((a,b),c), a proof tree spells out the path from the root to its leaf
+	full := ProofNode{Left: &ProofNode{Left: hashNode(a), Right: hashNode(b)}, Right: hashNode(c)}
+	toC := ProofNode{Left: hashNode(ab), Right: hashNode(c)}
+
+	tests := []struct {
+		proof ProofNode
+		leaf  []byte
+		index uint64
+		path  [][]byte
+	}{
+		{proof: full, leaf: a, index: 0, path: [][]byte{b, c}},
+		{proof: full, leaf: b, index: 1, path: [][]byte{a, c}},
+		{proof: toC, leaf: c, index: 2, path: [][]byte{ab}},
+	}
+
+	for _, tt := range tests {
+		index, path, err := ServiceAuditPath(tt.proof, leafArray(tt.leaf), 3)
+		if err != nil {
+			t.Fatalf("leaf %d: %v", tt.index, err)
+		}
+		if index != tt.index || !equalPaths(path, tt.path) {
+			t.Errorf("leaf %d: index %d path %x, want path %x", tt.index, index, path, tt.path)
+		}
+		if err := VerifyInclusion(ServiceTree, tt.leaf, index, 3, path, root); err != nil {
+			t.Errorf("leaf %d: %v", tt.index, err)
+		}
+	}
+
+	if _, _, err := ServiceAuditPath(toC, leafArray(a), 3); err == nil {
+		t.Error("audit path of a leaf the proof tree does not hold")
+	}
+	if _, _, err := ServiceAuditPath(full, leafArray(a), 2); err == nil {
+		t.Error("audit path of a proof tree deeper than its tree size")
+	}
+}
+
+// TestVerifyInclusionRFC6962 verifies audit paths of a CT log tree of 3 leafs, whose leafs and inner
+// nodes are hashed with domain separation, and checks that the service's hasher does not verify them
+func TestVerifyInclusionRFC6962(t *testing.T) {
+	h := RFC6962
+	a, b, c := h.HashLeaf([]byte("a")), h.HashLeaf([]byte("b")), h.HashLeaf([]byte("c"))
+	ab := h.HashChildren(a, b)
+	root := h.HashChildren(ab, c)
+
+	if err := VerifyInclusion(h, a, 0, 3, [][]byte{b, c}, root); err != nil {
+		t.Errorf("leaf 0: %v", err)
+	}
+	if err := VerifyInclusion(h, c, 2, 3, [][]byte{ab}, root); err != nil {
+		t.Errorf("leaf 2: %v", err)
+	}
+	if err := VerifyInclusion(ServiceTree, a, 0, 3, [][]byte{b, c}, root); err == nil {
+		t.Error("CT log audit path verified with the service hasher")
+	}
+}
+
+func equalPaths(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestVerifyInclusionBoundaries verifies the first and the last leaf of trees of several sizes, and
+// checks that an index outside [0, size), or a path for another index, is rejected
+func TestVerifyInclusionBoundaries(t *testing.T) {
+	for _, h := range []Hasher{RFC6962, ServiceTree} {
+		for _, size := range []uint64{1, 2, 3, 5, 8} {
+			leafs := testLeafs(int(size))
+			root := TreeHead(h, leafs)
+
+			for _, index := range []uint64{0, size - 1} {
+				path := AuditPath(h, leafs, index)
+				if err := VerifyInclusion(h, leafs[index], index, size, path, root); err != nil {
+					t.Errorf("%T: leaf %d of %d: %v", h, index, size, err)
+				}
+			}
+
+			last := AuditPath(h, leafs, size-1)
+			if err := VerifyInclusion(h, leafs[size-1], size, size, last, root); err == nil || !strings.Contains(err.Error(), "out of range") {
+				t.Errorf("%T: index %d of %d: %v, want out of range", h, size, size, err)
+			}
+			if size > 1 {
+				first := AuditPath(h, leafs, 0)
+				if err := VerifyInclusion(h, leafs[size-1], size-1, size, first, root); err == nil {
+					t.Errorf("%T: path of leaf 0 verified leaf %d of %d", h, size-1, size)
+				}
+				if err := VerifyInclusion(h, leafs[0], 0, size, first[:len(first)-1], root); err == nil || !strings.Contains(err.Error(), "audit path has") {
+					t.Errorf("%T: short path of leaf 0 of %d: %v, want a path length error", h, size, err)
+				}
+			}
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package prooftree
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"math/bits"
 )
 
 // ProofTree holds proof objects
@@ -12,6 +16,7 @@ type ProofTree struct {
 	Root     ProofNode `json:"Proof,omitempty"`
 	OldProof ProofNode `json:"OldProof,omitempty"`
 	NewProof ProofNode `json:"NewProof,omitempty"`
+	TreeSize uint64    `json:"TreeSize,omitempty"` // leafs in the tree of the proof (the new tree of a proof of extension), if known
 }
 
 // ProofNode represents a node in the Merkle-tree
@@ -28,8 +33,323 @@ func UnmarshalProofTree(s string) (t *ProofTree, err error) {
 	t = new(ProofTree)
 	err = json.Unmarshal([]byte(s), t)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return
 }
+
+// MaxProofDepth bounds the depth of any proof tree: the log cannot hold more than 2^64 leafs
+const MaxProofDepth = 64
+
+// MaxDepth returns the depth of the tree of the log with treeSize leafs, MaxProofDepth when the size is unknown (0).
+// The tree is split after the largest power of two, so no leaf is deeper than ceil(log2(treeSize)).
+func MaxDepth(treeSize uint64) int {
+	if treeSize == 0 {
+		return MaxProofDepth
+	}
+	return bits.Len64(treeSize - 1)
+}
+
+// ComputeRoot traverses the proof tree and returns the root hash.
+// The hashes of the visited leafs are appended to order, left to right.
+func ComputeRoot(node ProofNode, order *[][32]byte) ([32]byte, error) {
+	return ComputeRootDepth(node, order, MaxProofDepth)
+}
+
+// ComputeRootDepth is ComputeRoot for proof trees of at most maxDepth levels below the root.
+// The tree is walked iteratively, so a pathological proof cannot grow the stack, and a
+// proof deeper than maxDepth is rejected before any of its deeper nodes is hashed.
+func ComputeRootDepth(node ProofNode, order *[][32]byte, maxDepth int) ([32]byte, error) {
+	return computeRoot(node, order, maxDepth, nil)
+}
+
+// computeRoot walks the proof tree for ComputeRootDepth, looking the hashes up in the cache if it is not nil
+func computeRoot(node ProofNode, order *[][32]byte, maxDepth int, cache *VerifierCache) ([32]byte, error) {
+	type frame struct {
+		node    *ProofNode
+		depth   int
+		visited int // children pushed so far
+	}
+
+	var zero [32]byte
+	stack := []frame{{node: &node}}
+	var hashes [][32]byte // hashes of the completed subtrees, left to right
+
+	for len(stack) > 0 {
+		f := &stack[len(stack)-1]
+		n := f.node
+
+		if n.Hash != "" {
+			var h [32]byte
+			var err error
+			if cache != nil {
+				h, err = cache.decodeHash(n.Hash)
+			} else {
+				h, err = decodeHash(n.Hash)
+			}
+			if err != nil {
+				return zero, err
+			}
+
+			*order = append(*order, h)
+			hashes = append(hashes, h)
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		if n.Left == nil || n.Right == nil {
+			return zero, errors.New("Proof node has neither a hash nor two children")
+		}
+		if f.depth >= maxDepth {
+			return zero, fmt.Errorf("Proof tree is deeper than %d levels", maxDepth)
+		}
+
+		switch f.visited {
+		case 0:
+			f.visited++
+			stack = append(stack, frame{node: n.Left, depth: f.depth + 1})
+		case 1:
+			f.visited++
+			stack = append(stack, frame{node: n.Right, depth: f.depth + 1})
+		default:
+			l, r := hashes[len(hashes)-2], hashes[len(hashes)-1]
+			var h [32]byte
+			if cache != nil {
+				h = cache.hashChildren(l, r)
+			} else {
+				h = hashChildren(l[:], r[:])
+			}
+			hashes = append(hashes[:len(hashes)-2], h)
+			stack = stack[:len(stack)-1]
+		}
+	}
+
+	return hashes[0], nil
+}
+
+// ComputeRTH builds the Merkle tree over the full list of leafs and returns its root hash.
+// Leafs are the sha256 hashes of the logged ciphertexts, in log order.
+// The tree is split like the log's: the left subtree holds the largest power of two
+// smaller than the number of leafs, so odd leafs are never duplicated or padded.
+// The root of an empty tree is sha256(""), the device's initial RTH.
+func ComputeRTH(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		h := sha256.Sum256([]byte(""))
+		return h[:]
+	}
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+
+	k := 1
+	for k<<1 < len(leaves) {
+		k <<= 1
+	}
+
+	h := hashChildren(ComputeRTH(leaves[:k]), ComputeRTH(leaves[k:]))
+	return h[:]
+}
+
+// hashChildren computes the hash of an inner node from the hashes of its children
+func hashChildren(l, r []byte) [32]byte {
+	// hack  to comply with Dom's hash tree
+	// TODO: Dom should hash the byte array, not the hex encoded string..
+	ls := hex.EncodeToString(l)
+	rs := hex.EncodeToString(r)
+	buf := []byte(ls + rs)
+
+	// buf := append(l[:], r[:]...)
+
+	return sha256.Sum256(buf)
+}
+
+// VerifyExtension checks that the new proof extends the old one, and returns both root hashes
+func VerifyExtension(p ProofTree) (oldRTH, newRTH [32]byte, err error) {
+
+	// Presence lists
+	var oldOrder [][32]byte
+	var newOrder [][32]byte
+
+	// Compute old and new RTH, the old tree is no larger than the new one
+	depth := MaxDepth(p.TreeSize)
+	if oldRTH, err = ComputeRootDepth(p.OldProof, &oldOrder, depth); err != nil {
+		return
+	}
+	if newRTH, err = ComputeRootDepth(p.NewProof, &newOrder, depth); err != nil {
+		return
+	}
+
+	// Check that oldOrder is a subset of newOrder
+	if len(oldOrder) > len(newOrder) {
+		err = errors.New("Old proof is not a subset of new proof")
+		return
+	}
+	for i, v := range oldOrder {
+		if v != newOrder[i] {
+			err = errors.New("Old proof is not a subset of new proof")
+			return
+		}
+	}
+
+	return oldRTH, newRTH, nil
+}
+
+// VerifyAppended checks that the leaf is among the leafs the proof of extension appends to the old tree
+func VerifyAppended(p ProofTree, leaf [32]byte) error {
+	var oldOrder [][32]byte
+	var newOrder [][32]byte
+
+	depth := MaxDepth(p.TreeSize)
+	if _, err := ComputeRootDepth(p.OldProof, &oldOrder, depth); err != nil {
+		return err
+	}
+	if _, err := ComputeRootDepth(p.NewProof, &newOrder, depth); err != nil {
+		return err
+	}
+	if len(oldOrder) > len(newOrder) {
+		return errors.New("Old proof is not a subset of new proof")
+	}
+
+	for _, v := range newOrder[len(oldOrder):] {
+		if v == leaf {
+			return nil
+		}
+	}
+	return errors.New("Record is not appended by the proof of extension")
+}
+
+// ErrLeafMismatch is returned when the proofs of presence and extension are not for the same leaf
+var ErrLeafMismatch = errors.New("Proofs of presence and extension reference different leafs")
+
+// VerifySameLeaf checks that the proof of presence and the proof of extension are both for the leaf:
+// the record values they declare are equal, the leaf is in the new tree of the extension, and when
+// the extension declares its tree size, the leaf has the same index in both trees
+func VerifySameLeaf(pop, poe ProofTree, leaf [32]byte) error {
+	if pop.Record != "" && poe.Record != "" && pop.Record != poe.Record {
+		return ErrLeafMismatch
+	}
+
+	var newOrder [][32]byte
+	if _, err := ComputeRoot(poe.NewProof, &newOrder); err != nil {
+		return err
+	}
+	if !ContainsHash(newOrder, leaf) {
+		return ErrLeafMismatch
+	}
+
+	if poe.TreeSize == 0 {
+		return nil
+	}
+	popIndex, _, err := ServiceAuditPath(pop.Root, leaf, poe.TreeSize)
+	if err != nil {
+		return err
+	}
+	poeIndex, _, err := ServiceAuditPath(poe.NewProof, leaf, poe.TreeSize)
+	if err != nil {
+		return err
+	}
+	if popIndex != poeIndex {
+		return ErrLeafMismatch
+	}
+	return nil
+}
+
+// ErrLeafMoved is returned when two proofs of presence place the same leaf differently
+var ErrLeafMoved = errors.New("Leaf differs between the proofs, the log history was rewritten")
+
+// VerifyStableLeaf checks that two proofs of presence of the leaf against different tree states agree on it.
+// In an append-only log a leaf never changes: both proofs must verify against their declared RTH and
+// contain the leaf, the record values they declare must be equal, and when both declare their
+// tree size, the leaf must have the same index in both trees.
+func VerifyStableLeaf(a, b ProofTree, leaf [32]byte) error {
+	return VerifyStableLeafCached(a, b, leaf, nil, nil)
+}
+
+// VerifyStableLeafCached is VerifyStableLeaf computing the roots of a and b with the caches of
+// their tree states, when they are not nil. A proof without a declared RTH is verified uncached.
+func VerifyStableLeafCached(a, b ProofTree, leaf [32]byte, cacheA, cacheB *VerifierCache) error {
+	if err := verifyPresence(a, leaf, cacheA); err != nil {
+		return err
+	}
+	if err := verifyPresence(b, leaf, cacheB); err != nil {
+		return err
+	}
+
+	if a.Record != "" && b.Record != "" && a.Record != b.Record {
+		return ErrLeafMoved
+	}
+
+	if a.TreeSize == 0 || b.TreeSize == 0 {
+		return nil
+	}
+	indexA, _, err := ServiceAuditPath(a.Root, leaf, a.TreeSize)
+	if err != nil {
+		return err
+	}
+	indexB, _, err := ServiceAuditPath(b.Root, leaf, b.TreeSize)
+	if err != nil {
+		return err
+	}
+	if indexA != indexB {
+		return ErrLeafMoved
+	}
+	return nil
+}
+
+// verifyPresence checks that the proof of presence verifies against its declared RTH, if any, and contains the leaf
+func verifyPresence(p ProofTree, leaf [32]byte, cache *VerifierCache) error {
+	var order [][32]byte
+	if p.RTH == "" {
+		if _, err := ComputeRoot(p.Root, &order); err != nil {
+			return err
+		}
+	} else {
+		declared, err := hex.DecodeString(p.RTH)
+		if err != nil {
+			return err
+		}
+		rth, err := SliceToHash(declared)
+		if err != nil {
+			return err
+		}
+		var root [32]byte
+		if cache != nil {
+			root, err = cache.ComputeRoot(rth, p.Root, &order, MaxProofDepth)
+		} else {
+			root, err = ComputeRoot(p.Root, &order)
+		}
+		if err != nil {
+			return err
+		}
+		if root != rth {
+			return errors.New("Proof of presence does not match its declared RTH")
+		}
+	}
+	if !ContainsHash(order, leaf) {
+		return errors.New("Leaf not present in proof tree")
+	}
+	return nil
+}
+
+// decodeHash decodes the hex encoded hash of a proof node
+func decodeHash(s string) ([32]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return SliceToHash(b)
+}
+
+// SliceToHash copies a hash slice to an array.
+// The slice must be exactly a SHA-256 hash: a shorter hash padded with zeros, or a longer one cut off,
+// would still give a root, so a malformed proof could verify against some other tree.
+func SliceToHash(slice []byte) (hash [32]byte, err error) {
+	if len(slice) != len(hash) {
+		err = fmt.Errorf("SliceToHash: hash is %d bytes, want %d", len(slice), len(hash))
+		return
+	}
+
+	copy(hash[:], slice)
+	return
+}
@@ -0,0 +1,184 @@
+package prooftree
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// testLeafs returns the hashes of n logged ciphertexts
+func testLeafs(n int) [][]byte {
+	leafs := make([][]byte, n)
+	for i := range leafs {
+		h := sha256.Sum256([]byte{byte(i)})
+		leafs[i] = h[:]
+	}
+	return leafs
+}
+
+func hashNode(h []byte) *ProofNode {
+	return &ProofNode{Hash: hex.EncodeToString(h)}
+}
+
+func leafArray(h []byte) (leaf [32]byte) {
+	copy(leaf[:], h)
+	return leaf
+}
+
+func TestVerifySameLeaf(t *testing.T) {
+	l := testLeafs(3)
+	a, b, c := l[0], l[1], l[2]
+	ab := ComputeRTH(l[:2])
+
+	// the tree of 3 leafs is ((a,b),c), the extension from the tree of a and b appends c
+	full := ProofNode{Left: &ProofNode{Left: hashNode(a), Right: hashNode(b)}, Right: hashNode(c)}
+	appendC := ProofNode{Left: hashNode(ab), Right: hashNode(c)}
+	swapped := ProofNode{Left: &ProofNode{Left: hashNode(b), Right: hashNode(a)}, Right: hashNode(c)}
+
+	tests := []struct {
+		name    string
+		pop     ProofTree
+		poe     ProofTree
+		leaf    []byte
+		wantErr error
+	}{
+		{
+			name: "same leaf",
+			pop:  ProofTree{Root: full},
+			poe:  ProofTree{OldProof: *hashNode(ab), NewProof: full, TreeSize: 3},
+			leaf: a,
+		},
+		{
+			name: "same leaf, no tree size",
+			pop:  ProofTree{Root: full},
+			poe:  ProofTree{OldProof: *hashNode(ab), NewProof: full},
+			leaf: a,
+		},
+		{
+			name:    "extension for another leaf",
+			pop:     ProofTree{Root: full},
+			poe:     ProofTree{OldProof: *hashNode(ab), NewProof: appendC, TreeSize: 3},
+			leaf:    a,
+			wantErr: ErrLeafMismatch,
+		},
+		{
+			name:    "leaf at another index",
+			pop:     ProofTree{Root: full},
+			poe:     ProofTree{OldProof: *hashNode(ab), NewProof: swapped, TreeSize: 3},
+			leaf:    a,
+			wantErr: ErrLeafMismatch,
+		},
+		{
+			name:    "different record values",
+			pop:     ProofTree{Root: full, Record: "A"},
+			poe:     ProofTree{OldProof: *hashNode(ab), NewProof: full, TreeSize: 3, Record: "B"},
+			leaf:    a,
+			wantErr: ErrLeafMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := VerifySameLeaf(tt.pop, tt.poe, leafArray(tt.leaf)); err != tt.wantErr {
+				t.Fatalf("VerifySameLeaf: %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestComputeRTH checks the roots of the trees over the first leafs of testLeafs. The vectors were
+// computed independently of the package: inner nodes hash the hex encoded child hashes, and a tree
+// of n leafs is split after the largest power of two smaller than n.
+func TestComputeRTH(t *testing.T) {
+	tests := []struct {
+		leafs int
+		want  string
+	}{
+		{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"}, // sha256("")
+		{1, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"}, // the leaf itself
+		{2, "f1760081a911722f089886e61aedc65a8e19065908c2ca8562458f2670de86fe"},
+		{3, "0320be426f2a0174b1636993ab6130c4c372a3b5fd766498e09fffa52363ea06"},
+		{5, "253d3b925dea8bfe2a57678c8ee8ce884acb5eae2e2c1163c573f55d3b6d721b"},
+		{8, "e6961b67d9a22e7615a52ac57ed50f04ead7e7227dae2467ee61fc36a1a9d046"},
+	}
+
+	for _, tt := range tests {
+		if got := hex.EncodeToString(ComputeRTH(testLeafs(tt.leafs))); got != tt.want {
+			t.Errorf("ComputeRTH of %d leafs: %s, want %s", tt.leafs, got, tt.want)
+		}
+	}
+}
+
+// TestSiblingHashLength checks that a sibling hash one byte short or long is rejected, by the
+// service proof trees and by the audit paths of VerifyInclusion
+func TestSiblingHashLength(t *testing.T) {
+	l := testLeafs(2)
+	a, b := l[0], l[1]
+
+	for _, sibling := range [][]byte{b[:31], append(append([]byte(nil), b...), 0)} {
+		var order [][32]byte
+		if _, err := ComputeRoot(ProofNode{Left: hashNode(a), Right: hashNode(sibling)}, &order); err == nil {
+			t.Errorf("ComputeRoot accepted a %d byte sibling", len(sibling))
+		}
+
+		for _, h := range []Hasher{RFC6962, ServiceTree} {
+			root := TreeHead(h, l)
+			if err := VerifyInclusion(h, a, 0, 2, [][]byte{sibling}, root); err == nil {
+				t.Errorf("%T: VerifyInclusion accepted a %d byte sibling", h, len(sibling))
+			}
+		}
+	}
+}
+
+// chainProof returns a proof tree with a leaf at every level down to the given depth
+func chainProof(depth int) ProofNode {
+	leaf := *hashNode(testLeafs(1)[0])
+	node := leaf
+	for i := 0; i < depth; i++ {
+		l, r := leaf, node
+		node = ProofNode{Left: &l, Right: &r}
+	}
+	return node
+}
+
+// TestProofDepth checks that a proof deeper than its tree size allows is rejected, and that the
+// iterative walk rejects a pathological proof without growing the stack
+func TestProofDepth(t *testing.T) {
+	for _, size := range []uint64{2, 3, 5, 8, 1 << 20} {
+		depth := MaxDepth(size)
+		var order [][32]byte
+		if _, err := ComputeRootDepth(chainProof(depth), &order, depth); err != nil {
+			t.Errorf("proof of depth %d for tree size %d: %v", depth, size, err)
+		}
+		if _, err := ComputeRootDepth(chainProof(depth+1), &order, depth); err == nil {
+			t.Errorf("proof of depth %d accepted for tree size %d", depth+1, size)
+		}
+	}
+
+	var order [][32]byte
+	if _, err := ComputeRoot(chainProof(1000000), &order); err == nil {
+		t.Error("proof a million levels deep accepted")
+	}
+	if len(order) > MaxProofDepth+1 {
+		t.Errorf("%d leafs hashed before the over-deep proof was rejected", len(order))
+	}
+
+	// the extension declares the size of its tree, which bounds both proofs
+	poe := ProofTree{OldProof: chainProof(2), NewProof: chainProof(4), TreeSize: 8}
+	if _, _, err := VerifyExtension(poe); err == nil {
+		t.Error("extension deeper than its declared tree size accepted")
+	}
+}
+
+func TestContainsHash(t *testing.T) {
+	l := testLeafs(4)
+	s := [][32]byte{leafArray(l[0]), leafArray(l[1]), leafArray(l[0])}
+	for i, want := range []bool{true, true, false, false} {
+		if got := ContainsHash(s, leafArray(l[i])); got != want {
+			t.Errorf("ContainsHash of leaf %d: %v, want %v", i, got, want)
+		}
+	}
+	if ContainsHash(nil, leafArray(l[0])) {
+		t.Error("empty list contains a hash")
+	}
+}
@@ -0,0 +1,131 @@
+package rthsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Signature format versions, as sent in RootTreeHashRequest and RootTreeHash
+const (
+	Legacy    = 1 // sha256(rth || nonce)
+	Canonical = 2 // sha256 of CanonicalSignedBytes
+)
+
+// domain separates the canonical RTH signature from other signatures of the key
+const domain = "sgx-decryption-service RTH v2"
+
+// CanonicalSignedBytes serializes the signed fields of a root tree hash.
+// Variable length fields are prefixed with their length, so no two distinct
+// sets of fields serialize to the same bytes.
+func CanonicalSignedBytes(rth, nonce []byte, treeSize uint64, timestamp int64) []byte {
+	buf := make([]byte, 0, len(domain)+8+len(rth)+8+len(nonce)+16)
+	buf = appendBytes(buf, []byte(domain))
+	buf = appendBytes(buf, rth)
+	buf = appendBytes(buf, nonce)
+	buf = appendUint64(buf, treeSize)
+	buf = appendUint64(buf, uint64(timestamp))
+	return buf
+}
+
+// LegacySignedBytes is the concatenation of rth and nonce signed by devices
+// that predate the canonical format
+func LegacySignedBytes(rth, nonce []byte) []byte {
+	buf := make([]byte, 0, len(rth)+len(nonce))
+	buf = append(buf, rth...)
+	return append(buf, nonce...)
+}
+
+// Digest returns the sha256 digest signed for the given format version.
+// Versions other than Canonical use the legacy format, which signs neither tree size nor timestamp.
+func Digest(version uint32, rth, nonce []byte, treeSize uint64, timestamp int64) [32]byte {
+	if version == Canonical {
+		return sha256.Sum256(CanonicalSignedBytes(rth, nonce, treeSize, timestamp))
+	}
+	return sha256.Sum256(LegacySignedBytes(rth, nonce))
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = appendUint64(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// historyDomain separates the signature over an RTH history from the other signatures of the key
+const historyDomain = "sgx-decryption-service RTH history v1"
+
+// History is a run of consecutive RTHs the device has held, covered by one signature
+type History struct {
+	Start     uint64   // position of the first RTH in the device's history, the initial RTH is at 0
+	RTHs      [][]byte // RTHs in the order the device held them
+	TreeSizes []uint64 // tree size of every RTH, 0 when unknown
+	Nonce     []byte
+	Timestamp int64
+}
+
+// SignedBytes serializes the history for its aggregate signature, length-prefixed like CanonicalSignedBytes
+func (h *History) SignedBytes() []byte {
+	buf := appendBytes(nil, []byte(historyDomain))
+	buf = appendBytes(buf, h.Nonce)
+	buf = appendUint64(buf, uint64(h.Timestamp))
+	buf = appendUint64(buf, h.Start)
+	buf = appendUint64(buf, uint64(len(h.RTHs)))
+	for i, rth := range h.RTHs {
+		buf = appendBytes(buf, rth)
+		buf = appendUint64(buf, h.TreeSizes[i])
+	}
+	return buf
+}
+
+// Verify checks the aggregate signature over the history, and every RTH in it:
+// each is a sha256 hash with a tree size, consecutive RTHs differ, and known tree sizes never shrink
+func (h *History) Verify(pub *rsa.PublicKey, sig []byte) error {
+	if len(h.TreeSizes) != len(h.RTHs) {
+		return fmt.Errorf("RTH history has %d RTHs but %d tree sizes", len(h.RTHs), len(h.TreeSizes))
+	}
+
+	var lastSize uint64
+	for i, rth := range h.RTHs {
+		if len(rth) != sha256.Size {
+			return fmt.Errorf("RTH %d of the history is %d bytes, not a sha256 hash", h.Start+uint64(i), len(rth))
+		}
+		if i > 0 && bytes.Equal(rth, h.RTHs[i-1]) {
+			return fmt.Errorf("RTH %d of the history repeats the previous RTH", h.Start+uint64(i))
+		}
+		if size := h.TreeSizes[i]; size != 0 {
+			if size < lastSize {
+				return fmt.Errorf("tree size of RTH %d of the history shrinks from %d to %d", h.Start+uint64(i), lastSize, size)
+			}
+			lastSize = size
+		}
+	}
+
+	digest := sha256.Sum256(h.SignedBytes())
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+}
+
+// challengeDomain separates the signature answering a decryption challenge from the other signatures of the key
+const challengeDomain = "sgx-decryption-service decryption challenge v1"
+
+// ChallengeSignedBytes serializes what the device signs to answer the challenge of a decryption
+// request: the challenge, the hash of the ciphertext and the tag over the plaintext
+func ChallengeSignedBytes(challenge []byte, ctSum [32]byte, tag []byte) []byte {
+	buf := appendBytes(nil, []byte(challengeDomain))
+	buf = appendBytes(buf, challenge)
+	buf = appendBytes(buf, ctSum[:])
+	return appendBytes(buf, tag)
+}
+
+// VerifyChallenge checks the signature answering the challenge of a decryption request
+func VerifyChallenge(pub *rsa.PublicKey, challenge []byte, ctSum [32]byte, tag, sig []byte) error {
+	digest := sha256.Sum256(ChallengeSignedBytes(challenge, ctSum, tag))
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+}
@@ -0,0 +1,140 @@
+package rthsig
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// TestCanonicalSignedBytesGolden pins the serialization both the device and the clients sign and verify
+func TestCanonicalSignedBytesGolden(t *testing.T) {
+	want := "000000000000001d" + hex.EncodeToString([]byte(domain)) + // domain
+		"0000000000000002" + "0102" + // rth
+		"0000000000000003" + "6e6f6e" + // nonce
+		"0000000000000005" + // tree size
+		"fffffffffffffffe" // timestamp -2
+	if got := hex.EncodeToString(CanonicalSignedBytes([]byte{1, 2}, []byte("non"), 5, -2)); got != want {
+		t.Errorf("CanonicalSignedBytes = %s, want %s", got, want)
+	}
+	if got := hex.EncodeToString(LegacySignedBytes([]byte{1, 2}, []byte("non"))); got != "01026e6f6e" {
+		t.Errorf("LegacySignedBytes = %s, want 01026e6f6e", got)
+	}
+}
+
+// TestCanonicalSignedBytesBoundary moves a byte from the nonce to the RTH: the legacy concatenation
+// cannot tell the two apart, the canonical serialization can
+func TestCanonicalSignedBytesBoundary(t *testing.T) {
+	rth, nonce := []byte("rth"), []byte("nonce")
+	movedRTH, movedNonce := []byte("rthn"), []byte("once")
+
+	if Digest(Legacy, rth, nonce, 0, 0) != Digest(Legacy, movedRTH, movedNonce, 0, 0) {
+		t.Error("legacy digests differ, the test does not move the boundary")
+	}
+	if Digest(Canonical, rth, nonce, 7, 1) == Digest(Canonical, movedRTH, movedNonce, 7, 1) {
+		t.Error("canonical digest unchanged when bytes move from the nonce to the RTH")
+	}
+	if Digest(Canonical, rth, nonce, 7, 1) == Digest(Canonical, rth, nonce, 8, 1) {
+		t.Error("canonical digest does not cover the tree size")
+	}
+	if Digest(Canonical, rth, nonce, 7, 1) == Digest(Canonical, rth, nonce, 7, 2) {
+		t.Error("canonical digest does not cover the timestamp")
+	}
+}
+
+// testHistory returns a history of n consecutive RTHs with growing tree sizes
+func testHistory(n int) *History {
+	h := &History{Start: 3, Nonce: []byte("nonce"), Timestamp: 1500000000}
+	for i := 0; i < n; i++ {
+		rth := sha256.Sum256([]byte{byte(i)})
+		h.RTHs = append(h.RTHs, rth[:])
+		h.TreeSizes = append(h.TreeSizes, uint64(i+1))
+	}
+	return h
+}
+
+func signHistory(t *testing.T, key *rsa.PrivateKey, h *History) []byte {
+	t.Helper()
+	digest := sha256.Sum256(h.SignedBytes())
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestHistoryVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tamper  func(h *History) // applied before signing
+		after   func(h *History) // applied after signing
+		signer  *rsa.PrivateKey
+		wantErr bool
+	}{
+		{name: "valid"},
+		{name: "unknown tree size", tamper: func(h *History) { h.TreeSizes[1] = 0 }},
+		{name: "missing tree size", after: func(h *History) { h.TreeSizes = h.TreeSizes[:2] }, wantErr: true},
+		{name: "short RTH", tamper: func(h *History) { h.RTHs[1] = h.RTHs[1][:31] }, wantErr: true},
+		{name: "repeated RTH", tamper: func(h *History) { h.RTHs[2] = h.RTHs[1] }, wantErr: true},
+		{name: "shrinking tree size", tamper: func(h *History) { h.TreeSizes[2] = 1 }, wantErr: true},
+		{name: "shrinking past an unknown size", tamper: func(h *History) { h.TreeSizes[0], h.TreeSizes[1], h.TreeSizes[2] = 3, 0, 2 }, wantErr: true},
+		{name: "other key", signer: other, wantErr: true},
+		{name: "RTH swapped after signing", after: func(h *History) { h.RTHs[0], h.RTHs[1] = h.RTHs[1], h.RTHs[0] }, wantErr: true},
+		{name: "start moved after signing", after: func(h *History) { h.Start++ }, wantErr: true},
+		{name: "nonce changed after signing", after: func(h *History) { h.Nonce = []byte("other") }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := testHistory(3)
+			if tt.tamper != nil {
+				tt.tamper(h)
+			}
+			signer := key
+			if tt.signer != nil {
+				signer = tt.signer
+			}
+			sig := signHistory(t, signer, h)
+			if tt.after != nil {
+				tt.after(h)
+			}
+
+			err := h.Verify(&key.PublicKey, sig)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify: %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyChallenge(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctSum := sha256.Sum256([]byte("ciphertext"))
+	tag := sha256.Sum256([]byte("plaintext"))
+	digest := sha256.Sum256(ChallengeSignedBytes([]byte("challenge"), ctSum, tag[:]))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = VerifyChallenge(&key.PublicKey, []byte("challenge"), ctSum, tag[:], sig); err != nil {
+		t.Errorf("answer to the challenge: %v", err)
+	}
+	if err = VerifyChallenge(&key.PublicKey, []byte("another challenge"), ctSum, tag[:], sig); err == nil {
+		t.Error("answer to another challenge accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+)
+
+// ExternalLog is an append-only log outside the enclave the RTHs are anchored in.
+// Clients check the inclusion of an RTH against a tree head of the log they got
+// independently, so an enclave showing different RTHs to different clients is detected.
+// Leafs are RTHs, hashed as RFC 6962 leafs.
+type ExternalLog interface {
+	// Append logs the RTH, an RTH already in the log is not appended again
+	Append(rth []byte) error
+
+	// InclusionProof returns the leaf index and audit path of the RTH in the tree of the given size,
+	// or in the current tree when treeSize is 0, along with the size of the tree
+	InclusionProof(rth []byte, treeSize uint64) (index, size uint64, path [][]byte, err error)
+}
+
+// memoryLog is an ExternalLog kept in memory, for development only:
+// it lives in the same process as the device and anchors nothing
+type memoryLog struct {
+	mu     sync.Mutex
+	leafs  [][]byte          // RFC 6962 leaf hashes in log order
+	index  map[string]uint64 // leaf index by RTH
+	hasher pt.Hasher
+}
+
+func newMemoryLog() *memoryLog {
+	return &memoryLog{index: make(map[string]uint64), hasher: pt.RFC6962}
+}
+
+func (l *memoryLog) Append(rth []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.index[string(rth)]; ok {
+		return nil
+	}
+	l.index[string(rth)] = uint64(len(l.leafs))
+	l.leafs = append(l.leafs, l.hasher.HashLeaf(rth))
+	return nil
+}
+
+func (l *memoryLog) InclusionProof(rth []byte, treeSize uint64) (index, size uint64, path [][]byte, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	index, ok := l.index[string(rth)]
+	if !ok {
+		return 0, 0, nil, errors.New("RTH is not in the external log")
+	}
+
+	size = treeSize
+	if size == 0 {
+		size = uint64(len(l.leafs))
+	}
+	if size > uint64(len(l.leafs)) {
+		return 0, 0, nil, fmt.Errorf("External log has no tree of size %d, it holds %d RTHs", size, len(l.leafs))
+	}
+	if index >= size {
+		return 0, 0, nil, fmt.Errorf("RTH was logged after the tree of size %d", size)
+	}
+	return index, size, pt.AuditPath(l.hasher, l.leafs[:size], index), nil
+}
@@ -1,44 +1,215 @@
 package main
 
 import (
+	"container/list"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/sewelol/sgx-decryption-service/clock"
 	pb "github.com/sewelol/sgx-decryption-service/decryptionservice"
 	dev "github.com/sewelol/sgx-decryption-service/device"
+	"github.com/sewelol/sgx-decryption-service/proofcodec"
 	pt "github.com/sewelol/sgx-decryption-service/prooftree"
+	"github.com/sewelol/sgx-decryption-service/rthsig"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
 )
 
 const (
-	port = ":50051"
+	port         = ":50051"
+	maxChunkSize = 128  // max plaintext bytes returned in a single Record
+	maxHistory   = 4096 // max RTHs returned in a single RootTreeHashHistory
+
+	// Bounds on the partial records held for continuation tokens: a client that never asks for
+	// the rest of a plaintext must not make the server hold it forever
+	pendingTTL          = time.Minute // a continuation token expires this long after it was issued
+	maxPending          = 1024        // the oldest partial record is evicted when a new one exceeds this
+	maxPendingPerClient = 64          // the oldest partial record of a client is evicted when its new one exceeds this
 )
 
 // Decryption device
 var d dev.Device
 
+// anchorLog anchors the RTHs in an in-memory external log, see ExternalLog
+var anchorLog = flag.Bool("anchor-log", false, "anchor every served RTH in an in-memory external log (development only)")
+
+// debugTimings returns the internal timings of a decryption to clients asking for them
+var debugTimings = flag.Bool("debug-timings", false, "return the time spent decoding and verifying the proofs and decrypting to clients that ask (debugging only, it tells callers where the enclave spends its time)")
+
+// The server speaks TLS when given a certificate
+var (
+	tlsCert = flag.String("tls-cert", "", "PEM file with the server certificate chain, serve plaintext when empty")
+	tlsKey  = flag.String("tls-key", "", "PEM file with the private key of -tls-cert")
+)
+
 // server is used to implement helloworld.GreeterServer.
-type server struct{}
+type server struct {
+	mu      sync.Mutex
+	pending *pendingRecords // plaintext not yet returned, by continuation token
+	anchors ExternalLog     // log the served RTHs are anchored in, nil if none
+	clock   clock.Clock     // time the continuation tokens expire by
+}
+
+func newServer(c clock.Clock) *server {
+	return &server{pending: newPendingRecords(), clock: c}
+}
+
+// partialRecord holds the remainder of a plaintext that did not fit in one Record
+type partialRecord struct {
+	ctSum [32]byte // hash of the ciphertext the continuation token was issued for
+	rest  []byte   // plaintext chunks not yet returned
+	tag   []byte   // sha256 over the full plaintext
+	sig   []byte   // device's answer to the challenge of the request, nil if it had none
+
+	client     string        // host the record was decrypted for, see clientHost
+	token      string        // current continuation token
+	issued     time.Time     // when the current continuation token was issued
+	elem       *list.Element // of the record in pendingRecords.order
+	clientElem *list.Element // of the record in the list of its client
+}
 
 func (s *server) DecryptRecord(ctx context.Context, in *pb.DecryptionRequest) (*pb.Record, error) {
 
-	popTree, err := pt.UnmarshalProofTree(in.ProofOfPresence)
-	poeTree, err := pt.UnmarshalProofTree(in.ProofOfExtension)
+	if in.ContinuationToken != "" {
+		return s.nextChunk(in.Ciphertext, in.ContinuationToken)
+	}
 
-	pt, err := d.Decrypt(in.Ciphertext, *popTree, *poeTree)
+	start := time.Now()
+	popTree, poeTree, err := requestProofs(in)
+	if err != nil {
+		return nil, err
+	}
+	decode := time.Since(start)
 
-	return &pb.Record{Plaintext: pt}, err
+	var pt, sig []byte
+	var t dev.Timings
+	if len(in.Challenge) > 0 {
+		pt, sig, t, err = d.DecryptChallenge(in.Challenge, in.Ciphertext, *popTree, *poeTree, in.BaselineRth)
+	} else {
+		pt, t, err = d.DecryptTimed(in.Ciphertext, *popTree, *poeTree, in.BaselineRth)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tag := sha256.Sum256(pt)
+	p := &partialRecord{ctSum: sha256.Sum256(in.Ciphertext), rest: pt, tag: tag[:], sig: sig, client: clientHost(ctx)}
+	r := s.chunk(p)
+	if *debugTimings && in.Timings {
+		r.Timings = &pb.Timings{ProofDecode: int64(decode), ProofVerification: int64(t.ProofVerification), Decryption: int64(t.Decryption)}
+	}
+	return r, nil
+}
+
+// requestProofs decodes the proofs of a request, sent as JSON strings or, with a proofEncoding, in the encoded fields
+func requestProofs(in *pb.DecryptionRequest) (pop, poe *pt.ProofTree, err error) {
+	if in.ProofEncoding == "" {
+		if pop, err = pt.UnmarshalProofTree(in.ProofOfPresence); err != nil {
+			return nil, nil, err
+		}
+		if poe, err = pt.UnmarshalProofTree(in.ProofOfExtension); err != nil {
+			return nil, nil, err
+		}
+		return pop, poe, nil
+	}
+
+	codec, err := proofcodec.ByName(in.ProofEncoding)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pop, err = codec.Unmarshal(in.EncodedProofOfPresence); err != nil {
+		return nil, nil, err
+	}
+	if poe, err = codec.Unmarshal(in.EncodedProofOfExtension); err != nil {
+		return nil, nil, err
+	}
+	return pop, poe, nil
+}
+
+// nextChunk returns the next part of a partial record issued for the given ciphertext
+func (s *server) nextChunk(ciphertext []byte, token string) (*pb.Record, error) {
+	s.mu.Lock()
+	p := s.pending.take(token)
+	s.mu.Unlock()
+
+	if p == nil || p.ctSum != sha256.Sum256(ciphertext) {
+		return nil, errors.New("Unknown continuation token")
+	}
+	if s.clock.Now().Sub(p.issued) > pendingTTL {
+		return nil, errors.New("Continuation token expired")
+	}
+	return s.chunk(p), nil
+}
+
+// chunk returns at most maxChunkSize bytes of p, and stores the rest under a new continuation token.
+// The final chunk carries the tag over the full plaintext.
+func (s *server) chunk(p *partialRecord) *pb.Record {
+	if len(p.rest) <= maxChunkSize {
+		return &pb.Record{Plaintext: p.rest, Tag: p.tag, ChallengeSig: p.sig}
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatal(err)
+	}
+	token := hex.EncodeToString(buf)
+
+	r := &pb.Record{Plaintext: p.rest[:maxChunkSize], ContinuationToken: token}
+	p.rest = p.rest[maxChunkSize:]
+
+	s.mu.Lock()
+	s.pending.add(token, p, s.clock.Now())
+	s.mu.Unlock()
+
+	return r
 }
 
 func (s *server) GetRootTreeHash(ctx context.Context, in *pb.RootTreeHashRequest) (*pb.RootTreeHash, error) {
 
-	rth, signature := d.SignRootTreeHash(in.Nonce)
-	return &pb.RootTreeHash{Rth: rth, Nonce: in.Nonce, Sig: signature}, nil
+	version := in.Version
+	if version != rthsig.Canonical {
+		version = rthsig.Legacy
+	}
+	rth, treeSize, timestamp, signature := d.SignRootTreeHash(in.Nonce, version)
+	resp := &pb.RootTreeHash{Rth: rth, Nonce: in.Nonce, Sig: signature, TreeSize: treeSize, Timestamp: timestamp, Version: version}
+
+	// anchor every RTH before a client gets to see it
+	if s.anchors != nil {
+		if err := s.anchors.Append(rth); err != nil {
+			return nil, err
+		}
+		index, size, path, err := s.anchors.InclusionProof(rth, in.AnchorTreeSize)
+		if err != nil {
+			return nil, err
+		}
+		resp.Anchor = &pb.AnchorProof{LeafIndex: index, TreeSize: size, AuditPath: path}
+	}
+	return resp, nil
+}
+
+func (s *server) GetRootTreeHashHistory(ctx context.Context, in *pb.RootTreeHashHistoryRequest) (*pb.RootTreeHashHistory, error) {
+	count := in.Count
+	if count == 0 || count > maxHistory {
+		count = maxHistory
+	}
+
+	h, signature, err := d.SignRootTreeHashHistory(in.Nonce, in.Start, count)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RootTreeHashHistory{Start: h.Start, Rths: h.RTHs, TreeSizes: h.TreeSizes, Nonce: h.Nonce, Timestamp: h.Timestamp, Sig: signature}, nil
 }
 
 func (s *server) GetPublicKey(ctx context.Context, in *pb.PublicKeyRequest) (*pb.Quote, error) {
@@ -46,7 +217,36 @@ func (s *server) GetPublicKey(ctx context.Context, in *pb.PublicKeyRequest) (*pb
 	return &pb.Quote{Quote: "{QUOTE: {}}", RSA_EncryptionKey: ek, RSA_VerificationKey: vk}, nil
 }
 
+// clientHost returns the host the call came from. Partial records are bounded per host rather than
+// per client identifier, which every client chooses for itself.
+func clientHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// logClientID logs every call with the identifier the client sent in its metadata
+func logClientID(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := "unknown"
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md["client-id"]; len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	log.Printf("%s from client %q", info.FullMethod, id)
+
+	return handler(ctx, req)
+}
+
 func main() {
+	flag.Parse()
+
 	// Initialize device
 	initialRTH := sha256.Sum256([]byte(""))
 	log.Println("Initial RTH: ", hex.EncodeToString(initialRTH[:]))
@@ -57,8 +257,20 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
-	s := grpc.NewServer()
-	pb.RegisterDecryptionDeviceServer(s, &server{})
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(logClientID)}
+	if *tlsCert != "" {
+		creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("failed to load the TLS certificate: %v", err)
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s := grpc.NewServer(opts...)
+	srv := newServer(clock.Real)
+	if *anchorLog {
+		srv.anchors = newMemoryLog()
+	}
+	pb.RegisterDecryptionDeviceServer(s, srv)
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
 	if err := s.Serve(lis); err != nil {
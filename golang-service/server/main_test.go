@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sewelol/sgx-decryption-service/clock"
+)
+
+func testPartialRecord(ciphertext []byte, client string) *partialRecord {
+	plaintext := bytes.Repeat([]byte{'p'}, 2*maxChunkSize)
+	tag := sha256.Sum256(plaintext)
+	return &partialRecord{ctSum: sha256.Sum256(ciphertext), rest: plaintext, tag: tag[:], client: client}
+}
+
+func TestPendingBounded(t *testing.T) {
+	c := clock.NewFake(time.Unix(1500000000, 0))
+	s := newServer(c)
+	ciphertext := []byte("ciphertext")
+
+	first := s.chunk(testPartialRecord(ciphertext, "client0")).ContinuationToken
+	c.Advance(time.Second)
+	for i := 0; i < maxPending+10; i++ {
+		s.chunk(testPartialRecord(ciphertext, fmt.Sprintf("client%d", i%(maxPending/maxPendingPerClient+1))))
+	}
+	if len(s.pending.records) > maxPending {
+		t.Fatalf("%d partial records held, at most %d allowed", len(s.pending.records), maxPending)
+	}
+	if _, err := s.nextChunk(ciphertext, first); err == nil {
+		t.Fatal("token of an evicted partial record accepted")
+	}
+}
+
+func TestPendingPerClient(t *testing.T) {
+	c := clock.NewFake(time.Unix(1500000000, 0))
+	s := newServer(c)
+	ciphertext := []byte("ciphertext")
+
+	other := s.chunk(testPartialRecord(ciphertext, "other")).ContinuationToken
+	c.Advance(time.Second)
+	first := s.chunk(testPartialRecord(ciphertext, "flood")).ContinuationToken
+	for i := 0; i < maxPending+10; i++ {
+		s.chunk(testPartialRecord(ciphertext, "flood"))
+	}
+
+	if n := s.pending.clients["flood"].Len(); n != maxPendingPerClient {
+		t.Errorf("%d partial records held for the flooding client, want %d", n, maxPendingPerClient)
+	}
+	if _, err := s.nextChunk(ciphertext, first); err == nil {
+		t.Error("oldest token of the flooding client accepted after it exceeded its share")
+	}
+	if r, err := s.nextChunk(ciphertext, other); err != nil || r.Tag == nil {
+		t.Errorf("token of another client evicted by the flood: %v", err)
+	}
+}
+
+func TestPendingExpires(t *testing.T) {
+	c := clock.NewFake(time.Unix(1500000000, 0))
+	s := newServer(c)
+	ciphertext := []byte("ciphertext")
+
+	live := s.chunk(testPartialRecord(ciphertext, "client")).ContinuationToken
+	if r, err := s.nextChunk(ciphertext, live); err != nil || r.Tag == nil {
+		t.Fatalf("final chunk: %v", err)
+	}
+
+	stale := s.chunk(testPartialRecord(ciphertext, "client")).ContinuationToken
+	c.Advance(pendingTTL + time.Second)
+	if _, err := s.nextChunk(ciphertext, stale); err == nil {
+		t.Fatal("expired token accepted")
+	}
+
+	// expired partial records are dropped when the next token is issued, the ones still valid are kept
+	expired := s.chunk(testPartialRecord(ciphertext, "client")).ContinuationToken
+	c.Advance(pendingTTL / 2)
+	valid := s.chunk(testPartialRecord(ciphertext, "other")).ContinuationToken
+	c.Advance(pendingTTL/2 + time.Second)
+	s.chunk(testPartialRecord(ciphertext, "other"))
+	if _, ok := s.pending.records[expired]; ok {
+		t.Fatal("expired partial record still held")
+	}
+	if _, ok := s.pending.records[valid]; !ok {
+		t.Fatal("partial record dropped before it expired")
+	}
+	if _, ok := s.pending.clients["client"]; ok {
+		t.Error("client without partial records still tracked")
+	}
+}
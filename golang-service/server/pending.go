@@ -0,0 +1,66 @@
+package main
+
+import (
+	"container/list"
+	"time"
+)
+
+// pendingRecords holds the partial records by continuation token. Every token lives for
+// pendingTTL, so the order tokens were issued in is the order they expire in: records are
+// kept in that order, overall and per client, and evicting one takes constant time.
+// A client host holding maxPendingPerClient records evicts its own oldest, not another client's.
+// It is not safe for concurrent use.
+type pendingRecords struct {
+	records map[string]*partialRecord
+	order   *list.List            // *partialRecord, oldest first
+	clients map[string]*list.List // *partialRecord of every client host, oldest first
+}
+
+func newPendingRecords() *pendingRecords {
+	return &pendingRecords{records: make(map[string]*partialRecord), order: list.New(), clients: make(map[string]*list.List)}
+}
+
+// add stores p under the token, after dropping the records expired at now and the oldest
+// records while there is no room for p
+func (r *pendingRecords) add(token string, p *partialRecord, now time.Time) {
+	for e := r.order.Front(); e != nil && now.Sub(e.Value.(*partialRecord).issued) > pendingTTL; e = r.order.Front() {
+		r.remove(e.Value.(*partialRecord))
+	}
+
+	if own := r.clients[p.client]; own != nil && own.Len() >= maxPendingPerClient {
+		r.remove(own.Front().Value.(*partialRecord))
+	}
+	if r.order.Len() >= maxPending {
+		r.remove(r.order.Front().Value.(*partialRecord))
+	}
+
+	own := r.clients[p.client]
+	if own == nil {
+		own = list.New()
+		r.clients[p.client] = own
+	}
+
+	p.token, p.issued = token, now
+	p.elem, p.clientElem = r.order.PushBack(p), own.PushBack(p)
+	r.records[token] = p
+}
+
+// take removes and returns the record stored under the token, nil if there is none
+func (r *pendingRecords) take(token string) *partialRecord {
+	p, ok := r.records[token]
+	if !ok {
+		return nil
+	}
+	r.remove(p)
+	return p
+}
+
+func (r *pendingRecords) remove(p *partialRecord) {
+	delete(r.records, p.token)
+	r.order.Remove(p.elem)
+	own := r.clients[p.client]
+	own.Remove(p.clientElem)
+	if own.Len() == 0 {
+		delete(r.clients, p.client)
+	}
+}